@@ -0,0 +1,119 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// errStreamAbandoned is returned by readStream for a stream the loadgen
+// stopped reading on purpose, like a user navigating away mid-reply.
+var errStreamAbandoned = errors.New("stream abandoned")
+
+// Outcomes of checking what the backend did with an abandoned stream.
+const (
+	abandonCompleted = "completed"
+	abandonCancelled = "cancelled"
+	abandonError     = "error"
+)
+
+// abandonEvents is the range of events after which a stream is abandoned,
+// parsed from cfg.StreamAbandonEvents.
+var abandonEvents = [2]int{1, 10}
+
+// parseIntRange parses a range such as "1-10", or a single number.
+func parseIntRange(spec string) ([2]int, error) {
+	from, to, found := strings.Cut(spec, "-")
+	if !found {
+		to = from
+	}
+	lo, err := strconv.Atoi(strings.TrimSpace(from))
+	if err != nil {
+		return [2]int{}, fmt.Errorf("%q must look like min-max", spec)
+	}
+	hi, err := strconv.Atoi(strings.TrimSpace(to))
+	if err != nil {
+		return [2]int{}, fmt.Errorf("%q must look like min-max", spec)
+	}
+	if lo < 1 || hi < lo {
+		return [2]int{}, fmt.Errorf("%q must be a range of positive numbers, min first", spec)
+	}
+	return [2]int{lo, hi}, nil
+}
+
+// pickAbandonAfter decides whether a stream is abandoned, for a
+// cfg.StreamAbandonFraction share of them, and after how many events. It
+// returns 0 for a stream that is read to the end.
+func pickAbandonAfter() int {
+	if cfg.StreamAbandonFraction <= 0 || rng.Float64() >= cfg.StreamAbandonFraction {
+		return 0
+	}
+	return abandonEvents[0] + rng.Intn(abandonEvents[1]-abandonEvents[0]+1)
+}
+
+// abandonChecks tracks the checkAbandoned calls in progress, so the run's
+// totals are only reported once they have recorded their outcomes.
+var abandonChecks sync.WaitGroup
+
+// checkAbandoned waits cfg.StreamAbandonCheckDelay after a stream on the
+// session was abandoned and then looks in the session's events for a model
+// reply to the message sent as parts. A reply means the backend kept
+// generating after the client went away; none means it cancelled.
+func checkAbandoned(ctx context.Context, sess *session, parts []part) {
+	if sleep(ctx, cfg.StreamAbandonCheckDelay) != nil {
+		return
+	}
+	events, err := fetchSessionEvents(ctx, sess)
+	outcome := abandonCancelled
+	switch {
+	case err != nil:
+		outcome = abandonError
+		slog.Log(ctx, slog.LevelWarn, "Error checking abandoned stream", "session_id", sess.id, "error", err)
+	case hasReply(events, messageText(parts)):
+		outcome = abandonCompleted
+	}
+	stats.recordAbandonOutcome(outcome)
+	slog.Log(ctx, slog.LevelDebug, "Checked abandoned stream", "session_id", sess.id, "outcome", outcome)
+}
+
+// hasReply reports whether a model turn with text follows the latest user
+// message with text want, before the next user message.
+func hasReply(events []adkEvent, want string) bool {
+	for i := len(events) - 1; i >= 0; i-- {
+		c := events[i].Content
+		if c == nil || c.Role != "user" || messageText(c.Parts) != want {
+			continue
+		}
+		for _, ev := range events[i+1:] {
+			if ev.Content == nil {
+				continue
+			}
+			if ev.Content.Role == "user" {
+				return false
+			}
+			if ev.Content.Role == "model" && strings.TrimSpace(messageText(ev.Content.Parts)) != "" {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// operationRun is the chat request that every other operation is mixed in
+// alongside.
+const operationRun = "run"
+
+// An operation is a request other than /run that virtual users can send on
+// sess, weighted by API_MIX.
+type operation func(ctx context.Context, sess *session) error
+
+// operations are the requests API_MIX can mix in, by name.
+var operations = map[string]operation{
+	// health is the endpoint PREFLIGHT checks.
+	"health": func(ctx context.Context, sess *session) error {
+		return getEndpoint(ctx, sess.user, "/list-apps")
+	},
+	"list_sessions": func(ctx context.Context, sess *session) error {
+		return getEndpoint(ctx, sess.user, fmt.Sprintf("/apps/%s/users/%s/sessions", url.PathEscape(sess.app), url.PathEscape(sess.user)))
+	},
+	"get_session": func(ctx context.Context, sess *session) error {
+		_, err := fetchSessionEvents(ctx, sess)
+		return err
+	},
+}
+
+// apiMix is parsed from cfg.APIMix. It is nil when only /run is sent.
+var apiMix []weighted
+
+// parseAPIMix parses API_MIX, e.g. "run=10,list_sessions=1,health=1".
+func parseAPIMix(spec []string) ([]weighted, error) {
+	if len(spec) == 0 {
+		return nil, nil
+	}
+	mix, err := parseWeighted(spec)
+	if err != nil {
+		return nil, err
+	}
+	for _, it := range mix {
+		if _, ok := operations[it.name]; !ok && it.name != operationRun {
+			return nil, fmt.Errorf("unknown operation %q", it.name)
+		}
+	}
+	return mix, nil
+}
+
+// pickOperation returns the name of the next operation to send.
+func pickOperation() string {
+	if len(apiMix) == 0 {
+		return operationRun
+	}
+	return apiMix[pickWeighted(apiMix)].name
+}
+
+// sendOperation sends the operation name on sess and records it with the
+// chat requests, tagged with the operation.
+func sendOperation(ctx context.Context, sess *session, name string) error {
+	start := time.Now()
+	err := operations[name](ctx, sess)
+	stats.recordChat(time.Since(start), err, tag{Key: "operation", Value: name})
+	return err
+}
+
+// getEndpoint sends a GET request for path to the chat server as user and
+// discards the response.
+func getEndpoint(ctx context.Context, user, path string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", cfg.ChatServer+path, nil)
+	if err != nil {
+		return err
+	}
+	setAuthUser(req, user)
+	setVUHeader(ctx, req)
+
+	resp, err := chatClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &statusError{code: resp.StatusCode}
+	}
+	return nil
+}
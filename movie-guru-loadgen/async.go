@@ -0,0 +1,96 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// awaitAsync polls for the result of a chat request the server accepted
+// with 202 Accepted, at the URL in its Location or Operation-Location
+// header, until the result is ready or cfg.AsyncTimeout passes. It returns
+// the response holding the result. The poll waits cfg.AsyncPollInterval, or
+// as long as a Retry-After header asks, between polls.
+func awaitAsync(ctx, reqCtx context.Context, accepted *http.Response) (*http.Response, error) {
+	loc := accepted.Header.Get("Location")
+	if loc == "" {
+		loc = accepted.Header.Get("Operation-Location")
+	}
+	_, _ = io.Copy(io.Discard, accepted.Body)
+	accepted.Body.Close()
+	if loc == "" {
+		return nil, fmt.Errorf("server accepted the request asynchronously but sent no Location or Operation-Location header to poll")
+	}
+	pollURL, err := accepted.Request.URL.Parse(loc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid polling URL %q: %w", loc, err)
+	}
+
+	reqCtx, cancel := context.WithTimeoutCause(reqCtx, cfg.AsyncTimeout, fmt.Errorf("async result not ready within ASYNC_TIMEOUT %v: %w", cfg.AsyncTimeout, context.DeadlineExceeded))
+	wait := retryAfter(accepted)
+	for polls := 1; ; polls++ {
+		if err := sleep(reqCtx, wait); err != nil {
+			cancel()
+			return nil, context.Cause(reqCtx)
+		}
+		req, _ := http.NewRequestWithContext(reqCtx, http.MethodGet, pollURL.String(), nil)
+		setAuthUser(req, accepted.Request.Header.Get(authUserHeader))
+		setVUHeader(ctx, req)
+		asyncPolls.Inc()
+		resp, err := chatClient.Do(req)
+		if err != nil {
+			cancel()
+			if cause := context.Cause(reqCtx); cause != nil {
+				return nil, cause
+			}
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusAccepted {
+			slog.Log(ctx, slog.LevelDebug, "Async result ready", "polls", polls, "status", resp.StatusCode)
+			// The result body is read under the polling deadline too.
+			resp.Body = cancelOnClose{resp.Body, cancel}
+			return resp, nil
+		}
+		wait = retryAfter(resp)
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+// retryAfter returns how long a 202 response asks to wait before polling,
+// or cfg.AsyncPollInterval.
+func retryAfter(resp *http.Response) time.Duration {
+	if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s >= 0 {
+		return time.Duration(s) * time.Second
+	}
+	return cfg.AsyncPollInterval
+}
+
+// cancelOnClose cancels a context once the body read under it is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
@@ -0,0 +1,179 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// responsePair is a prompt and the chat server's reply to it, as stored in
+// RESPONSE_RECORD_FILE and RESPONSE_BASELINE_FILE.
+type responsePair struct {
+	Key      string `json:"key"`
+	Prompt   string `json:"prompt"`
+	Response string `json:"response"`
+}
+
+// responseKey identifies a prompt across runs.
+func responseKey(prompt string) string {
+	sum := sha256.Sum256([]byte(prompt))
+	return hex.EncodeToString(sum[:8])
+}
+
+// responseRecorder keeps the first reply to each prompt so it can be saved
+// as a baseline, and compares replies with a baseline saved by an earlier
+// run with the same seed and prompts.
+type responseRecorder struct {
+	mu       sync.Mutex
+	recorded map[string]responsePair
+	baseline map[string]responsePair
+
+	compared  int
+	changed   int
+	diffTotal float64
+}
+
+// responses is nil unless RESPONSE_RECORD_FILE or RESPONSE_BASELINE_FILE is
+// set. Its methods are no-ops on nil.
+var responses *responseRecorder
+
+// newResponseRecorder loads the baseline at baselinePath, if set.
+func newResponseRecorder(baselinePath string) (*responseRecorder, error) {
+	r := &responseRecorder{recorded: map[string]responsePair{}}
+	if baselinePath == "" {
+		return r, nil
+	}
+	f, err := os.Open(baselinePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r.baseline = map[string]responsePair{}
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for dec.More() {
+		var p responsePair
+		if err := dec.Decode(&p); err != nil {
+			return nil, err
+		}
+		r.baseline[p.Key] = p
+	}
+	return r, nil
+}
+
+// record stores the first reply to prompt and, the first time prompt is
+// seen, compares the reply with the baseline's.
+func (r *responseRecorder) record(ctx context.Context, prompt, reply string) {
+	if r == nil {
+		return
+	}
+	key := responseKey(prompt)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.recorded[key]; ok {
+		return
+	}
+	r.recorded[key] = responsePair{Key: key, Prompt: prompt, Response: reply}
+
+	base, ok := r.baseline[key]
+	if !ok {
+		return
+	}
+	r.compared++
+	diff := responseDifference(base.Response, reply)
+	responseDifferences.Observe(diff)
+	if diff > 0 {
+		r.changed++
+		r.diffTotal += diff
+		slog.Log(ctx, slog.LevelInfo, "Response changed from baseline", "key", key, "difference", diff)
+	}
+}
+
+// responseDifference is 1 minus the Jaccard similarity of the words of a
+// and b: 0 for the same words, 1 for no words in common.
+func responseDifference(a, b string) float64 {
+	wa, wb := wordSet(a), wordSet(b)
+	if len(wa) == 0 && len(wb) == 0 {
+		return 0
+	}
+	common := 0
+	for w := range wa {
+		if wb[w] {
+			common++
+		}
+	}
+	return 1 - float64(common)/float64(len(wa)+len(wb)-common)
+}
+
+func wordSet(s string) map[string]bool {
+	words := map[string]bool{}
+	for _, w := range strings.Fields(strings.ToLower(s)) {
+		words[strings.Trim(w, ".,!?;:\"'()*")] = true
+	}
+	delete(words, "")
+	return words
+}
+
+// finish logs how the run's replies compare with the baseline and saves the
+// recorded replies to recordPath, if set.
+func (r *responseRecorder) finish(recordPath string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.baseline != nil {
+		var changedFraction, meanDiff float64
+		if r.compared > 0 {
+			changedFraction = float64(r.changed) / float64(r.compared)
+		}
+		if r.changed > 0 {
+			meanDiff = r.diffTotal / float64(r.changed)
+		}
+		slog.Log(context.Background(), slog.LevelInfo, "Responses compared with baseline",
+			"baseline", len(r.baseline), "compared", r.compared, "changed", r.changed,
+			"changed_fraction", changedFraction, "mean_difference_of_changed", meanDiff)
+	}
+	if recordPath == "" {
+		return nil
+	}
+
+	f, err := os.Create(recordPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	// Sorted so that recordings of the same prompts diff cleanly.
+	for _, key := range slices.Sorted(maps.Keys(r.recorded)) {
+		if err = enc.Encode(r.recorded[key]); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,64 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"unicode/utf8"
+)
+
+// binaryPreviewLen is how many bytes of a binary body are logged.
+const binaryPreviewLen = 64
+
+// binaryResponseError is returned for a chat response whose body isn't text,
+// such as a compressed or truncated body a misbehaving proxy passed on.
+type binaryResponseError struct {
+	size    int
+	preview string
+}
+
+func (e *binaryResponseError) Error() string {
+	return fmt.Sprintf("binary chat response (%d bytes): %s", e.size, e.preview)
+}
+
+// isBinary reports whether b isn't UTF-8 text. NUL bytes are valid UTF-8
+// but never appear in JSON or event streams, so they count as binary too.
+func isBinary(b []byte) bool {
+	return !utf8.Valid(b) || bytes.IndexByte(b, 0) >= 0
+}
+
+// checkBinary returns a binaryResponseError if body is binary.
+func checkBinary(body []byte) error {
+	if !isBinary(body) {
+		return nil
+	}
+	return &binaryResponseError{size: len(body), preview: binaryPreview(body)}
+}
+
+// binaryPreview encodes the start of b, in cfg.BinaryPreview encoding, for
+// logging in place of the raw bytes.
+func binaryPreview(b []byte) string {
+	head, more := b, ""
+	if len(b) > binaryPreviewLen {
+		head, more = b[:binaryPreviewLen], "…"
+	}
+	if cfg.BinaryPreview == "base64" {
+		return "base64:" + base64.StdEncoding.EncodeToString(head) + more
+	}
+	return "hex:" + hex.EncodeToString(head) + more
+}
@@ -0,0 +1,111 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestCheckBinary(t *testing.T) {
+	// A gzipped /run response served without Content-Encoding, as a
+	// misconfigured proxy might.
+	fixture, err := os.ReadFile("testdata/binary_response.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name        string
+		body        []byte
+		encoding    string
+		wantPreview string
+	}{
+		{name: "json", body: []byte(`[{"content":{"role":"model","parts":[{"text":"Try Amélie."}]}}]`)},
+		{name: "empty", body: nil},
+		{name: "gzip hex", body: fixture, encoding: "hex", wantPreview: "hex:1f8b0800"},
+		{name: "gzip base64", body: fixture, encoding: "base64", wantPreview: "base64:H4sIAAAAAAAC"},
+		{name: "nul byte", body: []byte("{\"a\":\x00}"), encoding: "hex", wantPreview: "hex:7b2261223a007d"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg.BinaryPreview = tc.encoding
+			err := checkBinary(tc.body)
+			if tc.wantPreview == "" {
+				if err != nil {
+					t.Fatalf("checkBinary() error = %v, want nil", err)
+				}
+				return
+			}
+			var be *binaryResponseError
+			if !errors.As(err, &be) {
+				t.Fatalf("checkBinary() error = %v, want a binaryResponseError", err)
+			}
+			if got := errorClass(err); got != errorClassBinary {
+				t.Errorf("errorClass() = %q, want %q", got, errorClassBinary)
+			}
+			if !strings.HasPrefix(be.preview, tc.wantPreview) {
+				t.Errorf("preview = %q, want prefix %q", be.preview, tc.wantPreview)
+			}
+			if len(tc.body) > binaryPreviewLen && !strings.HasSuffix(be.preview, "…") {
+				t.Errorf("preview = %q, want it truncated", be.preview)
+			}
+			for _, logged := range []string{logJSON(tc.body), bodySnippet(tc.body)} {
+				if logged != be.preview || !utf8.ValidString(logged) {
+					t.Errorf("logged %q, want the preview %q", logged, be.preview)
+				}
+			}
+		})
+	}
+}
+
+func TestRunLoadCountsBinaryResponses(t *testing.T) {
+	fixture, err := os.ReadFile("testdata/binary_response.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := newFakeBackends(t)
+	binary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sessions" {
+			f.chat.Config.Handler.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(fixture)
+	}))
+	defer binary.Close()
+
+	setupRun(t, f, map[string]string{
+		"CHAT_SERVER": binary.URL,
+		"RATE_LIMIT":  "6000",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	summary, err := runLoad(ctx)
+	if err != nil {
+		t.Fatalf("runLoad() error = %v", err)
+	}
+	if summary.Requests == 0 || summary.ErrorsByClass[errorClassBinary] != summary.Requests {
+		t.Errorf("summary requests = %d, binary errors = %d, want every request to fail as binary", summary.Requests, summary.ErrorsByClass[errorClassBinary])
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"time"
+)
+
+// transport is shared by every outgoing request so connections are pooled
+// across the prompt and chat servers.
+var transport = http.DefaultTransport.(*http.Transport).Clone()
+
+var (
+	chatClient   = &http.Client{Transport: transport}
+	promptClient = &http.Client{Transport: transport, Timeout: 60 * time.Second}
+)
+
+// aborted is cancelled to abort chat requests that would otherwise be left
+// to finish, when the watchdog gives up on a hung backend.
+var aborted, abortInflight = context.WithCancel(context.Background())
+
+// setupTransport applies the TLS and connection pool settings from cfg to
+// the shared transport and, when a HAR file is requested, starts recording
+// traffic.
+func setupTransport() {
+	if cfg.MaxConnsPerHost > 0 {
+		transport.MaxConnsPerHost = cfg.MaxConnsPerHost
+		transport.MaxIdleConnsPerHost = cfg.MaxConnsPerHost
+		slog.Log(context.Background(), slog.LevelInfo, "Limiting connections per host", "max_conns_per_host", cfg.MaxConnsPerHost)
+	}
+
+	if cfg.InsecureSkipVerify {
+		slog.Log(context.Background(), slog.LevelWarn, "!!! INSECURE_SKIP_VERIFY is enabled: TLS certificates are NOT verified. Never use this against production backends !!!")
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	if len(tlsPins) > 0 {
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.VerifyPeerCertificate = verifyPins
+		slog.Log(context.Background(), slog.LevelInfo, "Pinning TLS certificates", "pins", len(tlsPins))
+	}
+
+	if cfg.HARFile != "" {
+		har = &harRecorder{}
+		recording := &harTransport{next: transport, rec: har}
+		chatClient.Transport = recording
+		promptClient.Transport = recording
+		slog.Log(context.Background(), slog.LevelInfo, "Recording HTTP traffic", "har_file", cfg.HARFile, "include_bodies", cfg.HARIncludeBodies)
+	}
+
+	if cfg.TraceHTTP {
+		chatClient.Transport = &tracingTransport{next: chatClient.Transport}
+		promptClient.Transport = &tracingTransport{next: promptClient.Transport}
+		if !slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+			slog.Log(context.Background(), slog.LevelWarn, "TRACE_HTTP logs at debug level, set LOG_LEVEL=DEBUG to see the timings")
+		}
+	}
+
+	// Outermost, so the HAR file and traces see the signature.
+	if cfg.RequestSigningSecret != "" {
+		chatClient.Transport = &signingTransport{next: chatClient.Transport, secret: []byte(cfg.RequestSigningSecret), header: cfg.RequestSignatureHeader}
+		slog.Log(context.Background(), slog.LevelInfo, "Signing chat requests", "header", cfg.RequestSignatureHeader)
+	}
+}
+
+// markCanary adds cfg.CanaryHeader and cfg.CanaryCookie, whichever are set,
+// so the backend routes req to the canary.
+func markCanary(req *http.Request) {
+	if name, value, ok := strings.Cut(cfg.CanaryHeader, ":"); ok {
+		req.Header.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	if name, value, ok := strings.Cut(cfg.CanaryCookie, "="); ok {
+		req.AddCookie(&http.Cookie{Name: strings.TrimSpace(name), Value: strings.TrimSpace(value)})
+	}
+}
+
+// connWaitTrace returns a context that measures how long a request waits
+// for a connection from the pool. Time spent dialing and in the TLS
+// handshake is excluded, so with MAX_CONNS_PER_HOST set the result is the
+// time queued behind the limit. wait must only be called once the request
+// has returned.
+func connWaitTrace(ctx context.Context) (context.Context, func() time.Duration) {
+	var getConn, gotConn time.Time
+	var connectStart, tlsStart time.Time
+	var dialing time.Duration
+	trace := &httptrace.ClientTrace{
+		GetConn:           func(string) { getConn = time.Now() },
+		ConnectStart:      func(string, string) { connectStart = time.Now() },
+		ConnectDone:       func(string, string, error) { dialing += time.Since(connectStart) },
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { dialing += time.Since(tlsStart) },
+		GotConn:           func(httptrace.GotConnInfo) { gotConn = time.Now() },
+	}
+	wait := func() time.Duration {
+		if getConn.IsZero() || gotConn.IsZero() {
+			return 0
+		}
+		return max(0, gotConn.Sub(getConn)-dialing)
+	}
+	return httptrace.WithClientTrace(ctx, trace), wait
+}
+
+// readBody reads resp.Body and returns it with how long the body took to
+// arrive once the response headers were received. A body slower than
+// cfg.StallThreshold is logged as stalled, which separates servers that
+// accept a request quickly but then trickle or never finish the body from
+// slow connects.
+func readBody(resp *http.Response, start time.Time) ([]byte, time.Duration, error) {
+	headersAt := time.Now()
+	body, err := readAll(resp)
+	bodyTime := time.Since(headersAt)
+
+	if bodyTime > cfg.StallThreshold {
+		slog.Log(resp.Request.Context(), slog.LevelWarn, "Stalled response body", "url", resp.Request.URL.String(), "time_to_headers", headersAt.Sub(start), "body_time", bodyTime, "error", err)
+	}
+	return body, bodyTime, err
+}
+
+// errBodyTooLarge is returned for a response body longer than
+// cfg.MaxBodyBytes.
+var errBodyTooLarge = errors.New("response body too large")
+
+// readAll reads resp.Body, up to cfg.MaxBodyBytes. When the server sends a
+// Content-Length the buffer is sized for it up front, which saves the
+// reallocations io.ReadAll makes as the body grows.
+func readAll(resp *http.Response) ([]byte, error) {
+	return readAllSized(resp.Body, resp.ContentLength, cfg.MaxBodyBytes)
+}
+
+// readAllSized reads r to EOF like io.ReadAll. If size isn't negative the
+// buffer starts with room for size bytes; otherwise io.ReadAll does the
+// reading. It fails with errBodyTooLarge once more than limit bytes have been
+// read, or up front if size is over limit.
+func readAllSized(r io.Reader, size, limit int64) ([]byte, error) {
+	if size > limit {
+		return nil, fmt.Errorf("%w: Content-Length %d exceeds %d bytes", errBodyTooLarge, size, limit)
+	}
+	lr := io.LimitReader(r, limit+1)
+	var b []byte
+	var err error
+	if size < 0 {
+		b, err = io.ReadAll(lr)
+	} else {
+		b, err = readInto(make([]byte, 0, size+1), lr)
+	}
+	if err == nil && int64(len(b)) > limit {
+		return b[:limit], fmt.Errorf("%w: exceeds %d bytes", errBodyTooLarge, limit)
+	}
+	return b, err
+}
+
+// readInto appends r to b until EOF. The spare byte readAllSized allocates
+// lets the final read see EOF without growing b.
+func readInto(b []byte, r io.Reader) ([]byte, error) {
+	for {
+		if len(b) == cap(b) {
+			// Let append pick how much to grow by.
+			b = append(b, 0)[:len(b)]
+		}
+		n, err := r.Read(b[len(b):cap(b)])
+		b = b[:len(b)+n]
+		if err == io.EOF {
+			return b, nil
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+}
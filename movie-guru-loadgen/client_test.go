@@ -0,0 +1,112 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadAllSized(t *testing.T) {
+	body := strings.Repeat("x", 1000)
+	for _, tc := range []struct {
+		name    string
+		size    int64
+		limit   int64
+		want    int
+		wantErr error
+	}{
+		{name: "content length", size: 1000, limit: 2000, want: 1000},
+		{name: "no content length", size: -1, limit: 2000, want: 1000},
+		{name: "short content length", size: 10, limit: 2000, want: 1000},
+		{name: "at limit", size: -1, limit: 1000, want: 1000},
+		{name: "over limit", size: -1, limit: 999, want: 999, wantErr: errBodyTooLarge},
+		{name: "content length over limit", size: 1000, limit: 999, wantErr: errBodyTooLarge},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := readAllSized(strings.NewReader(body), tc.size, tc.limit)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("readAllSized() error = %v, want %v", err, tc.wantErr)
+			}
+			if len(got) != tc.want || strings.Trim(string(got), "x") != "" {
+				t.Errorf("readAllSized() read %d bytes, want %d", len(got), tc.want)
+			}
+		})
+	}
+}
+
+func TestReadStreamMaxGap(t *testing.T) {
+	// Ten lines 20ms apart, then one after 100ms: a stream that takes
+	// 300ms in all but never waits more than 100ms.
+	pr, pw := io.Pipe()
+	go func() {
+		for range 10 {
+			time.Sleep(20 * time.Millisecond)
+			_, _ = io.WriteString(pw, ": keepalive\n")
+		}
+		time.Sleep(100 * time.Millisecond)
+		_, _ = io.WriteString(pw, "data: {}\n")
+		pw.Close()
+	}()
+	resp := &http.Response{Body: pr}
+
+	res, bodyTime, err := readStream(resp, func() {}, 0)
+	if err != nil {
+		t.Fatalf("readStream() error = %v", err)
+	}
+	if res.maxGap < 100*time.Millisecond || res.maxGap > 200*time.Millisecond {
+		t.Errorf("readStream() maxGap = %v, want about 100ms", res.maxGap)
+	}
+	if bodyTime < 300*time.Millisecond {
+		t.Errorf("readStream() bodyTime = %v, want at least 300ms", bodyTime)
+	}
+}
+
+// BenchmarkReadBody compares reading a typical /run response with
+// io.ReadAll against readAllSized with and without a Content-Length.
+func BenchmarkReadBody(b *testing.B) {
+	body := bytes.Repeat([]byte(`{"content":{"role":"model","parts":[{"text":"Try Despicable Me."}]}},`), 1000)
+	size := int64(len(body))
+
+	b.Run("ReadAll", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := io.ReadAll(bytes.NewReader(body)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Sized", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := readAllSized(bytes.NewReader(body), size, 16<<20); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Unsized", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := readAllSized(bytes.NewReader(body), -1, 16<<20); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
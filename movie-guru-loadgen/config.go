@@ -0,0 +1,1050 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultPromptStripPatterns remove the preambles Gemma most often puts
+// before the question. An interjection is only stripped when punctuation
+// follows it, so questions that start with "ok" keep it.
+var defaultPromptStripPatterns = []string{
+	`(?i)^(sure|okay|ok|certainly)\s*[^\w\s"“*]+\s*`,
+	`^here('s| is) (a|my|the|your)( next| follow-up)? question[^\w"“*]*`,
+	`^(question|user|you)\s*:\s*`,
+}
+
+// config holds the settings read from the environment.
+type config struct {
+	// PromptSource is where prompts come from: "ollama", "seed" or "static".
+	PromptSource string `json:"prompt_source"`
+	// SeedFile holds one prompt per line for the "seed" source.
+	SeedFile string `json:"seed_file"`
+	// VUPromptFiles pins prompt files to virtual users, as "vu=file". A
+	// pinned virtual user sends its file's prompts in order instead of
+	// generated ones.
+	VUPromptFiles []string `json:"vu_prompt_files"`
+	// FallbackPrompt is sent when the prompt source fails, so the chat
+	// server stays under load: a prompt, or "@path" for a file of them.
+	FallbackPrompt string `json:"fallback_prompt"`
+	// ReplayTiming reads stdin lines as "timestamp<TAB>prompt" and sends
+	// them with their recorded spacing, divided by ReplaySpeed.
+	ReplayTiming bool    `json:"replay_timing"`
+	ReplaySpeed  float64 `json:"replay_speed"`
+	// CSVFile holds the rows PromptTemplate's {column} placeholders are
+	// filled from for the "csv" source, one row per prompt.
+	CSVFile        string `json:"csv_file"`
+	PromptTemplate string `json:"prompt_template"`
+	// PromptServer is the base URL of the Ollama server. It is only
+	// required by the "ollama" source.
+	PromptServer string `json:"prompt_server"`
+	// ConfigFile is a file of KEY=VALUE settings applied over the
+	// environment, and reloaded on SIGHUP, see reloadConfig.
+	ConfigFile string `json:"config_file"`
+	// ChatServer is the base URL of the movie-guru-agent chat server.
+	ChatServer string `json:"chat_server"`
+	// RateLimit is the maximum number of chat requests per minute.
+	RateLimit float64 `json:"rate_limit"`
+	// RateLimitShards splits RateLimit evenly between this many limiters,
+	// each serving a slice of the virtual users, to cut contention at high
+	// virtual user counts.
+	RateLimitShards int `json:"rate_limit_shards"`
+	// PerUserRate, when set, gives every virtual user its own limiter at
+	// this many chat requests per minute instead of sharing RateLimit, so
+	// load scales with VirtualUsers.
+	PerUserRate float64 `json:"per_user_rate"`
+	// BurstMode zeroes think times and the session cooldown so virtual
+	// users send as fast as the rate limiter allows, for stress tests.
+	// UnsafeNoRateLimit lifts the rate limit as well.
+	BurstMode         bool `json:"burst_mode"`
+	UnsafeNoRateLimit bool `json:"unsafe_no_rate_limit"`
+	// RunDuration bounds the run. Zero runs until interrupted.
+	RunDuration time.Duration `json:"run_duration"`
+	// MaxWallClock force-exits the process this long after it started,
+	// even if graceful shutdown is stuck. Zero disables it.
+	MaxWallClock time.Duration `json:"max_wall_clock"`
+	// StartupDelay holds off preflight checks, session creation and load
+	// this long after boot, for backends that come up after the loadgen.
+	StartupDelay time.Duration `json:"startup_delay"`
+	// MaxErrorRate fails the process when more than this percentage of the
+	// run's chat requests failed. The default of 100 never fails.
+	MaxErrorRate float64 `json:"max_error_rate"`
+	// FlushTimeout bounds how long shutdown waits for metrics exporters to
+	// send their final data.
+	FlushTimeout time.Duration `json:"flush_timeout"`
+	// MinResponseChars flags successful replies shorter than this many
+	// characters as short. Zero disables the check.
+	MinResponseChars int `json:"min_response_chars"`
+	// CheckStreamIntegrity checks streamed responses for duplicate,
+	// out-of-order or inconsistent events.
+	CheckStreamIntegrity bool `json:"check_stream_integrity"`
+	// ResponseRecordFile is where the first reply to each prompt is saved
+	// when the run ends, to serve as a later run's ResponseBaselineFile.
+	ResponseRecordFile string `json:"response_record_file"`
+	// ResponseBaselineFile holds replies from an earlier run to compare this
+	// run's replies with.
+	ResponseBaselineFile string `json:"response_baseline_file"`
+	// ManifestFile is where the run's manifest, its effective configuration
+	// and build, is written when the run starts.
+	ManifestFile string `json:"manifest_file"`
+	// ResultsGCSURI, gs://bucket/prefix, receives a gzipped tarball of the
+	// run's summary, report, manifest and artifact files when it ends.
+	ResultsGCSURI        string        `json:"results_gcs_uri"`
+	ResultsUploadTimeout time.Duration `json:"results_upload_timeout"`
+	// UserFile lists the identities, one email address per line, that
+	// sessions are created for and requests are sent as. Virtual users pick
+	// a session of the next identity in turn or, with UserRotation "vu",
+	// always their own identity's.
+	UserFile     string `json:"user_file"`
+	UserRotation string `json:"user_rotation"`
+	// SplitFraction is the fraction of chat requests whose prompt is split
+	// into multiple message parts.
+	SplitFraction float64 `json:"split_fraction"`
+	// SplitStrategy decides where a prompt is split: "sentence" or "line".
+	SplitStrategy string `json:"split_strategy"`
+	// EmptyPromptAction is what happens when the prompt server returns an
+	// empty prompt: "skip" the chat request or "regenerate" the prompt.
+	EmptyPromptAction string `json:"empty_prompt_action"`
+	// InsecureSkipVerify disables TLS certificate verification. It is only
+	// meant for test environments with self-signed certificates.
+	InsecureSkipVerify bool `json:"insecure_skip_verify"`
+	// TLSPins, when set, fail TLS connections to backends whose certificate
+	// chain matches none of them. See parseTLSPins.
+	TLSPins []string `json:"tls_pins"`
+	// VirtualUsers is the number of concurrent workers sending requests.
+	VirtualUsers int `json:"virtual_users"`
+	// TargetRPS, when set, switches to closed-loop mode: virtual users are
+	// added or removed to keep completed requests per second near it.
+	TargetRPS float64 `json:"target_rps"`
+	// MaxVirtualUsers caps the number of workers in closed-loop mode.
+	MaxVirtualUsers int `json:"max_virtual_users"`
+	// DisableCache makes every chat request a cache miss by appending a
+	// nonce to the prompt and sending Cache-Control: no-cache.
+	DisableCache bool `json:"disable_cache"`
+	// MonitoringProject is the GCP project Cloud Monitoring metrics are
+	// exported to. Export is disabled when empty.
+	MonitoringProject string `json:"monitoring_project"`
+	// MonitoringInterval is how often metrics are pushed to Cloud Monitoring.
+	MonitoringInterval time.Duration `json:"monitoring_interval"`
+	// RuntimeLogInterval is how often the loadgen logs its own goroutine
+	// count, heap size and GC and scheduler latency. 0 disables it.
+	RuntimeLogInterval time.Duration `json:"runtime_log_interval"`
+	// SelfThrottleCPU is the loadgen's own CPU usage, as a percentage of
+	// GOMAXPROCS cores, above which it cuts its rate limit. Usage is
+	// measured every SelfThrottleInterval. 0 disables it.
+	SelfThrottleCPU      float64       `json:"self_throttle_cpu"`
+	SelfThrottleInterval time.Duration `json:"self_throttle_interval"`
+	// MetricsLogInterval is how often the request rate, error rate and
+	// latency percentiles since the last such log line are logged. Zero
+	// disables it.
+	MetricsLogInterval time.Duration `json:"metrics_log_interval"`
+	// MultiTurn makes each virtual user hold a conversation, generating each
+	// question from the previous replies instead of starting over.
+	MultiTurn bool `json:"multi_turn"`
+	// MaxConversationTokens ends a multi-turn conversation once the
+	// estimated tokens of its questions and answers reach it, and starts the
+	// next on a fresh session. Zero lets conversations run for good.
+	MaxConversationTokens int `json:"max_conversation_tokens"`
+	// HistoryTurns is how many prior turns are shown to the prompt server
+	// when generating a follow-up question.
+	HistoryTurns int `json:"history_turns"`
+	// OrderedTurns, in multi-turn mode, holds each of a virtual user's
+	// requests until its previous one has been answered, so its turns reach
+	// the chat server strictly in order. Other virtual users aren't held up,
+	// even on a shared session.
+	OrderedTurns bool `json:"ordered_turns"`
+	// StallThreshold is how long a response body may take to arrive after
+	// its headers, or a stream may go between lines, before the response
+	// is counted as stalled.
+	StallThreshold time.Duration `json:"stall_threshold"`
+	// WarmBackends sends an unrecorded prompt generation and chat request
+	// before the run so cold-start latency isn't measured.
+	WarmBackends bool `json:"warm_backends"`
+	// Preflight checks that the backends are reachable and accept our
+	// requests before the run starts, see preflight.
+	Preflight bool `json:"preflight"`
+	// HARFile is where a HAR archive of all HTTP traffic is written at the
+	// end of the run. Recording is disabled when empty.
+	HARFile string `json:"har_file"`
+	// TraceHTTP logs the DNS, connect, TLS, request write and first byte
+	// timings of every request at debug level.
+	TraceHTTP bool `json:"trace_http"`
+	// TraceExemplars starts a W3C trace for every chat request and attaches
+	// its trace id to the latency histograms as an exemplar.
+	TraceExemplars bool `json:"trace_exemplars"`
+	// ClientSendTime sends each chat request's send time in the
+	// X-Client-Send-Time header. ServerReceiveTimeHeader names a response
+	// header the backend reports when it received the request in, to
+	// measure the delay in front of its processing.
+	ClientSendTime          bool   `json:"client_send_time"`
+	ServerReceiveTimeHeader string `json:"server_receive_time_header"`
+	// ServerTimingHeaders are the response headers, tried in order, the
+	// backend reports its processing time in.
+	ServerTimingHeaders []string `json:"server_timing_headers"`
+	// RequestSigningSecret, when set, signs every chat server request body
+	// with HMAC-SHA256 into the RequestSignatureHeader header. It is kept
+	// out of the manifest.
+	RequestSigningSecret   string `json:"-"`
+	RequestSignatureHeader string `json:"request_signature_header"`
+	// HARIncludeBodies adds request and response bodies to the HAR file.
+	HARIncludeBodies bool `json:"har_include_bodies"`
+	// HARRedactHeaders lists headers whose values are replaced in the HAR file.
+	HARRedactHeaders []string `json:"har_redact_headers"`
+	// SessionInflight is how many requests each virtual user may have in
+	// flight on its session at once.
+	SessionInflight int `json:"session_inflight"`
+	// SessionRaceFraction is the share of turns sent as SessionRaceTurns
+	// overlapping requests on the same session, to probe how the backend
+	// handles concurrent turns, see raceTurns.
+	SessionRaceFraction float64 `json:"session_race_fraction"`
+	SessionRaceTurns    int     `json:"session_race_turns"`
+	// Seed seeds every random choice so a run can be reproduced.
+	Seed int64 `json:"seed"`
+	// BodyLogSampleRate is the fraction of chat requests whose full request
+	// and response bodies are logged.
+	BodyLogSampleRate float64 `json:"body_log_sample_rate"`
+	// BinaryPreview is how the start of a binary response body is encoded
+	// for logging: hex or base64.
+	BinaryPreview string `json:"binary_preview"`
+	// LogJSONPretty indents the JSON bodies that are logged instead of
+	// compacting them onto one line.
+	LogJSONPretty bool `json:"log_json_pretty"`
+	// AgeMin and AgeMax bound the sampled age of each synthetic user.
+	AgeMin int `json:"age_min"`
+	AgeMax int `json:"age_max"`
+	// AgeTemplates maps age bands to persona prompt template files, see
+	// parseAgeTemplates.
+	AgeTemplates string `json:"age_templates"`
+	// ResponseDiversityWindow is how many of the latest successful replies
+	// are hashed to flag a backend that gives the same reply whatever the
+	// prompt: when more than DuplicateThreshold percent of them are
+	// identical. Zero disables it.
+	ResponseDiversityWindow int     `json:"response_diversity_window"`
+	DuplicateThreshold      float64 `json:"response_duplicate_threshold"`
+	// ShuffleGenres shuffles the genres listed in each persona prompt.
+	ShuffleGenres bool `json:"shuffle_genres"`
+	// MaxConnsPerHost caps the connections opened to each backend host.
+	// Requests beyond it wait for a free connection. Zero means no limit.
+	MaxConnsPerHost int `json:"max_conns_per_host"`
+	// ReportURL and ReportFile receive the mergeable run report at the end
+	// of the run, for combining results with the aggregate command.
+	ReportURL  string `json:"report_url"`
+	ReportFile string `json:"report_file"`
+	// SnapshotDir is where POST /snapshot writes its files.
+	SnapshotDir string `json:"snapshot_dir"`
+	// BlockedPromptPatterns are case-insensitive regular expressions that
+	// generated prompts must not match.
+	BlockedPromptPatterns []string `json:"blocked_prompt_patterns"`
+	// BlockedPromptAction is what happens to a prompt matching one of
+	// BlockedPromptPatterns: "skip" the chat request or "regenerate".
+	BlockedPromptAction string `json:"blocked_prompt_action"`
+	// PromptStripPatterns are regular expressions removed from generated
+	// prompts, such as preambles before the question.
+	PromptStripPatterns []string `json:"prompt_strip_patterns"`
+	// MaxRetries is how many times a failed chat request is retried.
+	MaxRetries int `json:"max_retries"`
+	// RetryBackoff is the delay distribution (see parseSampler) of the
+	// first retry. It doubles for each further retry of the same request.
+	RetryBackoff string `json:"retry_backoff"`
+	// RetryBudgetPercent caps retries across the run at this percentage of
+	// requests sent, plus RetryBudgetMin.
+	RetryBudgetPercent float64 `json:"retry_budget_percent"`
+	RetryBudgetMin     int     `json:"retry_budget_min"`
+	// RetryStatusCodes are the chat server statuses that are retried.
+	RetryStatusCodes []int `json:"retry_status_codes"`
+	// RetryOnTimeout also retries requests that timed out, which the server
+	// may have processed.
+	RetryOnTimeout bool `json:"retry_on_timeout"`
+	// FailFast stops the run on the first failed request, without
+	// retrying, and dumps the request and response verbatim.
+	FailFast bool `json:"fail_fast"`
+	// RequestTimeouts bounds each attempt at a chat request, escalating
+	// through the list on retries and staying on the last entry once it runs
+	// out. Empty leaves chat requests without a timeout.
+	RequestTimeouts []time.Duration `json:"request_timeouts"`
+	// VerifyEvents fetches the session after each successful chat request
+	// to check the user message was stored.
+	VerifyEvents bool `json:"verify_events"`
+	// ValidateResponses fails successful chat responses that don't end in a
+	// model turn with text.
+	ValidateResponses bool `json:"validate_responses"`
+	// MinThinkTime is the least time a virtual user waits after a response
+	// before sending its next request.
+	MinThinkTime time.Duration `json:"min_think_time"`
+	// ThinkTime is the delay distribution (see parseSampler) of the time a
+	// virtual user waits after a response. MinThinkTime is its floor.
+	ThinkTime string `json:"think_time"`
+	// StartupJitter is the delay distribution of the time each virtual user
+	// waits before its first request, to spread out their start.
+	StartupJitter string `json:"startup_jitter"`
+	// SessionPoolSize is how many sessions per app are created at startup
+	// for virtual users to draw their own from. Zero shares one session per
+	// app between all virtual users.
+	SessionPoolSize int `json:"session_pool_size"`
+	// SharedSessions is how many sessions per app are created at startup
+	// for all virtual users to send requests on in turn. Zero or one
+	// shares a single session per app.
+	SharedSessions int `json:"shared_sessions"`
+	// SessionPoolJitter is the delay distribution of the pause before each
+	// pooled session is created.
+	SessionPoolJitter string `json:"session_pool_jitter"`
+	// SessionCooldown is the delay distribution of the pause between a
+	// virtual user ending a conversation and starting a new session, like
+	// the gap between a person's visits.
+	SessionCooldown string `json:"session_cooldown"`
+	// StatsdHost and StatsdPort locate a StatsD server that request counts
+	// and timings are sent to as they are recorded.
+	StatsdHost string `json:"statsd_host"`
+	StatsdPort int    `json:"statsd_port"`
+	// StatsdPrefix is prepended to every StatsD metric name.
+	StatsdPrefix string `json:"statsd_prefix"`
+	// DogStatsD adds tags to StatsD metrics in the DogStatsD format.
+	DogStatsD bool `json:"dogstatsd"`
+	// CanaryFraction is the fraction of chat requests marked for the canary
+	// with CanaryHeader ("Name: value") and CanaryCookie ("name=value").
+	CanaryFraction float64 `json:"canary_fraction"`
+	CanaryHeader   string  `json:"canary_header"`
+	CanaryCookie   string  `json:"canary_cookie"`
+	// RateRamp, when set, raises the rate limit linearly from
+	// RateRampStartRPM to RateLimit over this long at the start of the run.
+	RateRamp time.Duration `json:"rate_ramp"`
+	// RateShortfallWindow is how long the achieved request rate is averaged
+	// over before it is compared with the rate limit. A warning is logged
+	// when it is below RateShortfallRatio of the limit. Zero disables it.
+	RateShortfallWindow time.Duration `json:"rate_shortfall_window"`
+	RateShortfallRatio  float64       `json:"rate_shortfall_ratio"`
+	RateRampStartRPM    float64       `json:"rate_ramp_start_rpm"`
+	// ReportFormat, when set, prints the final statistics to stdout as
+	// "json", "table" or "markdown".
+	ReportFormat string `json:"report_format"`
+	// Streaming sends chat requests to /run_sse and reads the reply as
+	// server-sent events.
+	Streaming bool `json:"streaming"`
+	// StreamIdleTimeout fails a stream that sends nothing, not even a
+	// keepalive comment, for this long. Zero disables it.
+	StreamIdleTimeout time.Duration `json:"stream_idle_timeout"`
+	// StreamAbandonFraction is the share of streams closed after a random
+	// number of events in the StreamAbandonEvents range, like a user
+	// navigating away. StreamAbandonCheckDelay later, the session is checked
+	// for whether the backend finished the reply anyway.
+	StreamAbandonFraction   float64       `json:"stream_abandon_fraction"`
+	StreamAbandonEvents     string        `json:"stream_abandon_events"`
+	StreamAbandonCheckDelay time.Duration `json:"stream_abandon_check_delay"`
+	// StallTimeout aborts the run when no chat request completes for this
+	// long. Zero disables it.
+	StallTimeout time.Duration `json:"stall_timeout"`
+	// BreakerThreshold is how many consecutive failures open a backend
+	// endpoint's circuit breaker, holding requests to it back for
+	// BreakerCooldown; see endpointHealth.wait. 0 disables the breakers.
+	BreakerThreshold int           `json:"circuit_breaker_threshold"`
+	BreakerCooldown  time.Duration `json:"circuit_breaker_cooldown"`
+	// PromptModels are the prompt server models prompts are generated with,
+	// each optionally weighted as "model=weight".
+	PromptModels []string `json:"prompt_models"`
+	// AppNames are the ADK apps load is sent to, each optionally weighted as
+	// "app=weight".
+	AppNames []string `json:"app_names"`
+
+	// APIMix weights the operations virtual users send, such as
+	// "run=10,list_sessions=1". When empty, only /run is sent.
+	APIMix []string `json:"api_mix,omitempty"`
+	// AppRateLimits caps the request rate of individual apps, as
+	// "app=requests_per_minute", within the overall RateLimit.
+	AppRateLimits []string `json:"app_rate_limits"`
+	// SessionIDHeader is the response header a new session's id is read
+	// from when the response body doesn't contain it.
+	SessionIDHeader string `json:"session_id_header"`
+	// SessionCreatePath overrides the path sessions are created at, with
+	// {app}, {user} and {id} placeholders. SessionCreateMethod is the
+	// method used to create them.
+	SessionCreatePath   string `json:"session_create_path"`
+	SessionCreateMethod string `json:"session_create_method"`
+	// PromptBuffer is how many prompts for new conversations are generated
+	// ahead of time by PromptGenerators goroutines. 0 generates every
+	// prompt on demand.
+	PromptBuffer     int `json:"prompt_buffer"`
+	PromptGenerators int `json:"prompt_generators"`
+	// PromptBatchSize is how many opening prompts are asked for in one
+	// prompt server call. 1 asks for each prompt separately.
+	PromptBatchSize int `json:"prompt_batch_size"`
+	// PromptBudget caps prompt generation per run, as a number of requests
+	// or, suffixed with "tokens", of estimated tokens generated.
+	PromptBudget string `json:"prompt_budget"`
+	// AsyncMode polls for the result of chat requests the server accepts
+	// with 202 Accepted, every AsyncPollInterval for up to AsyncTimeout.
+	AsyncMode         bool          `json:"async_mode"`
+	AsyncPollInterval time.Duration `json:"async_poll_interval"`
+	AsyncTimeout      time.Duration `json:"async_timeout"`
+	// MaxBodyBytes caps the size of a response body read from the chat or
+	// prompt server.
+	MaxBodyBytes int64 `json:"max_body_bytes"`
+	// LatencySeriesFile is where a time series of up to LatencySeriesSamples
+	// chat request latencies, sampled from across the run, is written.
+	LatencySeriesFile    string `json:"latency_series_file"`
+	LatencySeriesSamples int    `json:"latency_series_samples"`
+	// SessionUpdateInterval is how often each virtual user sends
+	// SessionUpdatePayload to SessionUpdatePath with SessionUpdateMethod to
+	// update a session's state. Zero disables it. The default path is
+	// movie-guru-agent's, which only appends an empty event and ignores
+	// the payload.
+	SessionUpdateInterval time.Duration `json:"session_update_interval"`
+	SessionUpdateMethod   string        `json:"session_update_method"`
+	SessionUpdatePath     string        `json:"session_update_path"`
+	SessionUpdatePayload  string        `json:"session_update_payload"`
+}
+
+var cfg config
+
+// stdinFlag selects the stdin prompt source, see runStdin.
+var stdinFlag = flag.Bool("stdin", false, "send each line read from stdin to the chat server in order, then exit")
+
+// forceFlag starts the run even when the preflight check fails.
+var forceFlag = flag.Bool("force", false, "start the run even if the preflight check fails")
+
+func loadConfig() error {
+	if err := applyConfigFile(os.Getenv("CONFIG_FILE")); err != nil {
+		return fmt.Errorf("error loading CONFIG_FILE: %w", err)
+	}
+	cfg = config{
+		ConfigFile:              os.Getenv("CONFIG_FILE"),
+		SeedFile:                os.Getenv("SEED_FILE"),
+		VUPromptFiles:           envList("VU_PROMPT_FILES", nil),
+		FallbackPrompt:          os.Getenv("FALLBACK_PROMPT"),
+		ReplayTiming:            envBool("REPLAY_TIMING", false),
+		ReplaySpeed:             envFloat("REPLAY_SPEED", 1),
+		CSVFile:                 os.Getenv("CSV_FILE"),
+		PromptTemplate:          os.Getenv("PROMPT_TEMPLATE"),
+		PromptServer:            os.Getenv("PROMPT_SERVER"),
+		ChatServer:              os.Getenv("CHAT_SERVER"),
+		RateLimit:               envFloat("RATE_LIMIT", defaultRateLimit),
+		RateLimitShards:         envInt("RATE_LIMIT_SHARDS", 1),
+		PerUserRate:             envFloat("PER_USER_RATE", 0),
+		BurstMode:               envBool("BURST_MODE", false),
+		UnsafeNoRateLimit:       envBool("UNSAFE_NO_RATE_LIMIT", false),
+		RunDuration:             envDuration("RUN_DURATION", 0),
+		MaxWallClock:            envDuration("MAX_WALL_CLOCK", 0),
+		StartupDelay:            envDuration("STARTUP_DELAY", 0),
+		MaxErrorRate:            envFloat("MAX_ERROR_RATE", 100),
+		FlushTimeout:            envDuration("FLUSH_TIMEOUT", 10*time.Second),
+		MinResponseChars:        envInt("MIN_RESPONSE_CHARS", 0),
+		CheckStreamIntegrity:    envBool("CHECK_STREAM_INTEGRITY", false),
+		ResponseRecordFile:      envString("RESPONSE_RECORD_FILE", ""),
+		ResponseBaselineFile:    envString("RESPONSE_BASELINE_FILE", ""),
+		ManifestFile:            envString("MANIFEST_FILE", ""),
+		ResultsGCSURI:           envString("RESULTS_GCS_URI", ""),
+		ResultsUploadTimeout:    envDuration("RESULTS_UPLOAD_TIMEOUT", 2*time.Minute),
+		UserFile:                envString("USER_FILE", ""),
+		UserRotation:            envString("USER_ROTATION", userRotationRequest),
+		SplitFraction:           envFloat("SPLIT_FRACTION", 0),
+		SplitStrategy:           envString("SPLIT_STRATEGY", splitBySentence),
+		EmptyPromptAction:       envString("EMPTY_PROMPT_ACTION", promptActionSkip),
+		InsecureSkipVerify:      envBool("INSECURE_SKIP_VERIFY", false),
+		TLSPins:                 envList("TLS_PINS", nil),
+		VirtualUsers:            envInt("VIRTUAL_USERS", 1),
+		TargetRPS:               envFloat("TARGET_RPS", 0),
+		MaxVirtualUsers:         envInt("MAX_VIRTUAL_USERS", 50),
+		DisableCache:            envBool("DISABLE_CACHE", false),
+		MonitoringProject:       envString("MONITORING_PROJECT_ID", ""),
+		MonitoringInterval:      envDuration("MONITORING_EXPORT_INTERVAL", 60*time.Second),
+		RuntimeLogInterval:      envDuration("RUNTIME_LOG_INTERVAL", 0),
+		SelfThrottleCPU:         envFloat("SELF_THROTTLE_CPU", 0),
+		SelfThrottleInterval:    envDuration("SELF_THROTTLE_INTERVAL", 10*time.Second),
+		MetricsLogInterval:      envDuration("METRICS_LOG_INTERVAL", 0),
+		MultiTurn:               envBool("MULTI_TURN", false),
+		MaxConversationTokens:   envInt("MAX_CONVERSATION_TOKENS", 0),
+		HistoryTurns:            envInt("HISTORY_TURNS", 3),
+		OrderedTurns:            envBool("ORDERED_TURNS", true),
+		StallThreshold:          envDuration("STALL_THRESHOLD", 10*time.Second),
+		WarmBackends:            envBool("WARM_BACKENDS", false),
+		Preflight:               envBool("PREFLIGHT", true),
+		HARFile:                 envString("HAR_FILE", ""),
+		TraceHTTP:               envBool("TRACE_HTTP", false),
+		TraceExemplars:          envBool("TRACE_EXEMPLARS", false),
+		ClientSendTime:          envBool("CLIENT_SEND_TIME", false),
+		ServerReceiveTimeHeader: os.Getenv("SERVER_RECEIVE_TIME_HEADER"),
+		ServerTimingHeaders:     envList("SERVER_TIMING_HEADERS", []string{"Server-Timing", "X-Processing-Time"}),
+		RequestSigningSecret:    os.Getenv("REQUEST_SIGNING_SECRET"),
+		RequestSignatureHeader:  envString("REQUEST_SIGNATURE_HEADER", "X-Signature"),
+		HARIncludeBodies:        envBool("HAR_INCLUDE_BODIES", false),
+		HARRedactHeaders:        envList("HAR_REDACT_HEADERS", []string{"Authorization", "Cookie", "Set-Cookie", "Proxy-Authorization", "X-Goog-Authenticated-User-Email"}),
+		SessionInflight:         envInt("REQUESTS_PER_SESSION_INFLIGHT", 1),
+		SessionRaceFraction:     envFloat("SESSION_RACE_FRACTION", 0),
+		SessionRaceTurns:        envInt("SESSION_RACE_TURNS", 4),
+		Seed:                    envInt64("SEED", time.Now().UnixNano()),
+		LogJSONPretty:           envBool("LOG_JSON_PRETTY", false),
+		BinaryPreview:           envString("BINARY_PREVIEW", "hex"),
+		BodyLogSampleRate:       envFloat("BODY_LOG_SAMPLE_RATE", 1),
+		AgeMin:                  envInt("AGE_MIN", ageMin),
+		AgeMax:                  envInt("AGE_MAX", ageMax),
+		AgeTemplates:            os.Getenv("AGE_TEMPLATES"),
+		ShuffleGenres:           envBool("SHUFFLE_GENRES", true),
+		ResponseDiversityWindow: envInt("RESPONSE_DIVERSITY_WINDOW", 100),
+		DuplicateThreshold:      envFloat("RESPONSE_DUPLICATE_THRESHOLD", 50),
+		MaxConnsPerHost:         envInt("MAX_CONNS_PER_HOST", 0),
+		ReportURL:               os.Getenv("REPORT_URL"),
+		ReportFile:              os.Getenv("REPORT_FILE"),
+		SnapshotDir:             envString("SNAPSHOT_DIR", "."),
+		BlockedPromptPatterns:   envList("BLOCKED_PROMPT_PATTERNS", nil),
+		PromptStripPatterns:     envList("PROMPT_STRIP_PATTERNS", defaultPromptStripPatterns),
+		BlockedPromptAction:     envString("BLOCKED_PROMPT_ACTION", promptActionRegenerate),
+		MaxRetries:              envInt("MAX_RETRIES", 0),
+		RetryBackoff:            envString("RETRY_BACKOFF", "500ms"),
+		RetryBudgetPercent:      envFloat("RETRY_BUDGET_PERCENT", 20),
+		RetryBudgetMin:          envInt("RETRY_BUDGET_MIN", 3),
+		RetryStatusCodes:        envIntList("RETRY_STATUS_CODES", []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}),
+		RetryOnTimeout:          envBool("RETRY_ON_TIMEOUT", false),
+		FailFast:                envBool("FAIL_FAST", false),
+		RequestTimeouts:         envDurationList("REQUEST_TIMEOUTS", nil),
+		VerifyEvents:            envBool("VERIFY_EVENTS", false),
+		ValidateResponses:       envBool("VALIDATE_RESPONSES", false),
+		MinThinkTime:            envDuration("MIN_THINK_TIME", time.Second),
+		ThinkTime:               envString("THINK_TIME", "0"),
+		StartupJitter:           envString("STARTUP_JITTER", "0"),
+		SessionPoolSize:         envInt("SESSION_POOL_SIZE", 0),
+		SharedSessions:          envInt("SHARED_SESSIONS", 0),
+		SessionPoolJitter:       envString("SESSION_POOL_JITTER", "uniform:0s-100ms"),
+		SessionCooldown:         envString("SESSION_COOLDOWN", "0"),
+		StatsdHost:              os.Getenv("STATSD_HOST"),
+		StatsdPort:              envInt("STATSD_PORT", 8125),
+		StatsdPrefix:            envString("STATSD_PREFIX", "loadgen."),
+		DogStatsD:               envBool("DOGSTATSD", false),
+		CanaryFraction:          envFloat("CANARY_FRACTION", 0),
+		CanaryHeader:            envString("CANARY_HEADER", "X-Canary: true"),
+		CanaryCookie:            os.Getenv("CANARY_COOKIE"),
+		RateRamp:                envDuration("RATE_RAMP", 0),
+		RateShortfallWindow:     envDuration("RATE_SHORTFALL_WINDOW", time.Minute),
+		RateShortfallRatio:      envFloat("RATE_SHORTFALL_RATIO", 0.8),
+		RateRampStartRPM:        envFloat("RATE_RAMP_START_RPM", 1),
+		ReportFormat:            os.Getenv("REPORT_FORMAT"),
+		Streaming:               envBool("STREAMING", false),
+		StreamIdleTimeout:       envDuration("STREAM_IDLE_TIMEOUT", time.Minute),
+		StreamAbandonFraction:   envFloat("STREAM_ABANDON_FRACTION", 0),
+		StreamAbandonEvents:     envString("STREAM_ABANDON_EVENTS", "1-10"),
+		StreamAbandonCheckDelay: envDuration("STREAM_ABANDON_CHECK_DELAY", 10*time.Second),
+		StallTimeout:            envDuration("STALL_TIMEOUT", 0),
+		BreakerThreshold:        envInt("CIRCUIT_BREAKER_THRESHOLD", 0),
+		BreakerCooldown:         envDuration("CIRCUIT_BREAKER_COOLDOWN", 30*time.Second),
+		PromptModels:            envList("PROMPT_MODELS", []string{defaultPromptModel}),
+		AppNames:                envList("APP_NAME", []string{defaultAppName}),
+		APIMix:                  envList("API_MIX", nil),
+		AppRateLimits:           envList("APP_RATE_LIMITS", nil),
+		SessionIDHeader:         envString("SESSION_ID_HEADER", "X-Session-Id"),
+		SessionCreatePath:       os.Getenv("SESSION_CREATE_PATH"),
+		SessionCreateMethod:     envString("SESSION_CREATE_METHOD", http.MethodPost),
+		PromptBuffer:            envInt("PROMPT_BUFFER", 0),
+		PromptGenerators:        envInt("PROMPT_GENERATORS", 2),
+		PromptBatchSize:         envInt("PROMPT_BATCH_SIZE", 1),
+		PromptBudget:            envString("PROMPT_BUDGET", ""),
+		AsyncMode:               envBool("ASYNC_MODE", false),
+		AsyncPollInterval:       envDuration("ASYNC_POLL_INTERVAL", time.Second),
+		AsyncTimeout:            envDuration("ASYNC_TIMEOUT", 5*time.Minute),
+		MaxBodyBytes:            envInt64("MAX_BODY_BYTES", 16<<20),
+		LatencySeriesFile:       envString("LATENCY_SERIES_FILE", ""),
+		LatencySeriesSamples:    envInt("LATENCY_SERIES_SAMPLES", 10000),
+		SessionUpdateInterval:   envDuration("SESSION_UPDATE_INTERVAL", 0),
+		SessionUpdateMethod:     envString("SESSION_UPDATE_METHOD", http.MethodPost),
+		SessionUpdatePath:       envString("SESSION_UPDATE_PATH", "/sessions/{id}/events"),
+		SessionUpdatePayload:    envString("SESSION_UPDATE_PAYLOAD", `{"state":{"preferences":{"genres":["comedy"]}}}`),
+	}
+
+	// A seed or CSV file implies its source unless another one is chosen.
+	defaultSource := promptSourceOllama
+	if cfg.SeedFile != "" {
+		defaultSource = promptSourceSeed
+	} else if cfg.CSVFile != "" {
+		defaultSource = promptSourceCSV
+	}
+	cfg.PromptSource = envString("PROMPT_SOURCE", defaultSource)
+	if *stdinFlag {
+		cfg.PromptSource = promptSourceStdin
+	}
+
+	switch cfg.PromptSource {
+	case promptSourceOllama:
+		if cfg.PromptServer == "" {
+			return fmt.Errorf("PROMPT_SERVER not set")
+		}
+	case promptSourceSeed:
+		if cfg.SeedFile == "" {
+			return fmt.Errorf("SEED_FILE not set")
+		}
+	case promptSourceCSV:
+		if cfg.CSVFile == "" || cfg.PromptTemplate == "" {
+			return fmt.Errorf("CSV_FILE and PROMPT_TEMPLATE must both be set")
+		}
+	case promptSourceStatic, promptSourceStdin:
+	default:
+		return fmt.Errorf("PROMPT_SOURCE must be %q, %q, %q, %q or %q, got %q", promptSourceOllama, promptSourceSeed, promptSourceCSV, promptSourceStatic, promptSourceStdin, cfg.PromptSource)
+	}
+	if cfg.ReplaySpeed <= 0 {
+		return fmt.Errorf("REPLAY_SPEED must be positive, got %v", cfg.ReplaySpeed)
+	}
+	if cfg.ReplayTiming && cfg.PromptSource != promptSourceStdin {
+		return fmt.Errorf("REPLAY_TIMING requires the stdin prompt source")
+	}
+	if cfg.ChatServer == "" {
+		return fmt.Errorf("CHAT_SERVER not set")
+	}
+	if cfg.RateLimit <= 0 {
+		return fmt.Errorf("RATE_LIMIT must be positive, got %v", cfg.RateLimit)
+	}
+	if cfg.PerUserRate < 0 {
+		return fmt.Errorf("PER_USER_RATE must not be negative, got %v", cfg.PerUserRate)
+	}
+	if cfg.PerUserRate > 0 && cfg.TargetRPS > 0 {
+		return fmt.Errorf("PER_USER_RATE can't be combined with TARGET_RPS")
+	}
+	if cfg.UnsafeNoRateLimit && !cfg.BurstMode {
+		return fmt.Errorf("UNSAFE_NO_RATE_LIMIT requires BURST_MODE")
+	}
+	if cfg.UnsafeNoRateLimit && cfg.PerUserRate > 0 {
+		return fmt.Errorf("UNSAFE_NO_RATE_LIMIT can't be combined with PER_USER_RATE")
+	}
+	if cfg.RateLimitShards < 1 {
+		return fmt.Errorf("RATE_LIMIT_SHARDS must be at least 1, got %d", cfg.RateLimitShards)
+	}
+	if cfg.RunDuration < 0 {
+		return fmt.Errorf("RUN_DURATION must not be negative, got %v", cfg.RunDuration)
+	}
+	if cfg.MaxErrorRate < 0 || cfg.MaxErrorRate > 100 {
+		return fmt.Errorf("MAX_ERROR_RATE must be a percentage between 0 and 100, got %v", cfg.MaxErrorRate)
+	}
+	if cfg.StartupDelay < 0 {
+		return fmt.Errorf("STARTUP_DELAY must not be negative, got %v", cfg.StartupDelay)
+	}
+	if cfg.MaxWallClock < 0 || (cfg.MaxWallClock > 0 && cfg.MaxWallClock <= cfg.StartupDelay+cfg.RunDuration) {
+		return fmt.Errorf("MAX_WALL_CLOCK must be 0 or longer than STARTUP_DELAY plus RUN_DURATION, got %v", cfg.MaxWallClock)
+	}
+	if cfg.SplitFraction < 0 || cfg.SplitFraction > 1 {
+		return fmt.Errorf("SPLIT_FRACTION must be between 0 and 1, got %v", cfg.SplitFraction)
+	}
+	if cfg.SplitStrategy != splitBySentence && cfg.SplitStrategy != splitByLine {
+		return fmt.Errorf("SPLIT_STRATEGY must be %q or %q, got %q", splitBySentence, splitByLine, cfg.SplitStrategy)
+	}
+	if cfg.EmptyPromptAction != promptActionSkip && cfg.EmptyPromptAction != promptActionRegenerate {
+		return fmt.Errorf("EMPTY_PROMPT_ACTION must be %q or %q, got %q", promptActionSkip, promptActionRegenerate, cfg.EmptyPromptAction)
+	}
+	if cfg.VirtualUsers < 1 {
+		return fmt.Errorf("VIRTUAL_USERS must be at least 1, got %d", cfg.VirtualUsers)
+	}
+	if cfg.TargetRPS < 0 {
+		return fmt.Errorf("TARGET_RPS must not be negative, got %v", cfg.TargetRPS)
+	}
+	if cfg.MaxVirtualUsers < 1 {
+		return fmt.Errorf("MAX_VIRTUAL_USERS must be at least 1, got %d", cfg.MaxVirtualUsers)
+	}
+	// Cloud Monitoring accepts at most one point per time series every 5
+	// seconds and rejects the rest.
+	if cfg.MonitoringProject != "" && cfg.MonitoringInterval < 5*time.Second {
+		return fmt.Errorf("MONITORING_EXPORT_INTERVAL must be at least 5s, got %v", cfg.MonitoringInterval)
+	}
+	if cfg.MaxConversationTokens < 0 {
+		return fmt.Errorf("MAX_CONVERSATION_TOKENS must not be negative, got %d", cfg.MaxConversationTokens)
+	}
+	if cfg.MaxConversationTokens > 0 && !cfg.MultiTurn {
+		return fmt.Errorf("MAX_CONVERSATION_TOKENS requires MULTI_TURN")
+	}
+	if cfg.HistoryTurns < 1 {
+		return fmt.Errorf("HISTORY_TURNS must be at least 1, got %d", cfg.HistoryTurns)
+	}
+	if cfg.StallThreshold <= 0 {
+		return fmt.Errorf("STALL_THRESHOLD must be positive, got %v", cfg.StallThreshold)
+	}
+	if cfg.SessionInflight < 1 {
+		return fmt.Errorf("REQUESTS_PER_SESSION_INFLIGHT must be at least 1, got %d", cfg.SessionInflight)
+	}
+	// Ordered turns hold each of a virtual user's requests until the previous
+	// one is answered, which would queue the extra requests in flight.
+	if cfg.SessionInflight > 1 && cfg.MultiTurn && cfg.OrderedTurns {
+		return fmt.Errorf("REQUESTS_PER_SESSION_INFLIGHT above 1 needs ORDERED_TURNS=false in multi-turn mode, got %d", cfg.SessionInflight)
+	}
+	if cfg.SessionRaceFraction < 0 || cfg.SessionRaceFraction > 1 {
+		return fmt.Errorf("SESSION_RACE_FRACTION must be between 0 and 1, got %v", cfg.SessionRaceFraction)
+	}
+	if cfg.SessionRaceFraction > 0 && cfg.SessionRaceTurns < 2 {
+		return fmt.Errorf("SESSION_RACE_TURNS must be at least 2, got %d", cfg.SessionRaceTurns)
+	}
+	// A race is checked by comparing the session's events before and after
+	// it, so no other virtual user or conversation may send on the session.
+	if cfg.SessionRaceFraction > 0 && (cfg.SessionPoolSize == 0 || cfg.SessionInflight > 1) {
+		return fmt.Errorf("SESSION_RACE_FRACTION needs SESSION_POOL_SIZE, so each virtual user has its own sessions, and REQUESTS_PER_SESSION_INFLIGHT=1")
+	}
+	if cfg.BodyLogSampleRate < 0 || cfg.BodyLogSampleRate > 1 {
+		return fmt.Errorf("BODY_LOG_SAMPLE_RATE must be between 0 and 1, got %v", cfg.BodyLogSampleRate)
+	}
+
+	if cfg.AgeMin < 1 || cfg.AgeMin > cfg.AgeMax {
+		return fmt.Errorf("AGE_MIN and AGE_MAX must satisfy 1 <= AGE_MIN <= AGE_MAX, got %d and %d", cfg.AgeMin, cfg.AgeMax)
+	}
+
+	if cfg.MaxConnsPerHost < 0 {
+		return fmt.Errorf("MAX_CONNS_PER_HOST must not be negative, got %d", cfg.MaxConnsPerHost)
+	}
+
+	if cfg.BlockedPromptAction != promptActionSkip && cfg.BlockedPromptAction != promptActionRegenerate {
+		return fmt.Errorf("BLOCKED_PROMPT_ACTION must be %q or %q, got %q", promptActionSkip, promptActionRegenerate, cfg.BlockedPromptAction)
+	}
+	for _, d := range cfg.RequestTimeouts {
+		if d <= 0 {
+			return fmt.Errorf("REQUEST_TIMEOUTS must be positive, got %v", d)
+		}
+	}
+	if cfg.MaxRetries < 0 {
+		return fmt.Errorf("MAX_RETRIES must not be negative, got %d", cfg.MaxRetries)
+	}
+	backoff, err := parseSampler(cfg.RetryBackoff)
+	if err != nil {
+		return fmt.Errorf("invalid RETRY_BACKOFF: %w", err)
+	}
+	retryBackoff = backoff
+	if cfg.RetryBudgetPercent < 0 || cfg.RetryBudgetMin < 0 {
+		return fmt.Errorf("RETRY_BUDGET_PERCENT and RETRY_BUDGET_MIN must not be negative, got %v and %d", cfg.RetryBudgetPercent, cfg.RetryBudgetMin)
+	}
+	if cfg.BurstMode {
+		cfg.MinThinkTime, cfg.ThinkTime, cfg.SessionCooldown = 0, "0", "0"
+	}
+	if cfg.MinThinkTime < 0 {
+		return fmt.Errorf("MIN_THINK_TIME must not be negative, got %v", cfg.MinThinkTime)
+	}
+	think, err := parseSampler(cfg.ThinkTime)
+	if err != nil {
+		return fmt.Errorf("invalid THINK_TIME: %w", err)
+	}
+	thinkTime = think
+	jitter, err := parseSampler(cfg.StartupJitter)
+	if err != nil {
+		return fmt.Errorf("invalid STARTUP_JITTER: %w", err)
+	}
+	startupJitter = jitter
+	if cfg.SessionPoolSize < 0 {
+		return fmt.Errorf("SESSION_POOL_SIZE must not be negative, got %d", cfg.SessionPoolSize)
+	}
+	if cfg.SharedSessions < 0 {
+		return fmt.Errorf("SHARED_SESSIONS must not be negative, got %d", cfg.SharedSessions)
+	}
+	if cfg.SharedSessions > 0 && cfg.SessionPoolSize > 0 {
+		return fmt.Errorf("SHARED_SESSIONS and SESSION_POOL_SIZE can't both be set")
+	}
+	poolJitter, err := parseSampler(cfg.SessionPoolJitter)
+	if err != nil {
+		return fmt.Errorf("invalid SESSION_POOL_JITTER: %w", err)
+	}
+	sessionPoolJitter = poolJitter
+	if sessionCooldown, err = parseSampler(cfg.SessionCooldown); err != nil {
+		return fmt.Errorf("invalid SESSION_COOLDOWN: %w", err)
+	}
+	// Multi-turn conversations only end at the token cap.
+	if cfg.MultiTurn && cfg.MaxConversationTokens == 0 && sessionCooldown != constSampler(0) {
+		return fmt.Errorf("SESSION_COOLDOWN needs MAX_CONVERSATION_TOKENS in multi-turn mode")
+	}
+	if cfg.ResultsGCSURI != "" {
+		if _, _, err := parseGCSURI(cfg.ResultsGCSURI); err != nil {
+			return fmt.Errorf("RESULTS_GCS_URI: %w", err)
+		}
+	}
+	if cfg.UserRotation != userRotationRequest && cfg.UserRotation != userRotationVU {
+		return fmt.Errorf("USER_ROTATION must be %q or %q, got %q", userRotationRequest, userRotationVU, cfg.UserRotation)
+	}
+	if cfg.MinResponseChars < 0 {
+		return fmt.Errorf("MIN_RESPONSE_CHARS must not be negative, got %d", cfg.MinResponseChars)
+	}
+	if cfg.SessionUpdateInterval < 0 {
+		return fmt.Errorf("SESSION_UPDATE_INTERVAL must not be negative, got %v", cfg.SessionUpdateInterval)
+	}
+	if !json.Valid([]byte(cfg.SessionUpdatePayload)) {
+		return fmt.Errorf("SESSION_UPDATE_PAYLOAD must be valid JSON, got %q", cfg.SessionUpdatePayload)
+	}
+	if cfg.LatencySeriesSamples < 1 {
+		return fmt.Errorf("LATENCY_SERIES_SAMPLES must be at least 1, got %d", cfg.LatencySeriesSamples)
+	}
+	if cfg.MaxBodyBytes < 1 {
+		return fmt.Errorf("MAX_BODY_BYTES must be positive, got %d", cfg.MaxBodyBytes)
+	}
+	promptBudget = nil
+	if cfg.PromptBudget != "" {
+		var err error
+		if promptBudget, err = parsePromptBudget(cfg.PromptBudget); err != nil {
+			return fmt.Errorf("invalid PROMPT_BUDGET: %w", err)
+		}
+	}
+	if cfg.PromptBatchSize < 1 || cfg.PromptBatchSize > maxPromptBatchSize {
+		return fmt.Errorf("PROMPT_BATCH_SIZE must be between 1 and %d, got %d", maxPromptBatchSize, cfg.PromptBatchSize)
+	}
+	if cfg.PromptBuffer < 0 || cfg.PromptGenerators < 1 {
+		return fmt.Errorf("PROMPT_BUFFER must not be negative and PROMPT_GENERATORS must be at least 1, got %d and %d", cfg.PromptBuffer, cfg.PromptGenerators)
+	}
+	if cfg.CanaryFraction < 0 || cfg.CanaryFraction > 1 {
+		return fmt.Errorf("CANARY_FRACTION must be between 0 and 1, got %v", cfg.CanaryFraction)
+	}
+	if cfg.CanaryHeader != "" && !strings.Contains(cfg.CanaryHeader, ":") {
+		return fmt.Errorf("CANARY_HEADER must look like Name: value, got %q", cfg.CanaryHeader)
+	}
+	if cfg.CanaryCookie != "" && !strings.Contains(cfg.CanaryCookie, "=") {
+		return fmt.Errorf("CANARY_COOKIE must look like name=value, got %q", cfg.CanaryCookie)
+	}
+	if cfg.RateRamp < 0 {
+		return fmt.Errorf("RATE_RAMP must not be negative, got %v", cfg.RateRamp)
+	}
+	if cfg.RateRamp > 0 && (cfg.RateRampStartRPM <= 0 || cfg.RateRampStartRPM > cfg.RateLimit) {
+		return fmt.Errorf("RATE_RAMP_START_RPM must be positive and at most RATE_LIMIT, got %v", cfg.RateRampStartRPM)
+	}
+	if cfg.ReportFormat != "" {
+		if _, err := newReporter(cfg.ReportFormat); err != nil {
+			return fmt.Errorf("invalid REPORT_FORMAT: %w", err)
+		}
+	}
+	if cfg.StreamAbandonFraction < 0 || cfg.StreamAbandonFraction > 1 {
+		return fmt.Errorf("STREAM_ABANDON_FRACTION must be between 0 and 1, got %v", cfg.StreamAbandonFraction)
+	}
+	if cfg.StreamAbandonFraction > 0 && !cfg.Streaming {
+		return fmt.Errorf("STREAM_ABANDON_FRACTION requires STREAMING")
+	}
+	if cfg.CheckStreamIntegrity && !cfg.Streaming {
+		return fmt.Errorf("CHECK_STREAM_INTEGRITY requires STREAMING")
+	}
+	if cfg.StreamAbandonCheckDelay < 0 {
+		return fmt.Errorf("STREAM_ABANDON_CHECK_DELAY must not be negative, got %v", cfg.StreamAbandonCheckDelay)
+	}
+	if abandonEvents, err = parseIntRange(cfg.StreamAbandonEvents); err != nil {
+		return fmt.Errorf("invalid STREAM_ABANDON_EVENTS: %w", err)
+	}
+	if cfg.StreamIdleTimeout < 0 {
+		return fmt.Errorf("STREAM_IDLE_TIMEOUT must not be negative, got %v", cfg.StreamIdleTimeout)
+	}
+	if cfg.AsyncMode && (cfg.AsyncPollInterval <= 0 || cfg.AsyncTimeout <= 0) {
+		return fmt.Errorf("ASYNC_POLL_INTERVAL and ASYNC_TIMEOUT must be positive, got %v and %v", cfg.AsyncPollInterval, cfg.AsyncTimeout)
+	}
+	if cfg.RuntimeLogInterval < 0 {
+		return fmt.Errorf("RUNTIME_LOG_INTERVAL must not be negative, got %v", cfg.RuntimeLogInterval)
+	}
+	if cfg.SelfThrottleCPU < 0 || cfg.SelfThrottleCPU > 100 {
+		return fmt.Errorf("SELF_THROTTLE_CPU must be between 0 and 100, got %v", cfg.SelfThrottleCPU)
+	}
+	if cfg.SelfThrottleCPU > 0 && cfg.SelfThrottleInterval <= 0 {
+		return fmt.Errorf("SELF_THROTTLE_INTERVAL must be positive, got %v", cfg.SelfThrottleInterval)
+	}
+	if cfg.SelfThrottleCPU > 0 && cfg.TargetRPS > 0 {
+		return fmt.Errorf("SELF_THROTTLE_CPU can't be combined with TARGET_RPS")
+	}
+	if cfg.RateShortfallWindow < 0 {
+		return fmt.Errorf("RATE_SHORTFALL_WINDOW must not be negative, got %v", cfg.RateShortfallWindow)
+	}
+	if cfg.RateShortfallRatio <= 0 || cfg.RateShortfallRatio > 1 {
+		return fmt.Errorf("RATE_SHORTFALL_RATIO must be above 0 and at most 1, got %v", cfg.RateShortfallRatio)
+	}
+	if cfg.MetricsLogInterval < 0 {
+		return fmt.Errorf("METRICS_LOG_INTERVAL must not be negative, got %v", cfg.MetricsLogInterval)
+	}
+	if cfg.StallTimeout < 0 {
+		return fmt.Errorf("STALL_TIMEOUT must not be negative, got %v", cfg.StallTimeout)
+	}
+	if cfg.BreakerThreshold < 0 {
+		return fmt.Errorf("CIRCUIT_BREAKER_THRESHOLD must not be negative, got %d", cfg.BreakerThreshold)
+	}
+	if cfg.BreakerThreshold > 0 && cfg.BreakerCooldown <= 0 {
+		return fmt.Errorf("CIRCUIT_BREAKER_COOLDOWN must be positive, got %v", cfg.BreakerCooldown)
+	}
+	// An open breaker on the chat server holds every request back, which
+	// the watchdog would take for a stall.
+	if cfg.BreakerThreshold > 0 && cfg.StallTimeout > 0 && cfg.BreakerCooldown >= cfg.StallTimeout {
+		return fmt.Errorf("CIRCUIT_BREAKER_COOLDOWN must be shorter than STALL_TIMEOUT, got %v and %v", cfg.BreakerCooldown, cfg.StallTimeout)
+	}
+	models, err := parseWeighted(cfg.PromptModels)
+	if err != nil {
+		return fmt.Errorf("invalid PROMPT_MODELS: %w", err)
+	}
+	promptModels = models
+	if apps, err = parseWeighted(cfg.AppNames); err != nil {
+		return fmt.Errorf("invalid APP_NAME: %w", err)
+	}
+	if apiMix, err = parseAPIMix(cfg.APIMix); err != nil {
+		return fmt.Errorf("invalid API_MIX: %w", err)
+	}
+	if cfg.SessionCreatePath != "" {
+		if err := validateSessionPath(cfg.SessionCreatePath); err != nil {
+			return fmt.Errorf("invalid SESSION_CREATE_PATH: %w", err)
+		}
+	}
+	if err := validateSessionMethod(cfg.SessionCreateMethod); err != nil {
+		return fmt.Errorf("invalid SESSION_CREATE_METHOD: %w", err)
+	}
+	if tlsPins, err = parseTLSPins(cfg.TLSPins); err != nil {
+		return fmt.Errorf("invalid TLS_PINS: %w", err)
+	}
+	if cfg.ResponseDiversityWindow < 0 {
+		return fmt.Errorf("RESPONSE_DIVERSITY_WINDOW must not be negative, got %d", cfg.ResponseDiversityWindow)
+	}
+	if cfg.DuplicateThreshold <= 0 || cfg.DuplicateThreshold > 100 {
+		return fmt.Errorf("RESPONSE_DUPLICATE_THRESHOLD must be above 0 and at most 100, got %v", cfg.DuplicateThreshold)
+	}
+	if cfg.BinaryPreview != "hex" && cfg.BinaryPreview != "base64" {
+		return fmt.Errorf("BINARY_PREVIEW must be %q or %q, got %q", "hex", "base64", cfg.BinaryPreview)
+	}
+	if appLimiters, err = parseAppRateLimits(cfg.AppRateLimits); err != nil {
+		return fmt.Errorf("invalid APP_RATE_LIMITS: %w", err)
+	}
+
+	stripPrompts = nil
+	for _, p := range cfg.PromptStripPatterns {
+		re, err := regexp.Compile("(?i)" + p)
+		if err != nil {
+			return fmt.Errorf("invalid PROMPT_STRIP_PATTERNS entry %q: %w", p, err)
+		}
+		stripPrompts = append(stripPrompts, re)
+	}
+
+	blockedPrompts = nil
+	for _, p := range cfg.BlockedPromptPatterns {
+		re, err := regexp.Compile("(?i)" + p)
+		if err != nil {
+			return fmt.Errorf("invalid BLOCKED_PROMPT_PATTERNS entry %q: %w", p, err)
+		}
+		blockedPrompts = append(blockedPrompts, re)
+	}
+
+	rng = newLockedRand(cfg.Seed)
+	limiter = newRateLimiter(cfg.RateLimitShards, limiter.Limit())
+	return nil
+}
+
+func envString(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// envList reads a comma-separated list, ignoring empty items.
+func envList(name string, def []string) []string {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		slog.Log(context.Background(), slog.LevelWarn, "Error parsing "+name+", using default", "error", err, "default", def)
+		return def
+	}
+	return i
+}
+
+func envIntList(name string, def []int) []int {
+	var out []int
+	for _, item := range envList(name, nil) {
+		i, err := strconv.Atoi(item)
+		if err != nil {
+			slog.Log(context.Background(), slog.LevelWarn, "Error parsing "+name+", using default", "error", err, "default", def)
+			return def
+		}
+		out = append(out, i)
+	}
+	if out == nil {
+		return def
+	}
+	return out
+}
+
+func envDurationList(name string, def []time.Duration) []time.Duration {
+	var out []time.Duration
+	for _, item := range envList(name, nil) {
+		d, err := time.ParseDuration(item)
+		if err != nil {
+			slog.Log(context.Background(), slog.LevelWarn, "Error parsing "+name+", using default", "error", err, "default", def)
+			return def
+		}
+		out = append(out, d)
+	}
+	if out == nil {
+		return def
+	}
+	return out
+}
+
+func envInt64(name string, def int64) int64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	i, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		slog.Log(context.Background(), slog.LevelWarn, "Error parsing "+name+", using default", "error", err, "default", def)
+		return def
+	}
+	return i
+}
+
+func envFloat(name string, def float64) float64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		slog.Log(context.Background(), slog.LevelWarn, "Error parsing "+name+", using default", "error", err, "default", def)
+		return def
+	}
+	return f
+}
+
+func envBool(name string, def bool) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		slog.Log(context.Background(), slog.LevelWarn, "Error parsing "+name+", using default", "error", err, "default", def)
+		return def
+	}
+	return b
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		slog.Log(context.Background(), slog.LevelWarn, "Error parsing "+name+", using default", "error", err, "default", def)
+		return def
+	}
+	return d
+}
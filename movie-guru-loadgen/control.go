@@ -0,0 +1,171 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// pauseGate lets workers block while load is paused. resumed is closed
+// whenever the gate is open, so waiting on it never blocks in that state.
+type pauseGate struct {
+	mu      sync.Mutex
+	paused  bool
+	resumed chan struct{}
+}
+
+var gate = newPauseGate()
+
+func newPauseGate() *pauseGate {
+	g := &pauseGate{resumed: make(chan struct{})}
+	close(g.resumed)
+	return g
+}
+
+func (g *pauseGate) pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.paused {
+		g.paused = true
+		g.resumed = make(chan struct{})
+	}
+}
+
+func (g *pauseGate) resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused {
+		g.paused = false
+		close(g.resumed)
+	}
+}
+
+func (g *pauseGate) isPaused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused
+}
+
+// wait blocks until the gate is open or ctx is done.
+func (g *pauseGate) wait(ctx context.Context) error {
+	g.mu.Lock()
+	resumed := g.resumed
+	g.mu.Unlock()
+
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// PauseHandler stops workers from dispatching new requests. In-flight
+// requests are allowed to finish.
+func PauseHandler(w http.ResponseWriter, r *http.Request) {
+	gate.pause()
+	slog.Log(r.Context(), slog.LevelInfo, "Load paused")
+	_ = json.NewEncoder(w).Encode(map[string]bool{"paused": true})
+}
+
+// ResumeHandler lets workers dispatch requests again.
+func ResumeHandler(w http.ResponseWriter, r *http.Request) {
+	gate.resume()
+	slog.Log(r.Context(), slog.LevelInfo, "Load resumed")
+	_ = json.NewEncoder(w).Encode(map[string]bool{"paused": false})
+}
+
+// limiterRPM returns the current rate limit in requests per minute, or 0 when
+// the limiter is unlimited.
+func limiterRPM() float64 {
+	if limiter.Limit() == rate.Inf {
+		return 0
+	}
+	return float64(limiter.Limit()) * 60
+}
+
+// setLimit changes the rate limiter's limit and the gauge reporting it.
+func setLimit(l rate.Limit) {
+	limiter.SetLimit(l)
+	rateLimitRPM.Set(limiterRPM())
+}
+
+// rateRampStep is how often the rate limit is raised during a ramp.
+const rateRampStep = time.Second
+
+// rampRate raises the rate limit linearly from fromRPM to toRPM over window,
+// so the backend isn't hit with the full rate the moment the run starts. It
+// stops early if the limit is changed by anything else, e.g. POST /rate.
+func rampRate(ctx context.Context, fromRPM, toRPM float64, window time.Duration) {
+	slog.Log(ctx, slog.LevelInfo, "Ramping up rate limit", "from_rpm", fromRPM, "to_rpm", toRPM, "window", window)
+	start := time.Now()
+	set := rate.Limit(fromRPM / 60.0)
+	setLimit(set)
+
+	ticker := time.NewTicker(rateRampStep)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if limiter.Limit() != set {
+			slog.Log(ctx, slog.LevelInfo, "Rate limit changed during ramp, stopping ramp", "rpm", limiterRPM())
+			return
+		}
+		progress := float64(time.Since(start)) / float64(window)
+		if progress >= 1 {
+			setLimit(rate.Limit(toRPM / 60.0))
+			slog.Log(ctx, slog.LevelInfo, "Rate limit ramp complete", "rpm", toRPM)
+			return
+		}
+		set = rate.Limit((fromRPM + (toRPM-fromRPM)*progress) / 60.0)
+		setLimit(set)
+	}
+}
+
+// rateRequest is the payload accepted by RateHandler.
+type rateRequest struct {
+	RequestsPerMinute float64 `json:"requests_per_minute"`
+}
+
+// RateHandler changes the chat request rate without restarting the run.
+func RateHandler(w http.ResponseWriter, r *http.Request) {
+	var req rateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.RequestsPerMinute <= 0 || math.IsInf(req.RequestsPerMinute, 0) || math.IsNaN(req.RequestsPerMinute) {
+		http.Error(w, "requests_per_minute must be a positive number", http.StatusBadRequest)
+		return
+	}
+
+	previous := limiterRPM()
+	setLimit(rate.Limit(req.RequestsPerMinute / 60.0))
+	slog.Log(r.Context(), slog.LevelInfo, "Rate limit changed", "previous_rpm", previous, "rpm", req.RequestsPerMinute)
+
+	_ = json.NewEncoder(w).Encode(req)
+}
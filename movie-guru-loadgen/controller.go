@@ -0,0 +1,104 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"time"
+)
+
+// controlInterval is how often the throughput controller re-evaluates the
+// number of virtual users.
+const controlInterval = 10 * time.Second
+
+// runThroughputController adds or removes virtual users so that completed
+// chat requests per second track TARGET_RPS (closed-loop load). It runs
+// until ctx is done.
+func runThroughputController(ctx context.Context, pool *workerPool) {
+	ticker := time.NewTicker(controlInterval)
+	defer ticker.Stop()
+
+	last := stats.completed()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		completed := stats.completed()
+		achieved := float64(completed-last) / controlInterval.Seconds()
+		last = completed
+
+		current := pool.size()
+		target := targetRPS()
+		desired := desiredConcurrency(current, achieved, target, cfg.MaxVirtualUsers)
+		if desired != current {
+			slog.Log(ctx, slog.LevelInfo, "Adjusting virtual users", "from", current, "to", desired, "achieved_rps", achieved, "target_rps", target)
+			pool.resize(desired)
+		}
+	}
+}
+
+// desiredConcurrency estimates the number of workers needed to reach target
+// assuming per-worker throughput stays constant. Growth is limited to
+// doubling per interval so a brief lull doesn't cause a burst of new users.
+func desiredConcurrency(current int, achieved, target float64, limit int) int {
+	var desired int
+	if achieved <= 0 {
+		desired = current + 1
+	} else {
+		desired = int(math.Ceil(float64(current) * target / achieved))
+	}
+	return max(min(desired, 2*current, limit), 1)
+}
+
+// errNoThroughput is the cause a run is cancelled with when no chat request
+// completes for cfg.StallTimeout.
+var errNoThroughput = errors.New("no chat requests completed within STALL_TIMEOUT")
+
+// watchdogInterval is how often the watchdog checks for progress.
+const watchdogInterval = time.Second
+
+// runWatchdog cancels the run with errNoThroughput if the number of
+// completed chat requests, successful or not, stops changing for
+// cfg.StallTimeout. Time spent paused doesn't count. It runs until ctx is
+// done.
+func runWatchdog(ctx context.Context, cancel context.CancelCauseFunc) {
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+
+	last, progressAt := stats.completed(), time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if completed := stats.completed(); completed != last || gate.isPaused() {
+			last, progressAt = completed, time.Now()
+			continue
+		}
+		if time.Since(progressAt) >= cfg.StallTimeout {
+			slog.Log(ctx, slog.LevelError, "No chat requests completed, aborting run", "stall_timeout", cfg.StallTimeout, "completed", last)
+			cancel(errNoThroughput)
+			return
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"unicode/utf8"
+)
+
+const followUpPrompt = `%s
+
+**Conversation so far:**
+%s
+Ask your next question, reacting to what the expert just said. Reply with the question only.`
+
+// turn is one question and answer exchanged with the chat server.
+type turn struct {
+	Question string
+	Answer   string
+}
+
+// conversation is the state a virtual user keeps between turns. In
+// single-turn mode a new conversation is started for every request.
+type conversation struct {
+	persona string
+	turns   []turn
+	tokens  int // estimated tokens exchanged, questions and answers
+}
+
+func newConversation() *conversation {
+	age := rng.Intn(cfg.AgeMax-cfg.AgeMin+1) + cfg.AgeMin
+	return &conversation{persona: personaPrompt(age)}
+}
+
+func (c *conversation) add(t turn) {
+	c.turns = append(c.turns, t)
+	c.tokens += estimateTokens(t.Question) + estimateTokens(t.Answer)
+}
+
+// estimateTokens estimates the length of s in tokens, using the rough rule
+// of four characters per token.
+func estimateTokens(s string) int {
+	return int(math.Ceil(float64(utf8.RuneCountInString(s)) / 4))
+}
+
+// generationPrompt is the prompt sent to the prompt server to produce the
+// next user question. Only the last cfg.HistoryTurns turns are included so
+// generation stays bounded as the conversation grows.
+func (c *conversation) generationPrompt() string {
+	if len(c.turns) == 0 {
+		return c.persona
+	}
+
+	window := c.turns[max(0, len(c.turns)-cfg.HistoryTurns):]
+	var history strings.Builder
+	for _, t := range window {
+		fmt.Fprintf(&history, "You: %s\nExpert: %s\n\n", t.Question, t.Answer)
+	}
+	return fmt.Sprintf(followUpPrompt, c.persona, history.String())
+}
+
+// adkEvent is the subset of an ADK event returned by /run that carries the
+// agent's reply. The id, partial flag and timestamp are only used to check
+// the integrity of streams.
+type adkEvent struct {
+	ID        string      `json:"id,omitempty"`
+	Partial   bool        `json:"partial,omitempty"`
+	Timestamp float64     `json:"timestamp,omitempty"`
+	Content   *newMessage `json:"content"`
+}
+
+// extractReply returns the text of the last model message in a /run
+// response, or "" if there is none.
+func extractReply(body []byte) string {
+	var events []adkEvent
+	if err := json.Unmarshal(body, &events); err != nil {
+		return ""
+	}
+	return replyFromEvents(events)
+}
+
+// replyFromEvents returns the text of the last model message in events.
+func replyFromEvents(events []adkEvent) string {
+	for i := len(events) - 1; i >= 0; i-- {
+		c := events[i].Content
+		if c == nil || c.Role != "model" {
+			continue
+		}
+		var text strings.Builder
+		for _, p := range c.Parts {
+			text.WriteString(p.Text)
+		}
+		if text.Len() > 0 {
+			return text.String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,76 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// csvPlaceholder matches the {column} placeholders in PROMPT_TEMPLATE.
+var csvPlaceholder = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// csvSource fills a prompt template with the rows of a CSV file, one row
+// per prompt, cycling through the rows in order across all virtual users.
+// Conversation history is ignored.
+type csvSource struct {
+	template string
+	columns  []string
+	rows     [][]string
+	next     atomic.Uint64
+}
+
+func (c *csvSource) generate(context.Context, *conversation) (string, []tag, error) {
+	row := c.rows[(c.next.Add(1)-1)%uint64(len(c.rows))]
+	return csvPlaceholder.ReplaceAllStringFunc(c.template, func(p string) string {
+		return row[slices.Index(c.columns, p[1:len(p)-1])]
+	}), nil, nil
+}
+
+// newCSVSource reads path, whose first row names the columns, and checks
+// that every placeholder in template is one of them.
+func newCSVSource(path, template string) (*csvSource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) < 2 {
+		return nil, fmt.Errorf("%s needs a header row and at least one row of values", path)
+	}
+	columns := records[0]
+	for i := range columns {
+		columns[i] = strings.TrimSpace(columns[i])
+	}
+	for _, m := range csvPlaceholder.FindAllStringSubmatch(template, -1) {
+		if !slices.Contains(columns, m[1]) {
+			return nil, fmt.Errorf("PROMPT_TEMPLATE placeholder {%s} is not a column of %s, which has %s", m[1], path, strings.Join(columns, ", "))
+		}
+	}
+	return &csvSource{template: template, columns: columns, rows: records[1:]}, nil
+}
@@ -0,0 +1,163 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"strings"
+	"sync"
+)
+
+// diversityTracker keeps the hashes of the latest successful replies, up to
+// RESPONSE_DIVERSITY_WINDOW of them, to catch a backend answering every
+// prompt with the same reply, which latency and error rates don't show.
+type diversityTracker struct {
+	mu     sync.Mutex
+	ring   []uint64
+	next   int
+	full   bool
+	counts map[uint64]int
+	texts  map[uint64]string
+	top    int // the highest count in counts
+	low    bool
+	lows   uint64
+}
+
+// diversity is nil unless RESPONSE_DIVERSITY_WINDOW is set. Its methods are
+// no-ops on nil.
+var diversity *diversityTracker
+
+func newDiversityTracker(window int) *diversityTracker {
+	return &diversityTracker{ring: make([]uint64, window), counts: map[uint64]int{}, texts: map[uint64]string{}}
+}
+
+// diversitySnapshot describes the replies in the window.
+type diversitySnapshot struct {
+	Window   int `json:"window"`
+	Distinct int `json:"distinct"`
+	// MostCommonPercent is the share of the window taken by its most
+	// common reply, quoted in MostCommon while Low.
+	MostCommonPercent float64 `json:"most_common_percent"`
+	MostCommon        string  `json:"most_common,omitempty"`
+	// Low is set while MostCommonPercent is above
+	// RESPONSE_DUPLICATE_THRESHOLD; Lows counts the times it was set.
+	Low  bool   `json:"low"`
+	Lows uint64 `json:"lows"`
+}
+
+// record adds reply to the window and, once the window is full, logs when
+// the most common reply's share crosses cfg.DuplicateThreshold. Empty
+// replies are skipped, so a burst of failures doesn't read as low
+// diversity.
+func (d *diversityTracker) record(ctx context.Context, reply string) {
+	reply = strings.TrimSpace(reply)
+	if d == nil || reply == "" {
+		return
+	}
+	h := fnv.New64a()
+	h.Write([]byte(reply))
+	sum := h.Sum64()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.full {
+		d.evict(d.ring[d.next])
+	}
+	d.ring[d.next] = sum
+	d.next = (d.next + 1) % len(d.ring)
+	d.full = d.full || d.next == 0
+	d.counts[sum]++
+	d.texts[sum] = reply
+	d.top = max(d.top, d.counts[sum])
+	if !d.full {
+		return
+	}
+
+	share := d.share()
+	mostCommonPercent.Set(share)
+	switch {
+	case share > cfg.DuplicateThreshold && !d.low:
+		d.low = true
+		d.lows++
+		lowResponseDiversity.Set(1)
+		slog.Log(ctx, slog.LevelWarn, "Chat responses are suspiciously uniform: the backend may be answering every prompt the same way", "most_common_percent", math.Round(share*10)/10, "window", len(d.ring), "distinct", len(d.counts), "most_common", bodySnippet([]byte(d.mostCommon())))
+	case share <= cfg.DuplicateThreshold && d.low:
+		d.low = false
+		lowResponseDiversity.Set(0)
+		slog.Log(ctx, slog.LevelInfo, "Chat response diversity recovered", "most_common_percent", math.Round(share*10)/10, "window", len(d.ring), "distinct", len(d.counts))
+	}
+}
+
+// evict removes a reply's hash from the counts. d.mu must be held.
+func (d *diversityTracker) evict(sum uint64) {
+	n := d.counts[sum]
+	if n == 1 {
+		delete(d.counts, sum)
+		delete(d.texts, sum)
+	} else {
+		d.counts[sum] = n - 1
+	}
+	if n == d.top {
+		d.top = 0
+		for _, c := range d.counts {
+			d.top = max(d.top, c)
+		}
+	}
+}
+
+// share returns the most common reply's percentage of the replies in the
+// window. d.mu must be held.
+func (d *diversityTracker) share() float64 {
+	n := len(d.ring)
+	if !d.full {
+		n = d.next
+	}
+	if n == 0 {
+		return 0
+	}
+	return 100 * float64(d.top) / float64(n)
+}
+
+// mostCommon returns the most common reply. d.mu must be held.
+func (d *diversityTracker) mostCommon() string {
+	for sum, c := range d.counts {
+		if c == d.top {
+			return d.texts[sum]
+		}
+	}
+	return ""
+}
+
+func (d *diversityTracker) snapshot() *diversitySnapshot {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s := &diversitySnapshot{
+		Window:            len(d.ring),
+		Distinct:          len(d.counts),
+		MostCommonPercent: math.Round(d.share()*10) / 10,
+		Low:               d.low,
+		Lows:              d.lows,
+	}
+	if d.low {
+		s.MostCommon = bodySnippet([]byte(d.mostCommon()))
+	}
+	return s
+}
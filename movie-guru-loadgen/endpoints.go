@@ -0,0 +1,203 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Endpoint states reported in /stats.
+const (
+	endpointHealthy = "healthy"
+	endpointFailing = "failing"
+)
+
+// Circuit breaker states, with CIRCUIT_BREAKER_THRESHOLD. A closed breaker
+// lets requests through. CIRCUIT_BREAKER_THRESHOLD consecutive failures open
+// it, holding requests to the endpoint back for CIRCUIT_BREAKER_COOLDOWN.
+// Then it is half-open: a single probe request goes through, and closes it
+// on success or opens it again on failure.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+// breakerPoll is how often requests held back by a half-open breaker check
+// whether its probe has finished.
+const breakerPoll = 100 * time.Millisecond
+
+// endpointHealth tracks each backend endpoint's recent results so /stats
+// shows which one is failing right now, not only how many requests failed
+// over the run.
+type endpointHealth struct {
+	mu        sync.Mutex
+	endpoints map[string]*endpointStats
+}
+
+type endpointStats struct {
+	requests    uint64
+	failures    uint64
+	consecutive uint64
+	lastError   string
+	lastErrorAt time.Time
+
+	breaker  string
+	trips    uint64
+	openedAt time.Time
+	probeAt  time.Time // when the half-open probe was let through, if it's in flight
+}
+
+// EndpointSnapshot is an endpoint's health in /stats. An endpoint is
+// failing from its first failure until its next success. The breaker
+// fields are only set with CIRCUIT_BREAKER_THRESHOLD.
+type EndpointSnapshot struct {
+	State               string     `json:"state"`
+	Requests            uint64     `json:"requests"`
+	Failures            uint64     `json:"failures"`
+	ConsecutiveFailures uint64     `json:"consecutive_failures"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastErrorTime       *time.Time `json:"last_error_time,omitempty"`
+	Breaker             string     `json:"breaker,omitempty"`
+	BreakerTrips        uint64     `json:"breaker_trips,omitempty"`
+	BreakerOpenUntil    *time.Time `json:"breaker_open_until,omitempty"`
+}
+
+var endpoints = &endpointHealth{endpoints: make(map[string]*endpointStats)}
+
+// get returns endpoint's stats, adding them if needed. h.mu must be held.
+func (h *endpointHealth) get(endpoint string) *endpointStats {
+	e := h.endpoints[endpoint]
+	if e == nil {
+		e = &endpointStats{breaker: breakerClosed}
+		h.endpoints[endpoint] = e
+	}
+	return e
+}
+
+// record counts a request to endpoint that failed with err, or succeeded if
+// err is nil, and moves the endpoint's breaker on. Requests cancelled by the
+// loadgen say nothing about the endpoint and aren't counted.
+func (h *endpointHealth) record(endpoint string, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e := h.get(endpoint)
+	e.requests++
+	if err == nil {
+		e.consecutive = 0
+	} else {
+		e.failures++
+		e.consecutive++
+		e.lastError = err.Error()
+		e.lastErrorAt = time.Now()
+	}
+	endpointConsecutiveFailures.WithLabelValues(endpoint).Set(float64(e.consecutive))
+
+	if cfg.BreakerThreshold <= 0 {
+		return
+	}
+	switch {
+	case err == nil && e.breaker == breakerHalfOpen:
+		e.breaker, e.probeAt = breakerClosed, time.Time{}
+		slog.Log(context.Background(), slog.LevelInfo, "Circuit breaker closed", "endpoint", endpoint)
+	case err != nil && (e.breaker == breakerHalfOpen || e.consecutive >= uint64(cfg.BreakerThreshold)):
+		if e.breaker != breakerOpen {
+			e.trips++
+			slog.Log(context.Background(), slog.LevelWarn, "Circuit breaker opened, holding requests back", "endpoint", endpoint, "consecutive_failures", e.consecutive, "cooldown", cfg.BreakerCooldown, "error", err)
+		}
+		e.breaker, e.openedAt, e.probeAt = breakerOpen, time.Now(), time.Time{}
+	}
+	open := 0.0
+	if e.breaker != breakerClosed {
+		open = 1
+	}
+	endpointBreakerOpen.WithLabelValues(endpoint).Set(open)
+}
+
+// wait blocks while endpoint's breaker holds requests back, until ctx is
+// done, and reports whether it had to. It lets a single probe through a
+// half-open breaker; a probe whose result never comes in, e.g. an abandoned
+// stream, is replaced after another cooldown.
+func (h *endpointHealth) wait(ctx context.Context, endpoint string) (bool, error) {
+	if cfg.BreakerThreshold <= 0 {
+		return false, nil
+	}
+	for waited := false; ; waited = true {
+		h.mu.Lock()
+		e := h.get(endpoint)
+		var d time.Duration
+		switch e.breaker {
+		case breakerOpen:
+			if d = time.Until(e.openedAt.Add(cfg.BreakerCooldown)); d <= 0 {
+				e.breaker, e.probeAt = breakerHalfOpen, time.Now()
+				slog.Log(ctx, slog.LevelInfo, "Circuit breaker half-open, sending a probe", "endpoint", endpoint)
+			}
+		case breakerHalfOpen:
+			if e.probeAt.IsZero() || time.Since(e.probeAt) > cfg.BreakerCooldown {
+				e.probeAt = time.Now()
+			} else {
+				d = breakerPoll
+			}
+		}
+		h.mu.Unlock()
+		if d <= 0 {
+			return waited, nil
+		}
+		if err := sleep(ctx, d); err != nil {
+			return waited, err
+		}
+	}
+}
+
+func (h *endpointHealth) snapshot() map[string]EndpointSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.endpoints) == 0 {
+		return nil
+	}
+	snap := make(map[string]EndpointSnapshot, len(h.endpoints))
+	for name, e := range h.endpoints {
+		s := EndpointSnapshot{
+			State:               endpointHealthy,
+			Requests:            e.requests,
+			Failures:            e.failures,
+			ConsecutiveFailures: e.consecutive,
+			LastError:           e.lastError,
+		}
+		if e.consecutive > 0 {
+			s.State = endpointFailing
+		}
+		if !e.lastErrorAt.IsZero() {
+			t := e.lastErrorAt
+			s.LastErrorTime = &t
+		}
+		if cfg.BreakerThreshold > 0 {
+			s.Breaker, s.BreakerTrips = e.breaker, e.trips
+			if e.breaker == breakerOpen {
+				t := e.openedAt.Add(cfg.BreakerCooldown)
+				s.BreakerOpenUntil = &t
+			}
+		}
+		snap[name] = s
+	}
+	return snap
+}
@@ -0,0 +1,75 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEndpointBreaker(t *testing.T) {
+	cfg.BreakerThreshold, cfg.BreakerCooldown = 2, 50*time.Millisecond
+	t.Cleanup(func() { cfg.BreakerThreshold = 0 })
+	h := &endpointHealth{endpoints: make(map[string]*endpointStats)}
+	const ep = "http://chat/run"
+	boom := errors.New("boom")
+	ctx := context.Background()
+	state := func(want string) {
+		t.Helper()
+		if got := h.snapshot()[ep].Breaker; got != want {
+			t.Fatalf("breaker = %q, want %q", got, want)
+		}
+	}
+
+	h.record(ep, boom)
+	state(breakerClosed)
+	h.record(ep, boom)
+	state(breakerOpen)
+
+	// An open breaker holds requests back for the cooldown, then lets a
+	// probe through.
+	start := time.Now()
+	if waited, err := h.wait(ctx, ep); err != nil || !waited {
+		t.Fatalf("wait() = %v, %v, want a wait", waited, err)
+	}
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Errorf("wait() returned after %v, want about the 50ms cooldown", d)
+	}
+	state(breakerHalfOpen)
+
+	// Only the probe goes through a half-open breaker.
+	shortCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := h.wait(shortCtx, ep); err == nil {
+		t.Errorf("second wait() went through a half-open breaker with its probe in flight")
+	}
+
+	// A failed probe opens the breaker again; a successful one closes it.
+	h.record(ep, boom)
+	state(breakerOpen)
+	if _, err := h.wait(ctx, ep); err != nil {
+		t.Fatal(err)
+	}
+	h.record(ep, nil)
+	state(breakerClosed)
+	if waited, _ := h.wait(ctx, ep); waited {
+		t.Errorf("wait() held a request back with the breaker closed")
+	}
+	if got := h.snapshot()[ep].BreakerTrips; got != 2 {
+		t.Errorf("BreakerTrips = %d, want 2", got)
+	}
+}
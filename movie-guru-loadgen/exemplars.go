@@ -0,0 +1,71 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The loadgen doesn't trace itself, but with TRACE_EXEMPLARS it starts a
+// W3C trace for every chat request by sending a traceparent header. The
+// backend's spans join that trace, and the trace id is attached to the
+// request's latency observation as an OpenMetrics exemplar, so a slow
+// bucket on a dashboard links straight to the backend trace behind it.
+
+type traceKey struct{}
+
+// withTrace returns ctx with a new random trace id, or ctx itself when
+// TRACE_EXEMPLARS is off. Every attempt gets its own trace.
+func withTrace(ctx context.Context) context.Context {
+	if !cfg.TraceExemplars {
+		return ctx
+	}
+	var id [16]byte
+	rand.Read(id[:])
+	return context.WithValue(ctx, traceKey{}, hex.EncodeToString(id[:]))
+}
+
+// traceID returns the trace id in ctx, if any.
+func traceID(ctx context.Context) string {
+	id, _ := ctx.Value(traceKey{}).(string)
+	return id
+}
+
+// setTraceparent adds a sampled traceparent header for the trace in ctx,
+// if any, to req, with a random parent span id standing in for the
+// loadgen's side of the request.
+func setTraceparent(ctx context.Context, req *http.Request) {
+	id := traceID(ctx)
+	if id == "" {
+		return
+	}
+	var span [8]byte
+	rand.Read(span[:])
+	req.Header.Set("traceparent", "00-"+id+"-"+hex.EncodeToString(span[:])+"-01")
+}
+
+// observe records v on o, with traceID as an exemplar when it's set.
+func observe(o prometheus.Observer, v float64, traceID string) {
+	if e, ok := o.(prometheus.ExemplarObserver); ok && traceID != "" {
+		e.ObserveWithExemplar(v, prometheus.Labels{"trace_id": traceID})
+		return
+	}
+	o.Observe(v)
+}
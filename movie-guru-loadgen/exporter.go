@@ -0,0 +1,75 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// flusher is a push-based metrics exporter that must send its last interval
+// of data before the process exits.
+type flusher interface {
+	flush(ctx context.Context) error
+}
+
+var (
+	exportersMu sync.Mutex
+	exporters   = map[string]flusher{}
+)
+
+// registerExporter adds an exporter to be flushed by flushExporters.
+func registerExporter(name string, f flusher) {
+	exportersMu.Lock()
+	defer exportersMu.Unlock()
+	exporters[name] = f
+}
+
+// flushExporters flushes every registered exporter in parallel and waits for
+// them, for at most timeout. Failures are only logged.
+func flushExporters(timeout time.Duration) {
+	exportersMu.Lock()
+	defer exportersMu.Unlock()
+	if len(exporters) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for name, f := range exporters {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := f.flush(ctx); err != nil {
+				slog.Log(ctx, slog.LevelWarn, "Error flushing metrics", "exporter", name, "error", err)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		slog.Log(ctx, slog.LevelInfo, "Flushed metrics exporters", "exporters", len(exporters))
+	case <-ctx.Done():
+		slog.Log(context.Background(), slog.LevelWarn, "Timed out flushing metrics exporters", "timeout", timeout)
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeFlusher counts flushes and blocks each one for delay or until its
+// context is done.
+type fakeFlusher struct {
+	delay   time.Duration
+	flushed atomic.Int32
+}
+
+func (f *fakeFlusher) flush(ctx context.Context) error {
+	select {
+	case <-time.After(f.delay):
+		f.flushed.Add(1)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestFlushExporters(t *testing.T) {
+	t.Cleanup(func() { exporters = map[string]flusher{} })
+
+	fast := &fakeFlusher{delay: 10 * time.Millisecond}
+	hung := &fakeFlusher{delay: time.Hour}
+	registerExporter("fast", fast)
+	registerExporter("hung", hung)
+
+	start := time.Now()
+	flushExporters(200 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("flushExporters() took %v, want it bounded by its 200ms timeout", elapsed)
+	}
+	if got := fast.flushed.Load(); got != 1 {
+		t.Errorf("fast exporter flushed %d times, want 1", got)
+	}
+	if got := hung.flushed.Load(); got != 0 {
+		t.Errorf("hung exporter flushed %d times, want 0", got)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+// errFailFast is the cause a run is cancelled with when FAIL_FAST is set
+// and a request fails.
+var errFailFast = errors.New("FAIL_FAST: a request failed")
+
+// exchange is a chat request and its response, kept verbatim with
+// cfg.FailFast so the first failure can be dumped.
+type exchange struct {
+	Method         string      `json:"method"`
+	URL            string      `json:"url"`
+	RequestHeader  http.Header `json:"request_header"`
+	RequestBody    string      `json:"request_body"`
+	Status         int         `json:"status,omitempty"`
+	ResponseHeader http.Header `json:"response_header,omitempty"`
+	ResponseBody   string      `json:"response_body,omitempty"`
+}
+
+// newExchange starts an exchange for req, whose body is body, or returns nil
+// unless cfg.FailFast is set.
+func newExchange(req *http.Request, body []byte) *exchange {
+	if !cfg.FailFast {
+		return nil
+	}
+	return &exchange{Method: req.Method, URL: req.URL.String(), RequestHeader: req.Header.Clone(), RequestBody: string(body)}
+}
+
+// setResponse records resp and its body, if any, on x.
+func (x *exchange) setResponse(resp *http.Response, body []byte) {
+	if x == nil {
+		return
+	}
+	x.Status = resp.StatusCode
+	x.ResponseHeader = resp.Header.Clone()
+	x.ResponseBody = string(body)
+	if isBinary(body) {
+		x.ResponseBody = binaryPreview(body)
+	}
+}
+
+var (
+	// stopRun cancels the run; runLoad and runStdin set it before sending
+	// any requests.
+	stopRun    context.CancelCauseFunc
+	failedFast sync.Once
+)
+
+// failFast stops the run on its first failure, dumping the error and the
+// exchange, if there was one, verbatim. In-flight requests are aborted
+// rather than waited for, and later failures, including the aborted
+// requests, are ignored.
+func failFast(ctx context.Context, err error, x *exchange) {
+	failedFast.Do(func() {
+		slog.Log(ctx, slog.LevelError, "FAIL_FAST: stopping the run on the first failure", "error", err, "class", errorClass(err), "exchange", x)
+		abortInflight()
+		if stopRun != nil {
+			stopRun(errFailFast)
+		}
+	})
+}
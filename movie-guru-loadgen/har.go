@@ -0,0 +1,256 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxHAREntries bounds memory use on long runs; later requests are dropped.
+const maxHAREntries = 10000
+
+const redactedValue = "REDACTED"
+
+// HAR 1.2 types, see http://www.softwareishard.com/blog/har-12-spec/.
+// Only the fields tools require are populated.
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	Cookies     []harNameValue `json:"cookies"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	Cookies     []harNameValue `json:"cookies"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// harRecorder collects HAR entries for every request made through a
+// harTransport and writes them out at the end of the run.
+type harRecorder struct {
+	mu      sync.Mutex
+	entries []harEntry
+	dropped int
+}
+
+var har *harRecorder
+
+func (h *harRecorder) add(e harEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.entries) >= maxHAREntries {
+		h.dropped++
+		return
+	}
+	h.entries = append(h.entries, e)
+}
+
+// save writes the recorded entries to path as a HAR document.
+func (h *harRecorder) save(path string) error {
+	h.mu.Lock()
+	doc := struct {
+		Log harLog `json:"log"`
+	}{harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "movie-guru-loadgen", Version: "1.0"},
+		Entries: h.entries,
+	}}
+	dropped := h.dropped
+	h.mu.Unlock()
+
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		return err
+	}
+	slog.Log(context.Background(), slog.LevelInfo, "Wrote HAR file", "path", path, "entries", len(doc.Log.Entries), "dropped", dropped)
+	return nil
+}
+
+// harTransport records each round trip in a harRecorder. The response body
+// is captured as the caller reads it, so response timings are unaffected.
+type harTransport struct {
+	next http.RoundTripper
+	rec  *harRecorder
+}
+
+func (t *harTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	entry := harEntry{
+		StartedDateTime: time.Now(),
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         req.URL.String(),
+			HTTPVersion: req.Proto,
+			Headers:     harHeaders(req.Header),
+			QueryString: []harNameValue{},
+			Cookies:     []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    req.ContentLength,
+		},
+	}
+	if cfg.HARIncludeBodies && req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			b, _ := io.ReadAll(body)
+			entry.Request.PostData = &harPostData{MimeType: req.Header.Get("Content-Type"), Text: string(b)}
+		}
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	wait := time.Since(entry.StartedDateTime)
+	if err != nil {
+		entry.Time = ms(wait)
+		entry.Timings = harTimings{Wait: ms(wait)}
+		entry.Response = harResponse{StatusText: err.Error(), Headers: []harNameValue{}, Cookies: []harNameValue{}, HeadersSize: -1, BodySize: -1}
+		t.rec.add(entry)
+		return nil, err
+	}
+
+	entry.Response = harResponse{
+		Status:      resp.StatusCode,
+		StatusText:  http.StatusText(resp.StatusCode),
+		HTTPVersion: resp.Proto,
+		Headers:     harHeaders(resp.Header),
+		Cookies:     []harNameValue{},
+		Content:     harContent{MimeType: resp.Header.Get("Content-Type")},
+		HeadersSize: -1,
+	}
+	resp.Body = &harBody{ReadCloser: resp.Body, entry: entry, wait: wait, rec: t.rec}
+	return resp, nil
+}
+
+// harBody completes its HAR entry when the response body is closed.
+type harBody struct {
+	io.ReadCloser
+	buf   bytes.Buffer
+	size  int64
+	entry harEntry
+	wait  time.Duration
+	rec   *harRecorder
+	once  sync.Once
+}
+
+func (b *harBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.size += int64(n)
+	if cfg.HARIncludeBodies {
+		b.buf.Write(p[:n])
+	}
+	return n, err
+}
+
+func (b *harBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		total := time.Since(b.entry.StartedDateTime)
+		b.entry.Time = ms(total)
+		b.entry.Timings = harTimings{Wait: ms(b.wait), Receive: ms(total - b.wait)}
+		b.entry.Response.BodySize = b.size
+		b.entry.Response.Content.Size = b.size
+		b.entry.Response.Content.Text = b.buf.String()
+		b.rec.add(b.entry)
+	})
+	return err
+}
+
+// harHeaders converts headers to HAR form, replacing the values of headers
+// listed in cfg.HARRedactHeaders.
+func harHeaders(h http.Header) []harNameValue {
+	out := []harNameValue{}
+	for name, values := range h {
+		redact := false
+		for _, r := range cfg.HARRedactHeaders {
+			if strings.EqualFold(name, r) {
+				redact = true
+				break
+			}
+		}
+		for _, v := range values {
+			if redact {
+				v = redactedValue
+			}
+			out = append(out, harNameValue{Name: name, Value: v})
+		}
+	}
+	return out
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
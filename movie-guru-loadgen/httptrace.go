@@ -0,0 +1,73 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+)
+
+// tracingTransport logs where the time went in every request it sends, at
+// debug level: DNS lookup, connect, TLS handshake, writing the request and
+// waiting for the first response byte. It tells slow connection setup from
+// slow server processing for individual requests.
+type tracingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var (
+		start                                     = time.Now()
+		dnsStart, connectStart, tlsStart          time.Time
+		dns, connect, handshake, wrote, firstByte time.Duration
+		reused                                    bool
+	)
+	trace := &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone:              func(httptrace.DNSDoneInfo) { dns = time.Since(dnsStart) },
+		ConnectStart:         func(string, string) { connectStart = time.Now() },
+		ConnectDone:          func(string, string, error) { connect = time.Since(connectStart) },
+		TLSHandshakeStart:    func() { tlsStart = time.Now() },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { handshake = time.Since(tlsStart) },
+		GotConn:              func(info httptrace.GotConnInfo) { reused = info.Reused },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { wrote = time.Since(start) },
+		GotFirstResponseByte: func() { firstByte = time.Since(start) },
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	resp, err := t.next.RoundTrip(req)
+	args := []any{
+		"method", req.Method,
+		"url", req.URL.String(),
+		"reused_conn", reused,
+		"dns", dns,
+		"connect", connect,
+		"tls", handshake,
+		"wrote_request", wrote,
+		"first_byte", firstByte,
+		"server_time", max(0, firstByte-wrote),
+	}
+	if err != nil {
+		args = append(args, "error", err)
+	} else {
+		args = append(args, "status", resp.StatusCode)
+	}
+	slog.Log(context.WithoutCancel(req.Context()), slog.LevelDebug, "HTTP request timings", args...)
+	return resp, err
+}
@@ -0,0 +1,90 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	userRotationRequest = "request"
+	userRotationVU      = "vu"
+)
+
+// authUserHeader is the header movie-guru-agent reads the user from.
+const authUserHeader = "x-goog-authenticated-user-email"
+
+// authUsers is loaded from cfg.UserFile. When it is empty every session
+// belongs to fakeUser.
+var (
+	authUsers    []string
+	nextAuthUser atomic.Uint64
+)
+
+// loadAuthUsers reads and validates the identities in path, one email
+// address per line.
+func loadAuthUsers(ctx context.Context, path string) error {
+	users, err := readSeedFile(path)
+	if err != nil {
+		return err
+	}
+	for i, u := range users {
+		if strings.ContainsAny(u, " \t") || !strings.Contains(u, "@") {
+			return fmt.Errorf("%s: identity %d, %q, is not an email address", path, i+1, u)
+		}
+	}
+	authUsers = users
+	slog.Log(ctx, slog.LevelInfo, "Loaded user identities", "file", path, "identities", len(users), "rotation", cfg.UserRotation)
+	return nil
+}
+
+// identities returns the identities sessions are created for: authUsers,
+// or just fakeUser.
+func identities() []string {
+	if len(authUsers) == 0 {
+		return []string{fakeUser}
+	}
+	return authUsers
+}
+
+// authUserIndex returns the index in identities() of the identity the
+// virtual user in ctx picks its next session as: the next one in turn, or
+// always the same one for a virtual user with cfg.UserRotation "vu".
+func authUserIndex(ctx context.Context) int {
+	if len(authUsers) == 0 {
+		return 0
+	}
+	if cfg.UserRotation == userRotationVU {
+		return vuNumber(ctx) % len(authUsers)
+	}
+	return int((nextAuthUser.Add(1) - 1) % uint64(len(authUsers)))
+}
+
+// authUser returns the identity at authUserIndex.
+func authUser(ctx context.Context) string {
+	return identities()[authUserIndex(ctx)]
+}
+
+// setAuthUser sets the authenticated-user header that backends key per-user
+// quotas and session ownership on. Requests on a session must be sent as
+// the session's user.
+func setAuthUser(req *http.Request, user string) {
+	req.Header.Set(authUserHeader, user)
+}
@@ -0,0 +1,372 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeBackends are in-process stand-ins for the Ollama prompt server and the
+// ADK chat server.
+type fakeBackends struct {
+	prompt *httptest.Server
+	chat   *httptest.Server
+
+	generated atomic.Int64
+	runs      atomic.Int64
+}
+
+func newFakeBackends(t *testing.T) *fakeBackends {
+	t.Helper()
+	f := &fakeBackends{}
+
+	promptMux := http.NewServeMux()
+	promptMux.HandleFunc("POST /api/generate", func(w http.ResponseWriter, r *http.Request) {
+		f.generated.Add(1)
+		_ = json.NewEncoder(w).Encode(OllamaResponse{
+			Model:    "gemma3:4b",
+			Response: "Can you recommend a funny animated movie from 2010?",
+			Done:     true,
+		})
+	})
+	f.prompt = httptest.NewServer(promptMux)
+	t.Cleanup(f.prompt.Close)
+
+	chatMux := http.NewServeMux()
+	chatMux.HandleFunc("POST /sessions", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{"session_id": "session-1"})
+	})
+	chatMux.HandleFunc("POST /run", func(w http.ResponseWriter, r *http.Request) {
+		f.runs.Add(1)
+		_ = json.NewEncoder(w).Encode([]adkEvent{{
+			Content: &newMessage{Role: "model", Parts: []part{{Text: "Try Despicable Me."}}},
+		}})
+	})
+	f.chat = httptest.NewServer(chatMux)
+	t.Cleanup(f.chat.Close)
+
+	return f
+}
+
+// setupRun points the loadgen at f and resets global run state.
+func setupRun(t *testing.T, f *fakeBackends, env map[string]string) {
+	t.Helper()
+	t.Setenv("PROMPT_SERVER", f.prompt.URL)
+	t.Setenv("CHAT_SERVER", f.chat.URL)
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	if err := loadConfig(); err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+	stats = newStats()
+}
+
+func TestRunLoadAgainstFakeBackends(t *testing.T) {
+	f := newFakeBackends(t)
+	setupRun(t, f, map[string]string{
+		"RATE_LIMIT":    "6000",
+		"VIRTUAL_USERS": "2",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+
+	summary, err := runLoad(ctx)
+	if err != nil {
+		t.Fatalf("runLoad() error = %v", err)
+	}
+
+	if summary.Requests == 0 {
+		t.Fatalf("summary.Requests = 0, want at least one request")
+	}
+	if summary.Errors != 0 {
+		t.Errorf("summary.Errors = %d, want 0", summary.Errors)
+	}
+	if got := f.runs.Load(); uint64(got) != summary.Requests {
+		t.Errorf("chat server received %d requests, summary reports %d", got, summary.Requests)
+	}
+	if summary.LatencyMs.Count != summary.Requests {
+		t.Errorf("summary.LatencyMs.Count = %d, want %d", summary.LatencyMs.Count, summary.Requests)
+	}
+	if summary.PromptErrors != 0 || summary.EmptyPrompts != 0 {
+		t.Errorf("prompt errors = %d, empty prompts = %d, want 0", summary.PromptErrors, summary.EmptyPrompts)
+	}
+}
+
+func TestRunLoadCountsChatErrors(t *testing.T) {
+	f := newFakeBackends(t)
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sessions" {
+			f.chat.Config.Handler.ServeHTTP(w, r)
+			return
+		}
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	setupRun(t, f, map[string]string{
+		"CHAT_SERVER": failing.URL,
+		"RATE_LIMIT":  "6000",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	summary, err := runLoad(ctx)
+	if err != nil {
+		t.Fatalf("runLoad() error = %v", err)
+	}
+	if summary.Requests == 0 || summary.Errors != summary.Requests {
+		t.Errorf("summary requests = %d, errors = %d, want every request to fail", summary.Requests, summary.Errors)
+	}
+}
+
+func TestRunLoadOrdersTurnsPerVirtualUser(t *testing.T) {
+	for _, tc := range []struct {
+		ordered, users, inflight string
+		wantVUOverlap            bool
+	}{
+		{ordered: "true", users: "4", inflight: "1", wantVUOverlap: false},
+		{ordered: "false", users: "1", inflight: "4", wantVUOverlap: true},
+	} {
+		t.Run("ORDERED_TURNS="+tc.ordered, func(t *testing.T) {
+			f := newFakeBackends(t)
+
+			// Count /run requests that arrive while an earlier request from
+			// the same virtual user, or on the same session, is still waiting
+			// for its response.
+			var mu sync.Mutex
+			vuInflight, sessInflight := map[string]int{}, map[string]int{}
+			var vuOverlaps, sessOverlaps atomic.Int64
+			chat := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/run" {
+					f.chat.Config.Handler.ServeHTTP(w, r)
+					return
+				}
+				var req AdkRequest
+				_ = json.NewDecoder(r.Body).Decode(&req)
+				vu := r.Header.Get(vuHeader)
+
+				mu.Lock()
+				if vuInflight[vu] > 0 {
+					vuOverlaps.Add(1)
+				}
+				if sessInflight[req.SessionId] > 0 {
+					sessOverlaps.Add(1)
+				}
+				vuInflight[vu]++
+				sessInflight[req.SessionId]++
+				mu.Unlock()
+
+				time.Sleep(50 * time.Millisecond)
+
+				mu.Lock()
+				vuInflight[vu]--
+				sessInflight[req.SessionId]--
+				mu.Unlock()
+				f.chat.Config.Handler.ServeHTTP(w, r)
+			}))
+			defer chat.Close()
+
+			setupRun(t, f, map[string]string{
+				"CHAT_SERVER":                   chat.URL,
+				"RATE_LIMIT":                    "6000",
+				"MIN_THINK_TIME":                "0",
+				"MULTI_TURN":                    "true",
+				"VIRTUAL_USERS":                 tc.users,
+				"REQUESTS_PER_SESSION_INFLIGHT": tc.inflight,
+				"ORDERED_TURNS":                 tc.ordered,
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			summary, err := runLoad(ctx)
+			if err != nil {
+				t.Fatalf("runLoad() error = %v", err)
+			}
+			if summary.Requests < 2 {
+				t.Fatalf("summary.Requests = %d, want at least 2", summary.Requests)
+			}
+			if got := vuOverlaps.Load() > 0; got != tc.wantVUOverlap {
+				t.Errorf("virtual user's turn dispatched before its previous response: %v (%d times), want %v", got, vuOverlaps.Load(), tc.wantVUOverlap)
+			}
+			// Virtual users share the session, and ordering one user's
+			// turns must not serialize the others.
+			if sessOverlaps.Load() == 0 {
+				t.Errorf("no requests overlapped on the shared session, want virtual users to send in parallel")
+			}
+		})
+	}
+}
+
+func TestRunLoadSendsAsSessionOwner(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		env  map[string]string
+	}{
+		{name: "request", env: map[string]string{"USER_ROTATION": "request"}},
+		{name: "vu", env: map[string]string{"USER_ROTATION": "vu"}},
+		{name: "pool", env: map[string]string{"USER_ROTATION": "request", "SESSION_POOL_SIZE": "2"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakeBackends(t)
+			t.Cleanup(func() { authUsers = nil })
+
+			// Like movie-guru-agent, sessions belong to the user in the
+			// header they were created with.
+			var mu sync.Mutex
+			owners := map[string]string{}
+			users := map[string]bool{}
+			var created, mismatched atomic.Int64
+			chat := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				user := r.Header.Get(authUserHeader)
+				switch r.URL.Path {
+				case "/sessions":
+					id := fmt.Sprintf("session-%d", created.Add(1))
+					mu.Lock()
+					owners[id] = user
+					mu.Unlock()
+					_ = json.NewEncoder(w).Encode(map[string]string{"session_id": id})
+					return
+				case "/run":
+					var req AdkRequest
+					_ = json.NewDecoder(r.Body).Decode(&req)
+					mu.Lock()
+					if owners[req.SessionId] != user || req.UserId != user {
+						mismatched.Add(1)
+					}
+					users[user] = true
+					mu.Unlock()
+				}
+				f.chat.Config.Handler.ServeHTTP(w, r)
+			}))
+			defer chat.Close()
+
+			userFile := filepath.Join(t.TempDir(), "users.txt")
+			if err := os.WriteFile(userFile, []byte("a@example.com\nb@example.com\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			env := map[string]string{
+				"CHAT_SERVER":    chat.URL,
+				"RATE_LIMIT":     "6000",
+				"MIN_THINK_TIME": "0",
+				"VIRTUAL_USERS":  "2",
+				"USER_FILE":      userFile,
+			}
+			maps.Copy(env, tc.env)
+			setupRun(t, f, env)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			summary, err := runLoad(ctx)
+			if err != nil {
+				t.Fatalf("runLoad() error = %v", err)
+			}
+			if summary.Requests < 2 {
+				t.Fatalf("summary.Requests = %d, want at least 2", summary.Requests)
+			}
+			if n := mismatched.Load(); n > 0 {
+				t.Errorf("%d requests sent as a user other than their session's owner", n)
+			}
+			if len(users) != 2 {
+				t.Errorf("requests sent as %d identities, want 2", len(users))
+			}
+		})
+	}
+}
+
+func TestRunLoadRejectsReusedSessions(t *testing.T) {
+	for _, env := range []map[string]string{
+		{"SHARED_SESSIONS": "2"},
+		{"SESSION_POOL_SIZE": "2"},
+	} {
+		t.Run(fmt.Sprint(env), func(t *testing.T) {
+			// The fake chat server, like movie-guru-agent's /sessions,
+			// returns the same session every time.
+			f := newFakeBackends(t)
+			env["RATE_LIMIT"] = "6000"
+			setupRun(t, f, env)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			if _, err := runLoad(ctx); !errors.Is(err, errSessionReused) {
+				t.Errorf("runLoad() error = %v, want %v", err, errSessionReused)
+			}
+		})
+	}
+}
+
+func TestRunLoadPacesAPIMixOperations(t *testing.T) {
+	f := newFakeBackends(t)
+	setupRun(t, f, map[string]string{
+		"RATE_LIMIT":     "6000",
+		"VIRTUAL_USERS":  "1",
+		"API_MIX":        "health=1",
+		"MIN_THINK_TIME": "200ms",
+		"THINK_TIME":     "0",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	summary, err := runLoad(ctx)
+	if err != nil {
+		t.Fatalf("runLoad() error = %v", err)
+	}
+	// One request, then one every 200ms.
+	if summary.Requests < 2 || summary.Requests > 6 {
+		t.Errorf("summary.Requests = %d, want 2-6 with a 200ms think time", summary.Requests)
+	}
+}
+
+func TestRunLoadCoolsDownBetweenSingleTurnConversations(t *testing.T) {
+	f := newFakeBackends(t)
+	setupRun(t, f, map[string]string{
+		"RATE_LIMIT":       "6000",
+		"VIRTUAL_USERS":    "1",
+		"MIN_THINK_TIME":   "0",
+		"SESSION_COOLDOWN": "200ms",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	summary, err := runLoad(ctx)
+	if err != nil {
+		t.Fatalf("runLoad() error = %v", err)
+	}
+	if summary.Requests < 2 || summary.Requests > 6 {
+		t.Errorf("summary.Requests = %d, want 2-6 with a 200ms cooldown", summary.Requests)
+	}
+	if summary.SessionGapMs.Count == 0 || summary.SessionGapMs.Min < 200 {
+		t.Errorf("summary.SessionGapMs = %+v, want gaps of at least 200ms", summary.SessionGapMs)
+	}
+}
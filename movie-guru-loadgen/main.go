@@ -18,18 +18,23 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"log/slog"
-	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/cors"
 	"golang.org/x/time/rate"
 )
@@ -37,7 +42,7 @@ import (
 const userPrompt = `You are a %d year oldperson who is chatting with a knowledgeable film expert. 
 You are not a film expert and need information from the movie expert. The only information you have is what the expert tells you.
 You cannot use any external knowledge about real movies or information to ask questions, even if you have access to it. You only can derive context from the expert's response.
-The genres you are interested in may be one or a combination of the following: comedy, horror, kids, cartoon, thriller, adeventure, fantasy.
+The genres you are interested in may be one or a combination of the following: %s.
 You are only interested in movies from the year 2000 onwards.
 You can ask questions about the movie, any actors, directors. Or you can ask the expert to show you movies of a specific type (genre, short duration, from a specific year, movies that are similar to a specific movie, etc.)
 You must ask the question in 750 characters or less.
@@ -47,17 +52,45 @@ You must ask the question in 750 characters or less.
 Engage in a natural conversation with the expert, reacting to their insights and asking questions just like a real movie buff would.`
 
 const (
-	ageMin      = 18
-	ageMax      = 80
-	fakeUser    = "fake@google.com"
-	appName     = "app"
-	address     = "0.0.0.0:"
-	defaultPort = "8080"
+	ageMin   = 18
+	ageMax   = 80
+	fakeUser = "fake@google.com"
+	// defaultAppName is the ADK app served by movie-guru-agent.
+	defaultAppName = "app"
+	address        = "0.0.0.0:"
+	defaultPort    = "8080"
 )
 
+const defaultRateLimit = 5.0 // requests per minute
+
+// defaultPromptModel is the Ollama model prompts are generated with.
+const defaultPromptModel = "gemma3:4b"
+
+// exitConfig is the exit code when the configuration is invalid.
+const exitConfig = 2
+
+// exitNoThroughput is the exit code when the run is aborted because no chat
+// requests completed for STALL_TIMEOUT.
+const exitNoThroughput = 3
+
+// exitPreflight is the exit code when the preflight check fails and
+// --force isn't set.
+const exitPreflight = 5
+
+// exitFailFast is the exit code when FAIL_FAST stopped the run.
+const exitFailFast = 6
+
+// exitErrorRate is the exit code when the run's error rate exceeded
+// MAX_ERROR_RATE.
+const exitErrorRate = 7
+
+// exitWallClock is the exit code when the process is killed by
+// MAX_WALL_CLOCK.
+const exitWallClock = 4
+
 var (
 	maxChatLen = 750
-	limiter    *rate.Limiter
+	limiter    = newRateLimiter(1, rate.Limit(defaultRateLimit/60.0))
 )
 
 // OllamaRequest represents the payload sent to the Ollama API
@@ -92,8 +125,6 @@ type AdkRequest struct {
 	Streaming  bool       `json:"streaming"`
 }
 
-var chatServer, promptServer string
-
 func getLogLevel() slog.Level {
 	levelStr := os.Getenv("LOG_LEVEL")
 	switch levelStr {
@@ -131,15 +162,34 @@ func replacer(groups []string, a slog.Attr) slog.Attr {
 func setupLogging() {
 	// Use json as our base logging format.
 	jsonHandler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{ReplaceAttr: replacer, Level: getLogLevel(), AddSource: true})
-	// Set this handler as the global slog handler.
-	slog.SetDefault(slog.New(jsonHandler))
+	// Set this handler as the global slog handler, adding any attributes
+	// carried by the context, such as the virtual user's id.
+	slog.SetDefault(slog.New(contextHandler{jsonHandler}))
 }
 
 func main() {
 	var wait time.Duration
+	processStart := time.Now()
+
+	// Before anything slow, so a SIGHUP during startup is queued for the
+	// reloader rather than killing the loadgen.
+	if os.Getenv("CONFIG_FILE") != "" {
+		signal.Notify(reloadSignals, syscall.SIGHUP)
+	}
 
 	r := mux.NewRouter()
 	r.HandleFunc("/", HealthHandler).Methods("GET")
+	r.HandleFunc("/healthz/startup", StartupHandler).Methods("GET")
+	r.HandleFunc("/stats", StatsHandler).Methods("GET")
+	// Exemplars are only exposed in the OpenMetrics format, which scrapers
+	// have to ask for, so the format is negotiated even before the config
+	// is loaded.
+	r.Handle("/metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}))).Methods("GET")
+	r.HandleFunc("/pause", PauseHandler).Methods("POST")
+	r.HandleFunc("/resume", ResumeHandler).Methods("POST")
+	r.HandleFunc("/rate", RateHandler).Methods("POST")
+	r.HandleFunc("/snapshot", SnapshotHandler).Methods("POST")
 
 	// Create a new CORS handler with specific options.
 	corsHandler := cors.New(cors.Options{
@@ -160,40 +210,20 @@ func main() {
 
 	setupLogging()
 
-	var sessionId string
-	var err error
-
-	if os.Getenv("PROMPT_SERVER") != "" {
-		promptServer = os.Getenv("PROMPT_SERVER")
-	} else {
-		slog.Log(context.Background(), slog.LevelError, "PROMPT_SERVER not set")
-		return
-	}
-
-	if os.Getenv("CHAT_SERVER") != "" {
-		chatServer = os.Getenv("CHAT_SERVER")
-	} else {
-		slog.Log(context.Background(), slog.LevelError, "CHAT_SERVER not set")
-		return
-	}
-
-	sessionId, err = createSession()
-	if err != nil {
-		slog.Log(context.Background(), slog.LevelError, "Error creating session", "error", err)
+	if len(os.Args) > 1 && os.Args[1] == "aggregate" {
+		if err := runAggregate(os.Args[2:]); err != nil {
+			slog.Log(context.Background(), slog.LevelError, "Error aggregating run reports", "error", err)
+			os.Exit(1)
+		}
 		return
 	}
 
-	if os.Getenv("RATE_LIMIT") != "" {
-		if r, err := strconv.ParseFloat(os.Getenv("RATE_LIMIT"), 64); err != nil {
-			slog.Log(context.Background(), slog.LevelWarn, "Error parsing RATE_LIMIT, using defaults", "error", err)
-			r = 5.0
-		} else {
-			limiter = rate.NewLimiter(rate.Limit(r/60.0), 1)
-		}
-	} else {
-		// Rate limiter: 5 requests per minute
-		limiter = rate.NewLimiter(rate.Limit(5.0/60.0), 1)
+	flag.Parse()
+	if err := loadConfig(); err != nil {
+		slog.Log(context.Background(), slog.LevelError, "Invalid configuration", "error", err, "exit_code", exitConfig)
+		os.Exit(exitConfig)
 	}
+	setupTransport()
 
 	go func() {
 		if err := srv.ListenAndServe(); err != nil {
@@ -201,62 +231,115 @@ func main() {
 		}
 	}()
 
-	go func() {
-		for { // Infinite loop
-			randomNumber := rand.Intn(ageMax-ageMin+1) + ageMin
-			fullPrompt := fmt.Sprintf(userPrompt, randomNumber)
-			moviePrompt, err := generatePrompt(fullPrompt)
-			if err != nil {
-				slog.Log(context.Background(), slog.LevelError, "Error generating prompt", "error", err)
-				os.Exit(1)
-			}
+	// We'll accept graceful shutdowns when quit via SIGINT (Ctrl+C)
+	// SIGKILL, SIGQUIT or SIGTERM (Ctrl+/) will not be caught.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// A backstop for when the graceful path below wedges, so CI jobs can't
+	// hang forever. It doesn't wait for anything, and counts from process
+	// start, so it covers the startup delay and preflight check too.
+	if cfg.MaxWallClock > 0 {
+		time.AfterFunc(cfg.MaxWallClock-time.Since(processStart), func() {
+			slog.Log(context.Background(), slog.LevelError, "MAX_WALL_CLOCK reached, exiting", "max_wall_clock", cfg.MaxWallClock, "exit_code", exitWallClock)
+			os.Exit(exitWallClock)
+		})
+	}
 
-			err = requestMovieRecommendations(moviePrompt, sessionId)
-			if err != nil {
-				slog.Log(context.Background(), slog.LevelError, "Error requesting movie recommendations", "error", err)
-				os.Exit(1)
-			}
+	// Health endpoints are served while waiting for the backend to come up.
+	if cfg.StartupDelay > 0 && waitStartupDelay(ctx, cfg.StartupDelay) != nil {
+		return
+	}
 
-			time.Sleep(1 * time.Second) // Add a delay between requests if needed.
+	if cfg.Preflight {
+		if err := preflight(ctx); err != nil {
+			if ctx.Err() != nil {
+				slog.Log(context.Background(), slog.LevelInfo, "Interrupted during the preflight check, not starting the run")
+				return
+			}
+			if !*forceFlag {
+				slog.Log(context.Background(), slog.LevelError, "Preflight check failed, not starting the run; use --force to start anyway", "error", err, "exit_code", exitPreflight)
+				os.Exit(exitPreflight)
+			}
+			slog.Log(context.Background(), slog.LevelWarn, "Preflight check failed, starting the run anyway because of --force", "error", err)
 		}
-	}()
+	}
 
-	c := make(chan os.Signal, 1)
-	// We'll accept graceful shutdowns when quit via SIGINT (Ctrl+C)
-	// SIGKILL, SIGQUIT or SIGTERM (Ctrl+/) will not be caught.
-	signal.Notify(c, os.Interrupt)
+	if cfg.RunDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.RunDuration)
+		defer cancel()
+	}
 
-	// Block until we receive our signal.
-	<-c
+	var summary StatsSnapshot
+	var err error
+	if cfg.PromptSource == promptSourceStdin {
+		summary, err = runStdin(ctx, os.Stdin)
+	} else {
+		summary, err = runLoad(ctx)
+	}
+	if err != nil && !errors.Is(err, errNoThroughput) && !errors.Is(err, errFailFast) {
+		slog.Log(context.Background(), slog.LevelError, "Error running load", "error", err)
+		return
+	}
+	slog.Log(context.Background(), slog.LevelInfo, "Run summary", "stats", summary)
+	if cfg.ReportFormat != "" {
+		reporter, _ := newReporter(cfg.ReportFormat)
+		if err := reporter.Report(os.Stdout, summary); err != nil {
+			slog.Log(context.Background(), slog.LevelError, "Error writing report", "error", err)
+		}
+	}
 
 	// Create a deadline to wait for.
-	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), wait)
 	defer cancel()
 	// Doesn't block if no connections, but will otherwise wait
 	// until the timeout deadline.
-	_ = srv.Shutdown(ctx)
+	_ = srv.Shutdown(shutdownCtx)
 
 	slog.Log(context.Background(), slog.LevelInfo, "Shutting down")
 
+	if errors.Is(err, errFailFast) {
+		slog.Log(context.Background(), slog.LevelError, "Run aborted", "error", err, "exit_code", exitFailFast)
+		os.Exit(exitFailFast)
+	}
+	if err != nil {
+		slog.Log(context.Background(), slog.LevelError, "Run aborted", "error", err, "exit_code", exitNoThroughput)
+		os.Exit(exitNoThroughput)
+	}
+	if observed, ok := errorRateExceeded(summary); ok {
+		slog.Log(context.Background(), slog.LevelError, "Error rate above MAX_ERROR_RATE", "error_rate", fmt.Sprintf("%.2f%%", observed), "max_error_rate", fmt.Sprintf("%.2f%%", cfg.MaxErrorRate), "errors", summary.Errors, "requests", summary.Requests, "exit_code", exitErrorRate)
+		os.Exit(exitErrorRate)
+	}
 	os.Exit(0)
 
 }
 
-func createSession() (string, error) {
+// errorRateExceeded returns the run's error rate as a percentage and whether
+// it is above MAX_ERROR_RATE. A run without requests has no error rate.
+func errorRateExceeded(s StatsSnapshot) (float64, bool) {
+	if s.Requests == 0 {
+		return 0, false
+	}
+	observed := 100 * float64(s.Errors) / float64(s.Requests)
+	return observed, observed > cfg.MaxErrorRate
+}
 
-	var sessionInfo map[string]string
+func createSession(app, user string) (string, error) {
 
-	req, err := http.NewRequest("POST", chatServer+"/sessions", bytes.NewBuffer([]byte("{\"state\":{\"login\":true}}")))
+	var sessionInfo map[string]any
+
+	u, idKey, clientId := sessionEndpoint(app, user)
+	req, err := http.NewRequest(cfg.SessionCreateMethod, u, bytes.NewBuffer([]byte("{\"state\":{\"login\":true}}")))
 	if err != nil {
 		slog.Log(context.Background(), slog.LevelError, "Error creating request", "error", err)
 		return "", err
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("x-goog-authenticated-user-email", fakeUser)
+	setAuthUser(req, user)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := chatClient.Do(req)
 	if err != nil {
 		slog.Log(context.Background(), slog.LevelError, "Error sending request", "error", err)
 		return "", err
@@ -270,25 +353,49 @@ func createSession() (string, error) {
 
 	b, _ := io.ReadAll(resp.Body)
 
+	// Backends that return the id in a header may send no body, or one
+	// that isn't JSON, so a body that can't be parsed only matters when the
+	// header is missing too.
+	source := "body"
 	err = json.Unmarshal(b, &sessionInfo)
-	if err != nil {
-		slog.Log(context.Background(), slog.LevelError, "Error unmarshaling JSON", "error", err)
+	sessionId, _ := sessionInfo[idKey].(string)
+	if sessionId == "" && cfg.SessionIDHeader != "" {
+		sessionId, source = resp.Header.Get(cfg.SessionIDHeader), "header"
+	}
+	if sessionId == "" && clientId != "" {
+		sessionId, source, err = clientId, "path", nil
+	}
+	if sessionId == "" {
+		if jsonErr := checkJSON(resp, b); jsonErr != nil {
+			slog.Log(context.Background(), slog.LevelError, "Session server returned an unexpected response", "error", jsonErr)
+			return "", jsonErr
+		}
+		if err != nil {
+			slog.Log(context.Background(), slog.LevelError, "Error unmarshaling JSON", "error", err)
+			return "", err
+		}
+		return "", fmt.Errorf("response has no %s in its body and no %s header", idKey, cfg.SessionIDHeader)
+	}
+	if err := claimSession(app, user, sessionId); err != nil {
 		return "", err
 	}
-	slog.Log(context.Background(), slog.LevelInfo, "Session created", "info", sessionInfo["session_id"])
+	slog.Log(context.Background(), slog.LevelInfo, "Session created", "info", sessionId, "app", app, "user", user, "source", source)
 
 	defer resp.Body.Close()
 
-	return sessionInfo["session_id"], nil
+	return sessionId, nil
 }
 
-func generatePrompt(fullPrompt string) (string, error) {
+func generatePrompt(ctx context.Context, model, fullPrompt string) (string, error) {
+	if err := promptBudget.reserve(ctx); err != nil {
+		return "", err
+	}
 
-	slog.Debug("Sending prompt to Gemma", userPrompt)
+	slog.DebugContext(ctx, "Sending prompt to Gemma", "prompt", fullPrompt)
 
 	// Create the request payload
 	requestPayload := OllamaRequest{
-		Model:  "gemma3:4b",
+		Model:  model,
 		Prompt: fullPrompt,
 		Stream: false,
 	}
@@ -296,23 +403,22 @@ func generatePrompt(fullPrompt string) (string, error) {
 	// Convert the payload to JSON
 	jsonData, err := json.Marshal(requestPayload)
 	if err != nil {
-		slog.Log(context.Background(), slog.LevelError, "Error marshalling JSON", "error", err)
+		slog.Log(ctx, slog.LevelError, "Error marshalling JSON", "error", err)
 		return "", err
 	}
 
 	// Create a new HTTP POST request
-	req, err := http.NewRequest("POST", promptServer+"/api/generate", bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(context.WithoutCancel(ctx), "POST", cfg.PromptServer+"/api/generate", bytes.NewBuffer(jsonData))
 	if err != nil {
-		slog.Log(context.Background(), slog.LevelError, "Error creating request", "error", err)
+		slog.Log(ctx, slog.LevelError, "Error creating request", "error", err)
 		return "", err
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	// Send the request using the default HTTP client
-	client := &http.Client{Timeout: 60 * time.Second} // Set a timeout
-	resp, err := client.Do(req)
+	// Send the request using the shared prompt client, which has a timeout
+	resp, err := promptClient.Do(req)
 	if err != nil {
-		slog.Log(context.Background(), slog.LevelError, "Error sending request to Ollama", "error", err)
+		slog.Log(ctx, slog.LevelError, "Error sending request to Ollama", "error", err)
 		return "", err
 	}
 	defer resp.Body.Close()
@@ -320,77 +426,291 @@ func generatePrompt(fullPrompt string) (string, error) {
 	// Check the response status code
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
-		slog.Log(context.Background(), slog.LevelError, "Received non-OK HTTP status", resp.StatusCode, "Response", string(bodyBytes))
+		slog.Log(ctx, slog.LevelError, "Received non-OK HTTP status", "status", resp.StatusCode, "Response", string(bodyBytes))
 		return "", fmt.Errorf("received non-OK HTTP status %d", resp.StatusCode)
 	}
 
 	// Read the response body
-	body, err := io.ReadAll(resp.Body)
+	body, err := readAll(resp)
 	if err != nil {
-		slog.Error("Error reading response body: %v", err)
+		slog.Log(ctx, slog.LevelError, "Error reading response body", "error", err)
 		return "", err
 	}
 
-	// Unmarshal the JSON response
-	var ollamaResponse OllamaResponse
-	err = json.Unmarshal(body, &ollamaResponse)
+	response, err := decodeOllamaResponse(body)
 	if err != nil {
-		slog.Log(context.Background(), slog.LevelError, "Error unmarshalling response JSON", "error", err)
+		slog.Log(ctx, slog.LevelError, "Error unmarshalling response JSON", "error", err)
 		return "", err
 	}
 
+	promptBudget.spend(ctx, response)
+
 	// Print the response from the model
-	slog.Log(context.Background(), slog.LevelError, "Gemma's Response", "info", ollamaResponse.Response)
-	return ollamaResponse.Response, nil
+	slog.Log(ctx, slog.LevelError, "Gemma's Response", "info", response)
+	if cleaned := cleanPrompt(response); cleaned != strings.TrimSpace(response) {
+		slog.Log(ctx, slog.LevelInfo, "Stripped wrapper from generated prompt", "prompt", cleaned)
+		response = cleaned
+	}
+	return response, nil
+}
+
+// decodeOllamaResponse returns the generated text in an /api/generate
+// response body. Under load Ollama sometimes answers a non-streaming request
+// with several concatenated JSON objects, as if streaming, so the response
+// fields of every object are joined. Anything unparseable after the object
+// marked done is ignored.
+func decodeOllamaResponse(body []byte) (string, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	var text strings.Builder
+	var objects int
+	done := false
+	for {
+		var chunk OllamaResponse
+		err := dec.Decode(&chunk)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if done {
+				break
+			}
+			return "", err
+		}
+		objects++
+		text.WriteString(chunk.Response)
+		done = done || chunk.Done
+	}
+	if objects == 0 {
+		return "", fmt.Errorf("empty response body")
+	}
+	if objects > 1 {
+		slog.Log(context.Background(), slog.LevelDebug, "Joined concatenated prompt server response", "objects", objects)
+	}
+	return text.String(), nil
+}
+
+// chatResponse is what a chat server request produced. Durations are set
+// even when the request fails, as far as it got.
+type chatResponse struct {
+	Reply    string
+	Latency  time.Duration // dispatch to end of body
+	BodyTime time.Duration // response headers to end of body
+	// StallGap is the longest wait for the body: BodyTime, or for a
+	// stream the longest gap between its lines.
+	StallGap time.Duration
+	ConnWait time.Duration // queued waiting for a pooled connection
+	Parts    []part        // the message parts as sent
+	// ReceiveDelay is send to the backend's reported receive time, when
+	// SERVER_RECEIVE_TIME_HEADER is set and the response has it.
+	ReceiveDelay time.Duration
+	// ServerTime is the processing time the backend reports in one of
+	// SERVER_TIMING_HEADERS.
+	ServerTime time.Duration
+	// Keepalives is the number of keepalive comments in a streamed response.
+	Keepalives int
+	// Anomaly describes a stream that failed CHECK_STREAM_INTEGRITY.
+	Anomaly *streamAnomaly
+	// Exchange is the request and response verbatim, only with FAIL_FAST.
+	Exchange *exchange
 }
 
-func requestMovieRecommendations(prompt string, sessionId string) error {
+// requestMovieRecommendations sends the prompt parts to the chat server on
+// sess, as its user, marked for the canary if canary is set. It doesn't record stats, so
+// callers decide whether a request counts. The request isn't cancelled with
+// ctx, so it completes even if its virtual user is stopped.
+func requestMovieRecommendations(ctx context.Context, parts []part, sess *session, canary bool) (chatResponse, error) {
+	if cfg.DisableCache {
+		parts = withNonce(parts)
+	}
+
 	// Create the request payload
 	requestPayload := AdkRequest{
-		AppName:   appName,
-		UserId:    fakeUser,
-		SessionId: "session_fake@google.com_476b8101", //sessionId,
+		AppName:   sess.app,
+		UserId:    sess.user,
+		SessionId: sess.id,
 		NewMessage: newMessage{
-			Role: "user",
-			Parts: []part{
-				{
-					Text: prompt,
-				},
-			},
+			Role:  "user",
+			Parts: parts,
 		},
-		Streaming: false,
+		Streaming: cfg.Streaming,
 	}
 	// Convert the payload to JSON
 	jsonData, err := json.Marshal(requestPayload)
 	if err != nil {
-		slog.Log(context.Background(), slog.LevelError, "Error marshalling JSON", "error", err)
-		return err
+		slog.Log(ctx, slog.LevelError, "Error marshalling JSON", "error", err)
+		return chatResponse{}, err
+	}
+	logBodies := sampleBodyLog()
+	if logBodies {
+		slog.Log(ctx, slog.LevelInfo, "Sending request to chat server", "info", logJSON(jsonData))
+	} else {
+		slog.Log(ctx, slog.LevelDebug, "Sending request to chat server", "bytes", len(jsonData))
 	}
-	slog.Log(context.Background(), slog.LevelInfo, "Sending request to chat server", "info", string(jsonData))
-	req, _ := http.NewRequest("POST", chatServer+"/run", bytes.NewBuffer(jsonData))
+	reqCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+	if d := requestTimeout(ctx); d > 0 {
+		reqCtx, cancel = context.WithTimeout(reqCtx, d)
+		defer cancel()
+	}
+	defer context.AfterFunc(aborted, cancel)()
+	reqCtx, connWait := connWaitTrace(reqCtx)
+	req, _ := http.NewRequestWithContext(reqCtx, "POST", chatEndpoint(), bytes.NewBuffer(jsonData))
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("x-goog-authenticated-user-email", fakeUser)
+	setAuthUser(req, sess.user)
+	setVUHeader(ctx, req)
+	setTraceparent(ctx, req)
+	if cfg.DisableCache {
+		req.Header.Set("Cache-Control", "no-cache")
+	}
+	if canary {
+		markCanary(req)
+	}
+	x := newExchange(req, jsonData)
+
+	start := time.Now()
+	setSendTime(req, start)
+	resp, err := chatClient.Do(req)
+	if err != nil {
+		slog.Log(ctx, slog.LevelError, "Error making request:", "Error", err)
+		return chatResponse{Latency: time.Since(start), ConnWait: connWait(), Parts: parts, Exchange: x}, err
+	}
+	recvDelay, _ := receiveDelay(ctx, resp, start)
+	if cfg.AsyncMode && resp.StatusCode == http.StatusAccepted {
+		// Latency covers the whole wait for the result.
+		if resp, err = awaitAsync(ctx, reqCtx, resp); err != nil {
+			slog.Log(ctx, slog.LevelError, "Error polling for async result", "error", err)
+			// The server accepted the request, so it mustn't be retried.
+			return chatResponse{Latency: time.Since(start), ConnWait: connWait(), Parts: parts, Exchange: x}, &responseError{err: err}
+		}
+	}
+	defer resp.Body.Close()
+	srvTime, _ := serverTime(ctx, resp)
+
+	if cfg.Streaming && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		if err := checkEventStream(resp); err != nil {
+			logInvalidResponse(ctx, err)
+			return chatResponse{Latency: time.Since(start), ConnWait: connWait(), Parts: parts, Exchange: x}, err
+		}
+		stream, bodyTime, err := readStream(resp, cancel, pickAbandonAfter())
+		res := chatResponse{Latency: time.Since(start), BodyTime: bodyTime, StallGap: stream.maxGap, ConnWait: connWait(), ReceiveDelay: recvDelay, ServerTime: srvTime, Parts: parts, Keepalives: stream.keepalives, Exchange: x}
+		if x != nil {
+			// The stream is consumed as it's parsed, so keep the events
+			// received rather than the raw body.
+			events, _ := json.Marshal(stream.events)
+			x.setResponse(resp, events)
+		}
+		if errors.Is(err, errStreamAbandoned) {
+			slog.Log(ctx, slog.LevelDebug, "Abandoned stream", "events", len(stream.events))
+			res.Reply = replyFromEvents(stream.events)
+			return res, err
+		}
+		if err != nil {
+			slog.Log(ctx, slog.LevelError, "Error reading response stream", "error", err, "events", len(stream.events))
+			return res, &responseError{err: err}
+		}
+		if cfg.CheckStreamIntegrity {
+			if kinds := checkStreamIntegrity(stream.events); kinds != nil {
+				a := newStreamAnomaly(stream.events, kinds)
+				res.Anomaly = &a
+			}
+		}
+		slog.Log(ctx, slog.LevelDebug, "Movie Recommendations", "events", len(stream.events), "keepalives", stream.keepalives)
+		res.Reply = replyFromEvents(stream.events)
+		if cfg.ValidateResponses {
+			err = validateEvents(stream.events)
+			logInvalidResponse(ctx, err)
+		}
+		return res, err
+	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	body, bodyTime, err := readBody(resp, start)
+	res := chatResponse{Latency: time.Since(start), BodyTime: bodyTime, StallGap: bodyTime, ConnWait: connWait(), ReceiveDelay: recvDelay, ServerTime: srvTime, Parts: parts, Exchange: x}
+	x.setResponse(resp, body)
 	if err != nil {
-		slog.Log(context.Background(), slog.LevelError, "Error making request:", "Error", err)
-		return err
+		slog.Log(ctx, slog.LevelError, "Error reading response body", "error", err)
+		return res, &responseError{err: err}
 	}
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		slog.Log(context.Background(), slog.LevelError, "Server returned error", "error", string(bodyBytes))
-		return fmt.Errorf("server returned error: %s (%d)", http.StatusText(resp.StatusCode), resp.StatusCode)
+		if logBodies {
+			slog.Log(ctx, slog.LevelError, "Server returned error", "status", resp.StatusCode, "error", logJSON(body))
+		} else {
+			slog.Log(ctx, slog.LevelError, "Server returned error", "status", resp.StatusCode, "bytes", len(body))
+		}
+		return res, &statusError{code: resp.StatusCode}
 	}
 
-	body, _ := io.ReadAll(resp.Body)
-	slog.Log(context.Background(), slog.LevelError, "Movie Recommendations", "info", string(body))
-	defer resp.Body.Close()
-	return nil
+	if err := checkBinary(body); err != nil {
+		slog.Log(ctx, slog.LevelWarn, "Chat server returned a binary response", "bytes", len(body), "preview", binaryPreview(body))
+		return res, err
+	}
+	if logBodies {
+		slog.Log(ctx, slog.LevelError, "Movie Recommendations", "info", logJSON(body))
+	} else {
+		slog.Log(ctx, slog.LevelDebug, "Movie Recommendations", "bytes", len(body))
+	}
+	if err := checkJSON(resp, body); err != nil {
+		logInvalidResponse(ctx, err)
+		return res, err
+	}
+	res.Reply = extractReply(body)
+	if cfg.ValidateResponses {
+		err = validateBody(body)
+		logInvalidResponse(ctx, err)
+	}
+	return res, err
+}
+
+// chatEndpoint returns the URL chat requests are sent to.
+func chatEndpoint() string {
+	if cfg.Streaming {
+		return cfg.ChatServer + "/run_sse"
+	}
+	return cfg.ChatServer + "/run"
+}
+
+// sampleBodyLog decides whether a request's full request and response bodies
+// are logged, keeping a cfg.BodyLogSampleRate share of them.
+func sampleBodyLog() bool {
+	return cfg.BodyLogSampleRate >= 1 || (cfg.BodyLogSampleRate > 0 && rng.Float64() < cfg.BodyLogSampleRate)
+}
+
+// logJSON formats a request or response body for logging, indented with
+// LOG_JSON_PRETTY and compacted onto one line otherwise. Bodies that aren't
+// JSON are logged as they are, unless they're binary.
+func logJSON(b []byte) string {
+	if isBinary(b) {
+		return binaryPreview(b)
+	}
+	var buf bytes.Buffer
+	var err error
+	if cfg.LogJSONPretty {
+		err = json.Indent(&buf, b, "", "  ")
+	} else {
+		err = json.Compact(&buf, b)
+	}
+	if err != nil {
+		return string(b)
+	}
+	return buf.String()
 }
 
 // HealthHandler handles kubernetes healthchecks
 func HealthHandler(w http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(w).Encode(map[string]bool{"ok": true})
 }
+
+// initialized is set once configuration, session creation and warm-up are
+// done and load is about to start.
+var initialized atomic.Bool
+
+// StartupHandler handles kubernetes startup probes. It returns 503 until
+// initialization has finished.
+func StartupHandler(w http.ResponseWriter, r *http.Request) {
+	if !initialized.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(map[string]bool{"ok": false})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+}
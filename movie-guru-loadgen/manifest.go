@@ -0,0 +1,72 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// version is the loadgen release, set at build time with
+// -ldflags "-X main.version=...".
+var version = "dev"
+
+// runManifest documents a run's parameters so it can be reproduced: the
+// full effective configuration, including the seed, and the build that ran
+// it.
+type runManifest struct {
+	Version      string    `json:"version"`
+	Revision     string    `json:"revision,omitempty"`
+	GoVersion    string    `json:"go_version"`
+	Hostname     string    `json:"hostname,omitempty"`
+	Started      time.Time `json:"started"`
+	Seed         int64     `json:"seed"`
+	ChatServer   string    `json:"chat_server"`
+	PromptServer string    `json:"prompt_server,omitempty"`
+	Config       config    `json:"config"`
+}
+
+func newRunManifest() runManifest {
+	m := runManifest{
+		Version:      version,
+		GoVersion:    runtime.Version(),
+		Started:      stats.started,
+		Seed:         cfg.Seed,
+		ChatServer:   cfg.ChatServer,
+		PromptServer: cfg.PromptServer,
+		Config:       cfg,
+	}
+	m.Hostname, _ = os.Hostname()
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				m.Revision = s.Value
+			}
+		}
+	}
+	return m
+}
+
+// writeManifest writes the run's manifest to path as indented JSON.
+func writeManifest(path string) error {
+	b, err := json.MarshalIndent(newRunManifest(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0o644)
+}
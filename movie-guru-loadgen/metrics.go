@@ -0,0 +1,382 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const metricsNamespace = "loadgen"
+
+// latencyBuckets covers 10ms to ~5min, which spans both fast failures and
+// slow LLM-backed responses.
+var latencyBuckets = prometheus.ExponentialBuckets(0.01, 2, 15)
+
+var (
+	chatRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "chat_request_duration_seconds",
+		Help:      "Latency of chat server requests, measured from dispatch after the rate limiter grants a token.",
+		Buckets:   latencyBuckets,
+	}, []string{"outcome"})
+
+	chatErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "chat_errors_total",
+		Help:      "Number of failed chat requests by class: transport (DNS, dial, TLS, connections dropped before a response), timeout, response (body too large or cut short), application (error status from the server), stream_idle, binary or semantic (invalid response).",
+	}, []string{"class"})
+
+	taggedChatRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "tagged_chat_request_duration_seconds",
+		Help:      "Latency of chat server requests broken down by request tag, e.g. tag=\"message\",value=\"multipart\".",
+		Buckets:   latencyBuckets,
+	}, []string{"tag", "value", "outcome"})
+
+	limiterWaitDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "limiter_wait_seconds",
+		Help:      "Time spent waiting for a rate limiter token before dispatching a chat request.",
+		Buckets:   latencyBuckets,
+	})
+
+	bodyReadDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "body_read_seconds",
+		Help:      "Time between receiving response headers and the end of the response body.",
+		Buckets:   latencyBuckets,
+	})
+
+	connWaitDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "conn_wait_seconds",
+		Help:      "Time chat requests spent queued for a pooled connection, excluding dial and TLS handshake time.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 12),
+	})
+
+	clientQueueDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "client_queue_seconds",
+		Help:      "Time between a chat request getting its rate limiter token and being sent, such as waiting for a free slot on its session.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 12),
+	})
+
+	receiveDelayDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "server_receive_delay_seconds",
+		Help:      "Time between sending a chat request and the receive time the backend reports in SERVER_RECEIVE_TIME_HEADER: network and queueing delay before processing, plus clock skew.",
+		Buckets:   latencyBuckets,
+	})
+
+	serverTimeDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "server_processing_seconds",
+		Help:      "Processing time of chat requests as reported by the backend in SERVER_TIMING_HEADERS.",
+		Buckets:   latencyBuckets,
+	})
+
+	networkOverhead = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "network_overhead_seconds",
+		Help:      "Client-observed latency of chat requests less the processing time the backend reports in SERVER_TIMING_HEADERS.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 12),
+	})
+
+	sessionGapDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "session_gap_seconds",
+		Help:      "Time between a virtual user's last response in a conversation and its first request on the next session, including SESSION_COOLDOWN.",
+		Buckets:   latencyBuckets,
+	})
+
+	invalidResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "invalid_responses_total",
+		Help:      "Number of successful chat responses that were invalid, by reason: not_json or not_event_stream, always checked, or malformed, no_model_turn, empty_parts or empty_text with VALIDATE_RESPONSES.",
+	}, []string{"reason"})
+
+	iterationDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "iteration_seconds",
+		Help:      "Wall-clock time of a virtual user's iteration: prompt generation, think time, rate limiter wait and chat request.",
+		Buckets:   latencyBuckets,
+	})
+
+	asyncPolls = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "async_polls_total",
+		Help:      "Number of ASYNC_MODE polls for the result of chat requests accepted with 202.",
+	})
+
+	streamAnomalies = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "stream_anomalies_total",
+		Help:      "Number of streamed chat responses failing CHECK_STREAM_INTEGRITY, by kind: duplicate_event, duplicate_chunk, out_of_order or partials_mismatch.",
+	}, []string{"kind"})
+
+	contentionErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "session_contention_errors_total",
+		Help:      "Number of chat requests rejected with 409 Conflict or 423 Locked because their session was in use by, or changed by, a concurrent request.",
+	})
+
+	streamsAbandoned = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "streams_abandoned_total",
+		Help:      "Number of streamed chat responses closed early by STREAM_ABANDON_FRACTION.",
+	})
+
+	abandonedOutcomes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "abandoned_stream_outcomes_total",
+		Help:      "Number of abandoned streams by what the backend did: completed (stored a reply anyway), cancelled (stored none) or error (the session couldn't be checked).",
+	}, []string{"outcome"})
+
+	sessionRaces = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "session_races_total",
+		Help:      "Number of SESSION_RACE_FRACTION bursts of concurrent requests on one session.",
+	})
+
+	sessionRaceAnomalies = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "session_race_anomalies_total",
+		Help:      "Number of session races that damaged the session, by kind: lost_message, duplicate_message, interleaved, missing_reply, empty_reply or history_lost.",
+	}, []string{"kind"})
+
+	streamKeepalives = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "stream_keepalives_total",
+		Help:      "Number of keepalive comments received on streamed chat responses.",
+	})
+
+	stalledResponses = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "stalled_responses_total",
+		Help:      "Number of responses whose body took longer than STALL_THRESHOLD to arrive after the headers.",
+	})
+
+	outOfOrderResponses = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "out_of_order_responses_total",
+		Help:      "Number of chat responses that completed after a request dispatched later on the same session.",
+	})
+
+	retriesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "retries_total",
+		Help:      "Number of chat requests retried after a failure.",
+	})
+
+	timeoutTierSuccesses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "timeout_tier_successes_total",
+		Help:      "Number of chat requests that succeeded, by the REQUEST_TIMEOUTS timeout of the attempt that succeeded.",
+	}, []string{"timeout"})
+
+	retriesDenied = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "retries_denied_total",
+		Help:      "Number of retries not made because the run's retry budget was exhausted.",
+	})
+
+	retryBudgetAvailable = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "retry_budget_available",
+		Help:      "Number of retries the run's retry budget currently allows.",
+	})
+
+	eventChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "event_checks_total",
+		Help:      "Number of VERIFY_EVENTS checks by outcome: found, missing or error.",
+	}, []string{"outcome"})
+
+	sessionUpdates = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "session_updates_total",
+		Help:      "Number of SESSION_UPDATE_INTERVAL session state updates by outcome: success or error.",
+	}, []string{"outcome"})
+
+	sessionPoolIdle = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "session_pool_idle",
+		Help:      "Number of SESSION_POOL_SIZE sessions not held by a virtual user.",
+	})
+
+	sessionPoolInUse = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "session_pool_in_use",
+		Help:      "Number of virtual users holding sessions from the session pool.",
+	})
+
+	sessionPoolCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "session_pool_created_total",
+		Help:      "Number of sessions created on demand because the session pool was exhausted.",
+	})
+
+	endpointConsecutiveFailures = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "endpoint_consecutive_failures",
+		Help:      "Number of consecutive failed requests to a backend endpoint, 0 once a request succeeds.",
+	}, []string{"endpoint"})
+
+	endpointBreakerOpen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "endpoint_breaker_open",
+		Help:      "1 while a backend endpoint's CIRCUIT_BREAKER_THRESHOLD breaker is open or half-open, 0 while it is closed.",
+	}, []string{"endpoint"})
+
+	rateLimitRPM = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "rate_limit_rpm",
+		Help:      "Current chat request rate limit in requests per minute, 0 when unlimited.",
+	})
+
+	appRateLimitRPM = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "app_rate_limit_rpm",
+		Help:      "APP_RATE_LIMITS request rate cap of an app in requests per minute.",
+	}, []string{"app"})
+
+	appDispatched = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "app_requests_dispatched_total",
+		Help:      "Number of chat requests, including retries, let through the rate limiters by app. Its rate is the app's effective request rate.",
+	}, []string{"app"})
+
+	mostCommonPercent = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "most_common_response_percent",
+		Help:      "Share of the latest RESPONSE_DIVERSITY_WINDOW successful replies taken by the most common reply.",
+	})
+
+	lowResponseDiversity = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "low_response_diversity",
+		Help:      "1 while the most common reply's share is above RESPONSE_DUPLICATE_THRESHOLD, else 0.",
+	})
+
+	selfThrottled = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "self_throttled",
+		Help:      "1 while the loadgen has cut the rate limit because its own CPU usage is above SELF_THROTTLE_CPU, else 0.",
+	})
+
+	cpuUsage = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "cpu_usage_percent",
+		Help:      "The loadgen's own CPU usage as a percentage of GOMAXPROCS cores, measured every SELF_THROTTLE_INTERVAL.",
+	})
+
+	virtualUsers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "virtual_users",
+		Help:      "Number of virtual users currently sending requests.",
+	})
+
+	shortResponses = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "short_responses_total",
+		Help:      "Number of successful chat responses shorter than MIN_RESPONSE_CHARS, a sign of truncated or partial generation.",
+	})
+
+	responseDifferences = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "response_difference",
+		Help:      "Difference between replies and RESPONSE_BASELINE_FILE, from 0 (same words) to 1 (no words in common).",
+		Buckets:   []float64{0, 0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 1},
+	})
+
+	emptyPrompts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "empty_prompts_total",
+		Help:      "Number of empty or whitespace-only prompts returned by the prompt server.",
+	})
+
+	blockedPromptsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "blocked_prompts_total",
+		Help:      "Number of generated prompts that matched BLOCKED_PROMPT_PATTERNS.",
+	})
+
+	promptLengthChars = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "prompt_length_chars",
+		Help:      "Length in characters of the prompts sent to the chat server.",
+		Buckets:   prometheus.LinearBuckets(100, 100, 15),
+	})
+
+	conversationTokens = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "conversation_tokens",
+		Help:      "Estimated tokens (characters / 4) of the questions and answers exchanged per conversation, observed when it ends.",
+		Buckets:   prometheus.ExponentialBuckets(100, 2, 12),
+	})
+
+	conversationResets = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "conversation_resets_total",
+		Help:      "Number of conversations ended by MAX_CONVERSATION_TOKENS and continued on a fresh session.",
+	})
+
+	promptLengthTokens = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "prompt_length_tokens",
+		Help:      "Estimated length in tokens (characters / 4) of the prompts sent to the chat server.",
+		Buckets:   prometheus.LinearBuckets(25, 25, 15),
+	})
+
+	overlongPrompts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "overlong_prompts_total",
+		Help:      "Number of generated prompts longer than the 750 characters the model is asked to stay within.",
+	})
+
+	promptBufferFill = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "prompt_buffer_prompts",
+		Help:      "Number of pre-generated prompts waiting in the PROMPT_BUFFER.",
+	})
+
+	promptBudgetUsed = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "prompt_budget_used",
+		Help:      "PROMPT_BUDGET used so far, in generation requests or estimated tokens.",
+	})
+
+	promptBudgetLimit = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "prompt_budget_limit",
+		Help:      "PROMPT_BUDGET limit, in generation requests or estimated tokens.",
+	})
+
+	promptErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "prompt_errors_total",
+		Help:      "Number of failed prompt server requests.",
+	})
+)
+
+// readGauge returns the current value of a gauge so it can be forwarded to
+// other monitoring systems.
+func readGauge(g prometheus.Gauge) float64 {
+	var m dto.Metric
+	_ = g.Write(&m)
+	return m.GetGauge().GetValue()
+}
@@ -0,0 +1,54 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"time"
+)
+
+// logMetrics logs the request rate, error rate and latency percentiles of
+// the last interval every interval until ctx is done, as a progress signal
+// where no metrics backend scrapes /metrics.
+func logMetrics(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	prev := stats.totals()
+	prevAt := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			cur := stats.totals()
+			requests := cur.requests - prev.requests
+			errors := cur.errors - prev.errors
+			latency := cur.latency.since(prev.latency).summary(1000)
+			slog.Log(ctx, slog.LevelInfo, "Load progress",
+				"interval", now.Sub(prevAt).Round(time.Millisecond),
+				"requests", requests,
+				"errors", errors,
+				"rps", math.Round(float64(requests)/now.Sub(prevAt).Seconds()*100)/100,
+				"error_rate", errorRate(errors, requests),
+				"p50_ms", math.Round(latency.P50*10)/10,
+				"p99_ms", math.Round(latency.P99*10)/10,
+				"total_requests", cur.requests,
+				"virtual_users", readGauge(virtualUsers))
+			prev, prevAt = cur, now
+		}
+	}
+}
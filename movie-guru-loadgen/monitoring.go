@@ -0,0 +1,161 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"os"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+	"cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"google.golang.org/genproto/googleapis/api/distribution"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoredrespb "google.golang.org/genproto/googleapis/api/monitoredres"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	customMetricPrefix = "custom.googleapis.com/loadgen/"
+
+	// Cloud Monitoring limits the number of buckets in a distribution, so
+	// every monitoringBucketRatio histogram buckets are folded into one.
+	monitoringBucketRatio   = 4
+	monitoringFiniteBuckets = 200
+)
+
+// monitoringExporter pushes the run statistics to Cloud Monitoring as custom
+// metrics. It authenticates with Application Default Credentials.
+type monitoringExporter struct {
+	client   *monitoring.MetricClient
+	project  string
+	instance string
+}
+
+func newMonitoringExporter(ctx context.Context, project string) (*monitoringExporter, error) {
+	client, err := monitoring.NewMetricClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	instance, _ := os.Hostname()
+	return &monitoringExporter{client: client, project: project, instance: instance}, nil
+}
+
+// run exports the statistics every interval until ctx is done.
+func (e *monitoringExporter) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := e.export(ctx); err != nil {
+				slog.Log(ctx, slog.LevelWarn, "Error exporting metrics to Cloud Monitoring", "error", err)
+			}
+		}
+	}
+}
+
+// flush exports the final values, so the last interval of the run isn't
+// lost.
+func (e *monitoringExporter) flush(ctx context.Context) error {
+	return e.export(ctx)
+}
+
+func (e *monitoringExporter) export(ctx context.Context) error {
+	t := stats.totals()
+	interval := &monitoringpb.TimeInterval{
+		StartTime: timestamppb.New(t.started),
+		EndTime:   timestamppb.Now(),
+	}
+	gaugeInterval := &monitoringpb.TimeInterval{EndTime: interval.EndTime}
+
+	series := []*monitoringpb.TimeSeries{
+		e.int64Series("chat_requests", map[string]string{"outcome": "success"}, metricpb.MetricDescriptor_CUMULATIVE, interval, int64(t.requests-t.errors)),
+		e.int64Series("chat_requests", map[string]string{"outcome": "error"}, metricpb.MetricDescriptor_CUMULATIVE, interval, int64(t.errors)),
+		e.int64Series("empty_prompts", nil, metricpb.MetricDescriptor_CUMULATIVE, interval, int64(t.emptyPrompts)),
+		e.int64Series("virtual_users", nil, metricpb.MetricDescriptor_GAUGE, gaugeInterval, int64(readGauge(virtualUsers))),
+	}
+	if t.latency.Count > 0 {
+		series = append(series, e.distributionSeries("chat_request_latency_seconds", interval, t.latency))
+	}
+	if t.limiterWait.Count > 0 {
+		series = append(series, e.distributionSeries("limiter_wait_seconds", interval, t.limiterWait))
+	}
+
+	return e.client.CreateTimeSeries(ctx, &monitoringpb.CreateTimeSeriesRequest{
+		Name:       "projects/" + e.project,
+		TimeSeries: series,
+	})
+}
+
+func (e *monitoringExporter) series(name string, labels map[string]string, kind metricpb.MetricDescriptor_MetricKind, valueType metricpb.MetricDescriptor_ValueType, point *monitoringpb.Point) *monitoringpb.TimeSeries {
+	metricLabels := map[string]string{"instance": e.instance}
+	for k, v := range labels {
+		metricLabels[k] = v
+	}
+	return &monitoringpb.TimeSeries{
+		Metric: &metricpb.Metric{Type: customMetricPrefix + name, Labels: metricLabels},
+		Resource: &monitoredrespb.MonitoredResource{
+			Type:   "global",
+			Labels: map[string]string{"project_id": e.project},
+		},
+		MetricKind: kind,
+		ValueType:  valueType,
+		Points:     []*monitoringpb.Point{point},
+	}
+}
+
+func (e *monitoringExporter) int64Series(name string, labels map[string]string, kind metricpb.MetricDescriptor_MetricKind, interval *monitoringpb.TimeInterval, v int64) *monitoringpb.TimeSeries {
+	return e.series(name, labels, kind, metricpb.MetricDescriptor_INT64, &monitoringpb.Point{
+		Interval: interval,
+		Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_Int64Value{Int64Value: v}},
+	})
+}
+
+func (e *monitoringExporter) distributionSeries(name string, interval *monitoringpb.TimeInterval, h *histogram) *monitoringpb.TimeSeries {
+	return e.series(name, nil, metricpb.MetricDescriptor_CUMULATIVE, metricpb.MetricDescriptor_DISTRIBUTION, &monitoringpb.Point{
+		Interval: interval,
+		Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DistributionValue{DistributionValue: toDistribution(h)}},
+	})
+}
+
+// toDistribution converts a histogram into a Cloud Monitoring distribution
+// with exponential buckets aligned to the histogram's own bucket bounds.
+func toDistribution(h *histogram) *distribution.Distribution {
+	// One underflow bucket, the finite buckets and one overflow bucket.
+	counts := make([]int64, monitoringFiniteBuckets+2)
+	for k, v := range h.Buckets {
+		i := (k + monitoringBucketRatio - 1) / monitoringBucketRatio
+		counts[min(i, monitoringFiniteBuckets+1)] += int64(v)
+	}
+	return &distribution.Distribution{
+		Count: int64(h.Count),
+		Mean:  h.Sum / float64(h.Count),
+		BucketOptions: &distribution.Distribution_BucketOptions{
+			Options: &distribution.Distribution_BucketOptions_ExponentialBuckets{
+				ExponentialBuckets: &distribution.Distribution_BucketOptions_Exponential{
+					NumFiniteBuckets: monitoringFiniteBuckets,
+					GrowthFactor:     math.Pow(histogramGrowth, monitoringBucketRatio),
+					Scale:            histogramMin,
+				},
+			},
+		},
+		BucketCounts: counts,
+	}
+}
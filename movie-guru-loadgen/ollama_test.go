@@ -0,0 +1,70 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestDecodeOllamaResponse(t *testing.T) {
+	concatenated, err := os.ReadFile("testdata/ollama_concatenated.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "single object",
+			body: `{"model":"gemma3:4b","response":"Any good horror movies?","done":true}`,
+			want: "Any good horror movies?",
+		},
+		{
+			name: "concatenated objects",
+			body: string(concatenated),
+			want: "Can you recommend a funny animated movie from 2010?",
+		},
+		{
+			name: "truncated after done",
+			body: `{"response":"Any thrillers?","done":true}{"response":"ext`,
+			want: "Any thrillers?",
+		},
+		{
+			name:    "truncated before done",
+			body:    `{"response":"Any thr","done":false}{"response":"ill`,
+			wantErr: true,
+		},
+		{
+			name:    "empty",
+			body:    "",
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := decodeOllamaResponse([]byte(tc.body))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("decodeOllamaResponse() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("decodeOllamaResponse() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	crand "crypto/rand"
+	"encoding/hex"
+	"strings"
+)
+
+const (
+	splitBySentence = "sentence"
+	splitByLine     = "line"
+)
+
+// messageParts turns a prompt into the parts of an ADK message. A
+// cfg.SplitFraction share of prompts is split using cfg.SplitStrategy so the
+// backend sees multi-part messages as well as single-part ones.
+func messageParts(prompt string) []part {
+	if cfg.SplitFraction > 0 && rng.Float64() < cfg.SplitFraction {
+		var texts []string
+		switch cfg.SplitStrategy {
+		case splitByLine:
+			texts = splitLines(prompt)
+		default:
+			texts = splitSentences(prompt)
+		}
+		if len(texts) > 1 {
+			parts := make([]part, len(texts))
+			for i, t := range texts {
+				parts[i] = part{Text: t}
+			}
+			return parts
+		}
+	}
+	return []part{{Text: prompt}}
+}
+
+// splitSentences splits after '.', '!' or '?' when followed by whitespace.
+func splitSentences(s string) []string {
+	var out []string
+	start := 0
+	for i := 0; i < len(s)-1; i++ {
+		if strings.ContainsRune(".!?", rune(s[i])) && (s[i+1] == ' ' || s[i+1] == '\n') {
+			out = appendTrimmed(out, s[start:i+1])
+			start = i + 1
+		}
+	}
+	return appendTrimmed(out, s[start:])
+}
+
+func splitLines(s string) []string {
+	var out []string
+	for _, line := range strings.Split(s, "\n") {
+		out = appendTrimmed(out, line)
+	}
+	return out
+}
+
+func appendTrimmed(out []string, s string) []string {
+	if s = strings.TrimSpace(s); s != "" {
+		out = append(out, s)
+	}
+	return out
+}
+
+// withNonce returns a copy of parts with a short random reference appended to
+// the last part. It makes every prompt unique, so a cache keyed on the prompt
+// always misses, without changing what is being asked.
+func withNonce(parts []part) []part {
+	b := make([]byte, 4)
+	_, _ = crand.Read(b)
+
+	out := make([]part, len(parts))
+	copy(out, parts)
+	last := len(out) - 1
+	out[last].Text += " (ref " + hex.EncodeToString(b) + ")"
+	return out
+}
@@ -0,0 +1,80 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// pinnedPrompts holds the prompts of the virtual users in VU_PROMPT_FILES,
+// by virtual user number.
+var pinnedPrompts map[int]*pinnedSource
+
+// pinnedSource sends a virtual user's prompts in file order, starting over
+// after the last, so its requests are the same every run. It is only used by
+// its own virtual user's goroutine.
+type pinnedSource struct {
+	file    string
+	prompts []string
+	next    int
+}
+
+func (p *pinnedSource) generate(context.Context, *conversation) (string, []tag, error) {
+	prompt := p.prompts[p.next%len(p.prompts)]
+	p.next++
+	return prompt, []tag{{Key: "prompt_pinned", Value: p.file}}, nil
+}
+
+// sourceFor returns the prompt source of the virtual user in ctx: its
+// pinned prompts if it has any, and prompts otherwise.
+func sourceFor(ctx context.Context) promptSource {
+	if vuID(ctx) != "" {
+		if p := pinnedPrompts[vuNumber(ctx)]; p != nil {
+			return p
+		}
+	}
+	return prompts
+}
+
+// loadPinnedPrompts parses a list such as "0=repro.txt,vu-3=other.txt" and
+// reads each virtual user's prompt file, one prompt per line.
+func loadPinnedPrompts(ctx context.Context, spec []string) (map[int]*pinnedSource, error) {
+	pinned := make(map[int]*pinnedSource)
+	for _, item := range spec {
+		vu, file, ok := strings.Cut(item, "=")
+		file = strings.TrimSpace(file)
+		if !ok || file == "" {
+			return nil, fmt.Errorf("%q must look like vu=prompt_file", item)
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(vu), "vu-"))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%q is not a virtual user number", vu)
+		}
+		if pinned[n] != nil {
+			return nil, fmt.Errorf("virtual user %d is pinned twice", n)
+		}
+		lines, err := readSeedFile(file)
+		if err != nil {
+			return nil, err
+		}
+		pinned[n] = &pinnedSource{file: file, prompts: lines}
+		slog.Log(ctx, slog.LevelInfo, "Pinned prompts to virtual user", "vu", "vu-"+strconv.Itoa(n), "file", file, "prompts", len(lines))
+	}
+	return pinned, nil
+}
@@ -0,0 +1,187 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// preflightTimeout bounds each step of the preflight check.
+const preflightTimeout = 10 * time.Second
+
+// preflightError is a failed preflight step, with advice on how to fix it.
+type preflightError struct {
+	backend   string
+	step      string
+	err       error
+	diagnosis string
+}
+
+func (e *preflightError) Error() string {
+	return fmt.Sprintf("%s %s check failed: %v — %s", e.backend, e.step, e.err, e.diagnosis)
+}
+
+func (e *preflightError) Unwrap() error { return e.err }
+
+// preflight checks that the backends can be reached and accept our
+// requests before the run starts, so a misconfiguration is reported with
+// what to fix instead of surfacing as failed requests mid-run. Each backend
+// is checked step by step: DNS, TCP connect, TLS handshake, then a request
+// whose status shows whether auth was accepted.
+func preflight(ctx context.Context) error {
+	var errs []error
+	if err := preflightBackend(ctx, "chat server", "CHAT_SERVER", cfg.ChatServer, "/list-apps"); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.PromptSource == promptSourceOllama {
+		if err := preflightBackend(ctx, "prompt server", "PROMPT_SERVER", cfg.PromptServer, "/api/tags"); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// preflightBackend runs the preflight steps against one backend, stopping at
+// the first that fails, and logs each step's result.
+func preflightBackend(ctx context.Context, backend, env, server, path string) error {
+	fail := func(step string, err error, diagnosis string) error {
+		pe := &preflightError{backend: backend, step: step, err: err, diagnosis: diagnosis}
+		slog.Log(ctx, slog.LevelError, "Preflight check failed", "backend", backend, "step", step, "error", err, "diagnosis", diagnosis)
+		return pe
+	}
+	pass := func(step string, start time.Time, args ...any) {
+		slog.Log(ctx, slog.LevelInfo, "Preflight check passed", append([]any{"backend", backend, "step", step, "duration", time.Since(start)}, args...)...)
+	}
+
+	u, err := url.Parse(server)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		if err == nil {
+			err = fmt.Errorf("%q is not an http or https URL", server)
+		}
+		return fail("url", err, fmt.Sprintf("set %s to the server's base URL, e.g. http://localhost:8000", env))
+	}
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	start := time.Now()
+	dnsCtx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	addrs, err := net.DefaultResolver.LookupHost(dnsCtx, host)
+	cancel()
+	if err != nil {
+		return fail("dns", err, fmt.Sprintf("%s could not be resolved; check the host name in %s and that this machine's DNS can see it", host, env))
+	}
+	pass("dns", start, "addresses", addrs)
+
+	start = time.Now()
+	addr := net.JoinHostPort(host, port)
+	conn, err := (&net.Dialer{Timeout: preflightTimeout}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fail("tcp", err, diagnoseDial(addr, err))
+	}
+	pass("tcp", start, "address", conn.RemoteAddr().String())
+
+	if u.Scheme == "https" {
+		start = time.Now()
+		tlsCfg := &tls.Config{ServerName: host}
+		if transport.TLSClientConfig != nil {
+			tlsCfg = transport.TLSClientConfig.Clone()
+			tlsCfg.ServerName = host
+		}
+		tlsConn := tls.Client(conn, tlsCfg)
+		_ = tlsConn.SetDeadline(time.Now().Add(preflightTimeout))
+		err := tlsConn.HandshakeContext(ctx)
+		tlsConn.Close()
+		if err != nil {
+			return fail("tls", err, diagnoseTLS(host, err))
+		}
+		pass("tls", start, "version", tls.VersionName(tlsConn.ConnectionState().Version))
+	} else {
+		conn.Close()
+	}
+
+	start = time.Now()
+	reqCtx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, server+path, nil)
+	if err != nil {
+		return fail("request", err, fmt.Sprintf("check %s", env))
+	}
+	setAuthUser(req, authUser(ctx))
+	resp, err := chatClient.Do(req)
+	if err != nil {
+		return fail("request", err, "the server accepted a connection but not an HTTP request; check that "+env+" points at the HTTP port and uses the right scheme")
+	}
+	resp.Body.Close()
+	pass("request", start, "status", resp.StatusCode)
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return fail("auth", &statusError{code: resp.StatusCode}, "the server rejected our credentials; check the identities in USER_FILE and any proxy in front of the server that requires auth")
+	case resp.StatusCode >= 500:
+		return fail("auth", &statusError{code: resp.StatusCode}, "the server is reachable but failing; check its logs")
+	}
+	pass("auth", start, "status", resp.StatusCode)
+	return nil
+}
+
+// diagnoseDial explains a failed TCP connect.
+func diagnoseDial(addr string, err error) string {
+	var ne net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return fmt.Sprintf("nothing is listening on %s; check that the server is running and the port is right", addr)
+	case errors.As(err, &ne) && ne.Timeout():
+		return fmt.Sprintf("connecting to %s timed out; a firewall or network policy may be dropping traffic", addr)
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return fmt.Sprintf("%s is unreachable from this network", addr)
+	}
+	return fmt.Sprintf("could not connect to %s", addr)
+}
+
+// diagnoseTLS explains a failed TLS handshake.
+func diagnoseTLS(host string, err error) string {
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		hostnameErr      x509.HostnameError
+		invalidErr       x509.CertificateInvalidError
+		recordErr        tls.RecordHeaderError
+	)
+	switch {
+	case errors.As(err, &unknownAuthority):
+		return "the certificate is signed by an unknown authority; add its CA to the system trust store, or set INSECURE_SKIP_VERIFY=true for test backends"
+	case errors.As(err, &hostnameErr):
+		return fmt.Sprintf("the certificate is not valid for %s; check the host name in the server URL", host)
+	case errors.As(err, &invalidErr) && invalidErr.Reason == x509.Expired:
+		return "the server's certificate has expired or is not yet valid; check the server's certificate and this machine's clock"
+	case errors.As(err, &recordErr):
+		return "the server did not answer with TLS; it may expect http:// rather than https://"
+	}
+	return "the TLS handshake failed; check the server's TLS configuration"
+}
@@ -0,0 +1,239 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	promptSourceOllama = "ollama"
+	promptSourceSeed   = "seed"
+	promptSourceStatic = "static"
+	promptSourceStdin  = "stdin"
+	promptSourceCSV    = "csv"
+
+	// What EMPTY_PROMPT_ACTION and BLOCKED_PROMPT_ACTION do with a prompt
+	// that can't be sent.
+	promptActionSkip       = "skip"
+	promptActionRegenerate = "regenerate"
+
+	// maxPromptAttempts bounds regeneration so a prompt server that only
+	// returns empty output can't stall a worker forever.
+	maxPromptAttempts = 3
+)
+
+// nextPrompt asks the prompt source for the next user question in conv.
+// Empty or whitespace-only output and prompts matching a blocked pattern are
+// counted and, depending on cfg.EmptyPromptAction or cfg.BlockedPromptAction,
+// either regenerated or skipped. An empty result means the iteration should
+// not send a chat request. The returned tags describe how the prompt was
+// produced and are meant for the chat request.
+func nextPrompt(ctx context.Context, conv *conversation) (string, []tag, error) {
+	for attempt := 1; ; attempt++ {
+		prompt, tags, err := sourceFor(ctx).generate(ctx, conv)
+		if err != nil {
+			return "", nil, err
+		}
+
+		var problem, action string
+		if strings.TrimSpace(prompt) == "" {
+			stats.recordEmptyPrompt()
+			problem, action = "Prompt server returned an empty prompt", cfg.EmptyPromptAction
+		} else if pattern := blockedPattern(prompt); pattern != "" {
+			stats.recordBlockedPrompt()
+			problem, action = "Prompt matched a blocked pattern", cfg.BlockedPromptAction
+			slog.Log(ctx, slog.LevelDebug, "Blocked prompt", "pattern", pattern, "prompt", prompt)
+		} else {
+			stats.recordPromptLength(prompt)
+			return prompt, tags, nil
+		}
+
+		if action != promptActionRegenerate || attempt >= maxPromptAttempts {
+			slog.Log(ctx, slog.LevelWarn, problem+", skipping chat request", "attempt", attempt)
+			return "", nil, nil
+		}
+		slog.Log(ctx, slog.LevelWarn, problem+", regenerating", "attempt", attempt)
+	}
+}
+
+// stripPrompts is compiled from cfg.PromptStripPatterns.
+var stripPrompts []*regexp.Regexp
+
+// codeFence matches a prompt wrapped in a markdown code fence, with an
+// optional language.
+var codeFence = regexp.MustCompile("(?s)^```[a-zA-Z]*\\s*(.*?)\\s*```$")
+
+// cleanPrompt strips the wrappers models put around the question they were
+// asked for: a code fence, preambles such as "Here's a question:" matching
+// stripPrompts, and surrounding quotes or bold markers.
+func cleanPrompt(prompt string) string {
+	p := strings.TrimSpace(prompt)
+	if m := codeFence.FindStringSubmatch(p); m != nil {
+		p = m[1]
+	}
+	for _, re := range stripPrompts {
+		p = strings.TrimSpace(re.ReplaceAllString(p, ""))
+	}
+	for _, wrap := range [][2]string{{"**", "**"}, {`"`, `"`}, {"\u201c", "\u201d"}} {
+		open, close := wrap[0], wrap[1]
+		if len(p) > len(open)+len(close) && strings.HasPrefix(p, open) && strings.HasSuffix(p, close) {
+			p = strings.TrimSpace(p[len(open) : len(p)-len(close)])
+		}
+	}
+	return p
+}
+
+// blockedPrompts is compiled from cfg.BlockedPromptPatterns.
+var blockedPrompts []*regexp.Regexp
+
+// blockedPattern returns the first blocked pattern prompt matches, or "".
+func blockedPattern(prompt string) string {
+	for _, re := range blockedPrompts {
+		if re.MatchString(prompt) {
+			return re.String()
+		}
+	}
+	return ""
+}
+
+// promptSource produces the user questions sent to the chat server, with
+// any tags describing how each was produced.
+type promptSource interface {
+	generate(ctx context.Context, conv *conversation) (string, []tag, error)
+}
+
+// prompts is the source selected by cfg.PromptSource.
+var prompts promptSource = ollamaSource{}
+
+// ollamaSource asks a model on the prompt server to role-play the user. The
+// model is picked by weight from cfg.PromptModels for every prompt and
+// reported in the prompt_model tag.
+type ollamaSource struct{}
+
+func (ollamaSource) generate(ctx context.Context, conv *conversation) (string, []tag, error) {
+	model := pickPromptModel()
+	if _, err := endpoints.wait(ctx, cfg.PromptServer+"/api/generate"); err != nil {
+		return "", nil, err
+	}
+	prompt, err := generatePrompt(ctx, model, conv.generationPrompt())
+	endpoints.record(cfg.PromptServer+"/api/generate", err)
+	return prompt, []tag{{Key: "prompt_model", Value: model}}, err
+}
+
+// promptModels is parsed from cfg.PromptModels.
+var promptModels = []weighted{{name: defaultPromptModel, weight: 1}}
+
+// pickPromptModel picks a model from promptModels by weight.
+func pickPromptModel() string {
+	return promptModels[pickWeighted(promptModels)].name
+}
+
+// listSource picks a random prompt from a fixed list. Conversation history
+// is ignored.
+type listSource struct {
+	prompts []string
+}
+
+func (l listSource) generate(context.Context, *conversation) (string, []tag, error) {
+	return l.prompts[rng.Intn(len(l.prompts))], nil, nil
+}
+
+// staticPrompts is used by the static source, which needs no prompt server.
+var staticPrompts = []string{
+	"Can you recommend a funny movie from the last ten years?",
+	"What are some good horror movies released after 2010?",
+	"I'm looking for an animated movie my kids would enjoy. Any ideas?",
+	"Which fantasy adventure movies came out around 2005?",
+	"Show me some short thrillers, under 100 minutes if possible.",
+	"Who directed the best comedies of the 2010s?",
+	"Can you suggest movies similar to a light-hearted family adventure?",
+	"What cartoon movies from 2015 onwards have great reviews?",
+}
+
+// newPromptSource builds the source selected by cfg.PromptSource.
+func newPromptSource() (promptSource, error) {
+	switch cfg.PromptSource {
+	case promptSourceSeed:
+		seeds, err := readSeedFile(cfg.SeedFile)
+		if err != nil {
+			return nil, err
+		}
+		slog.Log(context.Background(), slog.LevelInfo, "Loaded seed prompts", "file", cfg.SeedFile, "prompts", len(seeds))
+		return listSource{prompts: seeds}, nil
+	case promptSourceStatic:
+		return listSource{prompts: staticPrompts}, nil
+	case promptSourceCSV:
+		src, err := newCSVSource(cfg.CSVFile, cfg.PromptTemplate)
+		if err != nil {
+			return nil, err
+		}
+		slog.Log(context.Background(), slog.LevelInfo, "Loaded CSV prompt data", "file", cfg.CSVFile, "columns", src.columns, "rows", len(src.rows))
+		return src, nil
+	default:
+		return ollamaSource{}, nil
+	}
+}
+
+// fallbackPrompts is loaded from cfg.FallbackPrompt.
+var fallbackPrompts []string
+
+// loadFallbackPrompts parses FALLBACK_PROMPT: a prompt, or "@path" for a
+// file of them, one per line.
+func loadFallbackPrompts(spec string) ([]string, error) {
+	if path, ok := strings.CutPrefix(spec, "@"); ok {
+		return readSeedFile(path)
+	}
+	return []string{spec}, nil
+}
+
+// fallbackPrompt picks a prompt to send in place of one the prompt source
+// failed to produce, tagged prompt_fallback=prompt_error.
+func fallbackPrompt() (string, []tag) {
+	return fallbackPrompts[rng.Intn(len(fallbackPrompts))], []tag{{Key: "prompt_fallback", Value: "prompt_error"}}
+}
+
+// readSeedFile reads one prompt per line, skipping blank lines and lines
+// starting with '#'.
+func readSeedFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var seeds []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		seeds = append(seeds, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(seeds) == 0 {
+		return nil, fmt.Errorf("seed file %s has no prompts", path)
+	}
+	return seeds, nil
+}
@@ -0,0 +1,42 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "testing"
+
+func TestCleanPrompt(t *testing.T) {
+	t.Setenv("PROMPT_SERVER", "http://localhost:11434")
+	t.Setenv("CHAT_SERVER", "http://localhost:8000")
+	if err := loadConfig(); err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+	for _, tc := range []struct {
+		prompt, want string
+	}{
+		{prompt: "Sure, what's a good comedy?", want: "what's a good comedy?"},
+		{prompt: "SURE! Any thrillers?", want: "Any thrillers?"},
+		{prompt: "okay. Something from the 90s?", want: "Something from the 90s?"},
+		{prompt: "Ok: any westerns?", want: "any westerns?"},
+		{prompt: "Certainly; what about dramas?", want: "what about dramas?"},
+		{prompt: "Sure — \"Any sci-fi?\"", want: "Any sci-fi?"},
+		{prompt: "ok computer-style movies?", want: "ok computer-style movies?"},
+		{prompt: "Okay so what about horror?", want: "Okay so what about horror?"},
+		{prompt: "Surely you know a good musical?", want: "Surely you know a good musical?"},
+	} {
+		if got := cleanPrompt(tc.prompt); got != tc.want {
+			t.Errorf("cleanPrompt(%q) = %q, want %q", tc.prompt, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// maxPromptBatchSize bounds PROMPT_BATCH_SIZE; small models lose track of
+// longer lists.
+const maxPromptBatchSize = 50
+
+// batchInstruction is appended to the persona prompt to ask for a batch of
+// opening questions at once.
+const batchInstruction = `
+
+Instead of a single question, write %d different opening questions this person might ask, each phrased as they would ask it. Reply with only a JSON array of %d strings and nothing else.`
+
+// batchSource asks the prompt server for several opening prompts per
+// generation call and hands them out one at a time, so chat throughput
+// isn't bound by the prompt server's round-trip time. Each conversation
+// adopts the persona its prompt was generated for. Follow-up prompts depend
+// on the replies so far and are still generated one at a time by inner.
+type batchSource struct {
+	inner promptSource
+	size  int
+
+	mu      sync.Mutex
+	pending []bufferedPrompt
+}
+
+func newBatchSource(inner promptSource, size int) *batchSource {
+	return &batchSource{inner: inner, size: size}
+}
+
+func (b *batchSource) generate(ctx context.Context, conv *conversation) (string, []tag, error) {
+	if len(conv.turns) > 0 {
+		return b.inner.generate(ctx, conv)
+	}
+
+	// Callers queue behind a batch being generated rather than each
+	// generating their own.
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.pending) == 0 {
+		batch, err := generateBatch(ctx, b.size)
+		if err != nil {
+			return "", nil, err
+		}
+		b.pending = batch
+	}
+	p := b.pending[0]
+	b.pending = b.pending[1:]
+	conv.persona = p.persona
+	return p.text, p.tags, nil
+}
+
+// generateBatch asks the prompt server for n opening prompts for a new
+// persona.
+func generateBatch(ctx context.Context, n int) ([]bufferedPrompt, error) {
+	conv := newConversation()
+	model := pickPromptModel()
+	if _, err := endpoints.wait(ctx, cfg.PromptServer+"/api/generate"); err != nil {
+		return nil, err
+	}
+	text, err := generatePrompt(ctx, model, conv.generationPrompt()+fmt.Sprintf(batchInstruction, n, n))
+	endpoints.record(cfg.PromptServer+"/api/generate", err)
+	if err != nil {
+		return nil, err
+	}
+
+	prompts, malformed := parsePromptBatch(text)
+	if malformed > 0 {
+		slog.Log(ctx, slog.LevelWarn, "Skipped malformed prompts in batch", "malformed", malformed, "prompts", len(prompts))
+	}
+	if len(prompts) == 0 {
+		return nil, fmt.Errorf("prompt server returned no usable prompts in a batch of %d", n)
+	}
+	slog.Log(ctx, slog.LevelDebug, "Generated prompt batch", "prompts", len(prompts), "requested", n)
+
+	tags := []tag{{Key: "prompt_model", Value: model}}
+	batch := make([]bufferedPrompt, len(prompts))
+	for i, p := range prompts {
+		batch[i] = bufferedPrompt{persona: conv.persona, text: p, tags: tags}
+	}
+	return batch, nil
+}
+
+// quotedString matches a JSON string literal.
+var quotedString = regexp.MustCompile(`"(?:[^"\\]|\\.)*"`)
+
+// listMarker matches a numbered or bulleted list item's marker.
+var listMarker = regexp.MustCompile(`^\s*(?:\d+[.)]|[-*•])\s+`)
+
+// parsePromptBatch extracts the prompts from a model's reply to
+// batchInstruction. The reply should be a JSON array of strings, but models
+// wrap it in prose, put objects in it or answer with a plain list instead,
+// or cut it short, so it takes the outermost [...] in the reply, accepts
+// strings and objects with a "question" or "prompt" field, and when the
+// array doesn't parse falls back to the string literals after its opening
+// bracket, or failing that to one prompt per line. It returns the prompts
+// and the number of items skipped.
+func parsePromptBatch(text string) (prompts []string, malformed int) {
+	add := func(p string) {
+		if p = cleanPrompt(p); p != "" {
+			prompts = append(prompts, p)
+		} else {
+			malformed++
+		}
+	}
+
+	var items []json.RawMessage
+	start, end := strings.Index(text, "["), strings.LastIndex(text, "]")
+	if start < 0 || end < start || json.Unmarshal([]byte(text[start:end+1]), &items) != nil {
+		if start >= 0 {
+			for _, lit := range quotedString.FindAllString(text[start:], -1) {
+				var s string
+				if json.Unmarshal([]byte(lit), &s) == nil {
+					add(s)
+				} else {
+					malformed++
+				}
+			}
+			if len(prompts) > 0 {
+				return prompts, malformed
+			}
+		}
+		for _, line := range strings.Split(text, "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || line == "[" || line == "]" || strings.HasPrefix(line, "```") {
+				continue
+			}
+			add(strings.TrimSuffix(listMarker.ReplaceAllString(line, ""), ","))
+		}
+		return prompts, malformed
+	}
+
+	for _, item := range items {
+		var s string
+		if json.Unmarshal(item, &s) == nil {
+			add(s)
+			continue
+		}
+		var obj struct {
+			Question string `json:"question"`
+			Prompt   string `json:"prompt"`
+		}
+		if json.Unmarshal(item, &obj) == nil && (obj.Question != "" || obj.Prompt != "") {
+			add(obj.Question + obj.Prompt)
+			continue
+		}
+		malformed++
+	}
+	return prompts, malformed
+}
@@ -0,0 +1,200 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// errPromptBudgetSpent is returned by generatePrompt once PROMPT_BUDGET is
+// used up.
+var errPromptBudgetSpent = errors.New("PROMPT_BUDGET spent")
+
+// generationBudget caps the prompt server work a run may use, counted in
+// generation requests or in tokens generated, estimated like prompt
+// lengths at four characters per token.
+type generationBudget struct {
+	limit  int64
+	tokens bool
+
+	mu        sync.Mutex
+	used      int64
+	exhausted chan struct{}
+}
+
+// promptBudget is nil when PROMPT_BUDGET isn't set; its methods then allow
+// everything.
+var promptBudget *generationBudget
+
+type unbudgetedKey struct{}
+
+// withoutBudget returns ctx with generation requests made under it not
+// charged to PROMPT_BUDGET, for the warm-up before the run.
+func withoutBudget(ctx context.Context) context.Context {
+	return context.WithValue(ctx, unbudgetedKey{}, true)
+}
+
+// budgeted reports whether generation requests under ctx are charged.
+func budgeted(ctx context.Context) bool {
+	unbudgeted, _ := ctx.Value(unbudgetedKey{}).(bool)
+	return !unbudgeted
+}
+
+// parsePromptBudget parses a budget such as "500" requests or "200000tokens".
+func parsePromptBudget(spec string) (*generationBudget, error) {
+	n, tokens := strings.CutSuffix(strings.TrimSpace(spec), "tokens")
+	limit, err := strconv.ParseInt(strings.TrimSpace(n), 10, 64)
+	if err != nil || limit <= 0 {
+		return nil, fmt.Errorf("%q must be a positive number of requests, or of tokens followed by \"tokens\"", spec)
+	}
+	b := &generationBudget{limit: limit, tokens: tokens, exhausted: make(chan struct{})}
+	promptBudgetLimit.Set(float64(limit))
+	return b, nil
+}
+
+// unit names what the budget counts, for logs.
+func (b *generationBudget) unit() string {
+	if b.tokens {
+		return "tokens"
+	}
+	return "requests"
+}
+
+// reserve is called before a generation request and fails once the budget
+// is spent. A request budget is charged here; a token budget is charged by
+// spend, so the request that crosses it is allowed to finish.
+func (b *generationBudget) reserve(ctx context.Context) error {
+	if b == nil || !budgeted(ctx) {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used >= b.limit {
+		return errPromptBudgetSpent
+	}
+	if !b.tokens {
+		b.charge(ctx, 1)
+	}
+	return nil
+}
+
+// spend charges a token budget for a generated response.
+func (b *generationBudget) spend(ctx context.Context, response string) {
+	if b == nil || !b.tokens || !budgeted(ctx) {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.charge(ctx, int64(math.Ceil(float64(utf8.RuneCountInString(response))/4)))
+}
+
+// charge adds n to the budget used. b.mu must be held.
+func (b *generationBudget) charge(ctx context.Context, n int64) {
+	wasSpent := b.used >= b.limit
+	b.used += n
+	promptBudgetUsed.Set(float64(b.used))
+	if !wasSpent && b.used >= b.limit {
+		close(b.exhausted)
+		slog.Log(ctx, slog.LevelWarn, "PROMPT_BUDGET spent, falling back to cached prompts", "used", b.used, "limit", b.limit, "unit", b.unit())
+	}
+}
+
+// spent reports whether the budget is used up.
+func (b *generationBudget) spent() bool {
+	if b == nil {
+		return false
+	}
+	select {
+	case <-b.exhausted:
+		return true
+	default:
+		return false
+	}
+}
+
+// done returns a channel closed once the budget is spent, or nil, which
+// never is, without a budget.
+func (b *generationBudget) done() <-chan struct{} {
+	if b == nil {
+		return nil
+	}
+	return b.exhausted
+}
+
+// maxCachedPrompts bounds the prompts budgetSource keeps to fall back on.
+const maxCachedPrompts = 1000
+
+// budgetSource keeps the prompts inner generates and, once PROMPT_BUDGET is
+// spent, sends them again instead, or SEED_FILE or the static prompts if
+// none were generated. Prompts sent again are tagged prompt_fallback.
+type budgetSource struct {
+	inner    promptSource
+	fallback []string
+
+	mu     sync.Mutex
+	cached []string
+	next   int
+}
+
+func newBudgetSource(inner promptSource) (*budgetSource, error) {
+	b := &budgetSource{inner: inner, fallback: staticPrompts}
+	if cfg.SeedFile != "" {
+		seeds, err := readSeedFile(cfg.SeedFile)
+		if err != nil {
+			return nil, err
+		}
+		b.fallback = seeds
+	}
+	return b, nil
+}
+
+func (b *budgetSource) generate(ctx context.Context, conv *conversation) (string, []tag, error) {
+	if !promptBudget.spent() {
+		prompt, tags, err := b.inner.generate(ctx, conv)
+		if !errors.Is(err, errPromptBudgetSpent) {
+			if err == nil && strings.TrimSpace(prompt) != "" {
+				b.remember(prompt)
+			}
+			return prompt, tags, err
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.cached) > 0 {
+		return b.cached[rng.Intn(len(b.cached))], []tag{{Key: "prompt_fallback", Value: "cached"}}, nil
+	}
+	return b.fallback[rng.Intn(len(b.fallback))], []tag{{Key: "prompt_fallback", Value: "seed"}}, nil
+}
+
+// remember adds prompt to the cache, replacing the oldest once it's full.
+func (b *budgetSource) remember(prompt string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.cached) < maxCachedPrompts {
+		b.cached = append(b.cached, prompt)
+		return
+	}
+	b.cached[b.next] = prompt
+	b.next = (b.next + 1) % maxCachedPrompts
+}
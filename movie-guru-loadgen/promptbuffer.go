@@ -0,0 +1,88 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// bufferedPrompt is a prompt generated ahead of time for a new
+// conversation with persona.
+type bufferedPrompt struct {
+	persona string
+	text    string
+	tags    []tag
+}
+
+// bufferedSource decouples prompt generation from chat dispatch: a pool of
+// generators keeps a buffer of prompts for new conversations filled so that
+// virtual users don't wait on a slow prompt server. Follow-up prompts depend
+// on the replies so far and are still generated on demand.
+type bufferedSource struct {
+	inner promptSource
+	ready chan bufferedPrompt
+}
+
+// newBufferedSource starts generators goroutines that fill a buffer of size
+// prompts from inner until ctx is done.
+func newBufferedSource(ctx context.Context, inner promptSource, size, generators int) *bufferedSource {
+	b := &bufferedSource{inner: inner, ready: make(chan bufferedPrompt, size)}
+	for range generators {
+		go b.fill(ctx)
+	}
+	return b
+}
+
+func (b *bufferedSource) fill(ctx context.Context) {
+	for ctx.Err() == nil {
+		conv := newConversation()
+		text, tags, err := b.inner.generate(ctx, conv)
+		if errors.Is(err, errPromptBudgetSpent) {
+			return
+		}
+		if err != nil {
+			stats.recordPromptError()
+			slog.Log(ctx, slog.LevelError, "Error generating prompt", "error", err)
+			_ = sleep(ctx, 1*time.Second)
+			continue
+		}
+		select {
+		case b.ready <- bufferedPrompt{persona: conv.persona, text: text, tags: tags}:
+			promptBufferFill.Set(float64(len(b.ready)))
+		case <-ctx.Done():
+		}
+	}
+}
+
+// generate takes a ready prompt for a new conversation, which adopts the
+// persona it was generated for.
+func (b *bufferedSource) generate(ctx context.Context, conv *conversation) (string, []tag, error) {
+	if len(conv.turns) > 0 {
+		return b.inner.generate(ctx, conv)
+	}
+	select {
+	case p := <-b.ready:
+		promptBufferFill.Set(float64(len(b.ready)))
+		conv.persona = p.persona
+		return p.text, p.tags, nil
+	case <-promptBudget.done():
+		return "", nil, errPromptBudgetSpent
+	case <-ctx.Done():
+		return "", nil, ctx.Err()
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clientSendTimeHeader carries the time a chat request was sent, with
+// CLIENT_SEND_TIME, as Unix seconds with microseconds.
+const clientSendTimeHeader = "X-Client-Send-Time"
+
+// setSendTime adds the clientSendTimeHeader to req when CLIENT_SEND_TIME is
+// set.
+func setSendTime(req *http.Request, sent time.Time) {
+	if cfg.ClientSendTime {
+		req.Header.Set(clientSendTimeHeader, strconv.FormatFloat(float64(sent.UnixMicro())/1e6, 'f', 6, 64))
+	}
+}
+
+// receiveDelay returns how long after sent the backend says, in
+// cfg.ServerReceiveTimeHeader, it received the request or started on it.
+// That is network and queueing delay in front of the server's processing,
+// plus any clock skew between the hosts. It returns false when there's no
+// such header, it can't be parsed, or it's before sent, which only clock
+// skew explains.
+func receiveDelay(ctx context.Context, resp *http.Response, sent time.Time) (time.Duration, bool) {
+	if cfg.ServerReceiveTimeHeader == "" {
+		return 0, false
+	}
+	v := resp.Header.Get(cfg.ServerReceiveTimeHeader)
+	if v == "" {
+		return 0, false
+	}
+	received, ok := parseTimestamp(v)
+	if !ok {
+		slog.Log(ctx, slog.LevelDebug, "Unparseable server receive time", "header", cfg.ServerReceiveTimeHeader, "value", v)
+		return 0, false
+	}
+	d := received.Sub(sent)
+	if d < 0 {
+		slog.Log(ctx, slog.LevelDebug, "Server receive time is before the request was sent, are the clocks in sync?", "ahead_by", -d)
+		return 0, false
+	}
+	return d, true
+}
+
+// parseTimestamp parses an RFC 3339 time, or a Unix time in seconds,
+// milliseconds or microseconds told apart by magnitude. A "t=" prefix, as
+// in the X-Request-Start header some proxies add, is ignored.
+func parseTimestamp(v string) (time.Time, bool) {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "t=")
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t, true
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f <= 0 {
+		return time.Time{}, false
+	}
+	switch {
+	case f >= 1e14:
+		return time.UnixMicro(int64(f)), true
+	case f >= 1e11:
+		return time.UnixMicro(int64(f * 1e3)), true
+	default:
+		return time.UnixMicro(int64(f * 1e6)), true
+	}
+}
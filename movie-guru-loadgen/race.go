@@ -0,0 +1,160 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// Kinds of damage a session race can do to the session's events.
+const (
+	raceLostMessage      = "lost_message"      // fewer copies of the message stored than were answered
+	raceDuplicateMessage = "duplicate_message" // more copies stored than were sent
+	raceInterleaved      = "interleaved"       // a copy stored before the previous one was answered
+	raceMissingReply     = "missing_reply"     // fewer replies stored than were answered
+	raceEmptyReply       = "empty_reply"       // a successful response with no reply text
+	raceHistoryLost      = "history_lost"      // events from before the race disappeared
+)
+
+// pickRace decides whether a turn is sent as a session race, for a
+// cfg.SessionRaceFraction share of them.
+func pickRace() bool {
+	return cfg.SessionRaceFraction > 0 && rng.Float64() < cfg.SessionRaceFraction
+}
+
+// raceResult is the outcome of one request in a session race.
+type raceResult struct {
+	res chatResponse
+	err error
+}
+
+// raceTurns sends parts as cfg.SessionRaceTurns overlapping requests on
+// sess, to probe whether the backend serializes concurrent turns on a
+// session, rejects them or corrupts its state, and then checks the session's
+// events for the damage. Config validation makes sure sess is the virtual
+// user's own, so the race's requests are the only ones on it. The requests
+// ignore ORDERED_TURNS and aren't retried. The caller already has a rate
+// limiter token for the first; the rest wait for theirs before any is sent,
+// so all of them are dispatched together. It returns the first successful response, so the conversation
+// carries on from it, or else the first error.
+func raceTurns(ctx context.Context, sess *session, parts []part, tags ...tag) (chatResponse, error) {
+	before, err := fetchSessionEvents(ctx, sess)
+	if err != nil {
+		slog.Log(ctx, slog.LevelWarn, "Error fetching session events before a session race, not checking it", "session_id", sess.id, "error", err)
+	}
+	for range cfg.SessionRaceTurns - 1 {
+		if err := waitLimits(ctx, sess.app); err != nil {
+			return chatResponse{}, err
+		}
+	}
+
+	tags = append(tags, tag{Key: "session_race", Value: "true"})
+	results := make([]raceResult, cfg.SessionRaceTurns)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := requestMovieRecommendations(ctx, parts, sess, false)
+			stats.recordChat(res.Latency, err, tags...)
+			if contentionError(err) {
+				stats.recordContention()
+			}
+			results[i] = raceResult{res: res, err: err}
+		}()
+	}
+	wg.Wait()
+
+	var answered, rejected, failed, first int
+	for i, r := range results {
+		switch {
+		case r.err == nil:
+			answered++
+			if results[first].err != nil {
+				first = i
+			}
+		case contentionError(r.err):
+			rejected++
+		default:
+			failed++
+		}
+	}
+
+	var kinds []string
+	for _, r := range results {
+		if r.err == nil && strings.TrimSpace(r.res.Reply) == "" {
+			kinds = append(kinds, raceEmptyReply)
+			break
+		}
+	}
+	if before != nil {
+		after, err := fetchSessionEvents(ctx, sess)
+		if err != nil {
+			slog.Log(ctx, slog.LevelWarn, "Error fetching session events after a session race", "session_id", sess.id, "error", err)
+		} else {
+			kinds = append(kinds, raceDamage(before, after, messageText(parts), answered)...)
+		}
+	}
+	stats.recordRace(kinds)
+	level := slog.LevelDebug
+	if len(kinds) > 0 {
+		level = slog.LevelError
+	}
+	slog.Log(ctx, level, "Session race finished", "session_id", sess.id, "turns", len(results), "answered", answered, "rejected", rejected, "failed", failed, "anomalies", kinds)
+	return results[first].res, results[first].err
+}
+
+// raceDamage compares a session's events before and after a race of
+// requests sending the message want, answered of which succeeded, and
+// returns the kinds of damage found.
+func raceDamage(before, after []adkEvent, want string, answered int) []string {
+	if len(after) < len(before) {
+		return []string{raceHistoryLost}
+	}
+	var kinds []string
+	var stored, replies int
+	pending, interleaved := false, false
+	for _, ev := range after[len(before):] {
+		c := ev.Content
+		if c == nil {
+			continue
+		}
+		switch {
+		case c.Role == "user" && messageText(c.Parts) == want:
+			stored++
+			interleaved = interleaved || pending
+			pending = true
+		case c.Role == "model" && strings.TrimSpace(messageText(c.Parts)) != "":
+			replies++
+			pending = false
+		}
+	}
+	if stored < answered {
+		kinds = append(kinds, raceLostMessage)
+	}
+	if stored > cfg.SessionRaceTurns {
+		kinds = append(kinds, raceDuplicateMessage)
+	}
+	if interleaved {
+		kinds = append(kinds, raceInterleaved)
+	}
+	if replies < answered {
+		kinds = append(kinds, raceMissingReply)
+	}
+	return kinds
+}
@@ -0,0 +1,113 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// lockedRand is a math/rand source that is safe for concurrent use. All
+// random choices go through rng so a run can be reproduced from its seed.
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+var rng = newLockedRand(1)
+
+func newLockedRand(seed int64) *lockedRand {
+	return &lockedRand{r: rand.New(rand.NewSource(seed))}
+}
+
+func (l *lockedRand) Intn(n int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Intn(n)
+}
+
+func (l *lockedRand) Float64() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Float64()
+}
+
+func (l *lockedRand) ExpFloat64() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.ExpFloat64()
+}
+
+func (l *lockedRand) Shuffle(n int, swap func(i, j int)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.r.Shuffle(n, swap)
+}
+
+func (l *lockedRand) NormFloat64() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.NormFloat64()
+}
+
+// weighted is a name, such as a model or app name, and its selection
+// weight.
+type weighted struct {
+	name   string
+	weight int
+}
+
+// parseWeighted parses a list such as "gemma3:4b=3,llama3.2:3b=1". The
+// weight is optional and defaults to 1.
+func parseWeighted(spec []string) ([]weighted, error) {
+	var items []weighted
+	for _, item := range spec {
+		name, w, hasWeight := strings.Cut(item, "=")
+		it := weighted{name: strings.TrimSpace(name), weight: 1}
+		if hasWeight {
+			var err error
+			if it.weight, err = strconv.Atoi(strings.TrimSpace(w)); err != nil || it.weight < 1 {
+				return nil, fmt.Errorf("invalid weight %q for %s", w, it.name)
+			}
+		}
+		if it.name == "" {
+			return nil, fmt.Errorf("empty name in %q", item)
+		}
+		items = append(items, it)
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("no names given")
+	}
+	return items, nil
+}
+
+// pickWeighted returns the index of an item picked from items by weight.
+func pickWeighted(items []weighted) int {
+	total := 0
+	for _, it := range items {
+		total += it.weight
+	}
+	n := rng.Intn(total)
+	for i, it := range items {
+		if n < it.weight {
+			return i
+		}
+		n -= it.weight
+	}
+	return len(items) - 1
+}
@@ -0,0 +1,133 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimiter caps the chat request rate. A single rate.Limiter serializes
+// every virtual user on its mutex, which becomes a contention point at very
+// high virtual user counts, so the rate can instead be split evenly across
+// shards, each serving the virtual users whose number falls into it. The
+// shards add up to the overall limit, but a shard whose users are idle can't
+// lend its share to the others, so sharding only suits many busy users.
+type rateLimiter struct {
+	shards []*rate.Limiter
+
+	mu    sync.Mutex
+	limit rate.Limit
+}
+
+func newRateLimiter(shards int, l rate.Limit) *rateLimiter {
+	r := &rateLimiter{shards: make([]*rate.Limiter, shards)}
+	for i := range r.shards {
+		r.shards[i] = rate.NewLimiter(0, 1)
+	}
+	r.SetLimit(l)
+	return r
+}
+
+// Wait blocks until the shard of the virtual user in ctx allows a request
+// or ctx is done.
+func (r *rateLimiter) Wait(ctx context.Context) error {
+	return r.shards[vuNumber(ctx)%len(r.shards)].Wait(ctx)
+}
+
+// Limit returns the overall limit.
+func (r *rateLimiter) Limit() rate.Limit {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.limit
+}
+
+// SetLimit changes the overall limit, splitting it evenly between shards.
+func (r *rateLimiter) SetLimit(l rate.Limit) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.limit = l
+	share := l
+	if l != rate.Inf {
+		share = l / rate.Limit(len(r.shards))
+	}
+	for _, s := range r.shards {
+		s.SetLimit(share)
+	}
+}
+
+type userLimiterKey struct{}
+
+// withUserLimiter returns a context for a virtual user with its own
+// PER_USER_RATE limiter, shared by its conversations.
+func withUserLimiter(ctx context.Context) context.Context {
+	return context.WithValue(ctx, userLimiterKey{}, rate.NewLimiter(rate.Limit(cfg.PerUserRate/60), 1))
+}
+
+// appLimiters cap the request rate of individual apps, from
+// cfg.AppRateLimits, on top of the overall limiter.
+var appLimiters map[string]*rate.Limiter
+
+// parseAppRateLimits parses a list such as "trivia=1,app=30" into a limiter
+// per app, allowing that many requests per minute. Every app must be one of
+// apps.
+func parseAppRateLimits(spec []string) (map[string]*rate.Limiter, error) {
+	limiters := make(map[string]*rate.Limiter)
+	for _, item := range spec {
+		app, rpm, ok := strings.Cut(item, "=")
+		app = strings.TrimSpace(app)
+		if !ok || app == "" {
+			return nil, fmt.Errorf("%q must look like app=requests_per_minute", item)
+		}
+		if !slices.ContainsFunc(apps, func(w weighted) bool { return w.name == app }) {
+			return nil, fmt.Errorf("app %q is not in APP_NAME", app)
+		}
+		r, err := strconv.ParseFloat(strings.TrimSpace(rpm), 64)
+		if err != nil || r <= 0 {
+			return nil, fmt.Errorf("rate for app %q must be a positive number of requests per minute, got %q", app, rpm)
+		}
+		limiters[app] = rate.NewLimiter(rate.Limit(r/60), 1)
+		appRateLimitRPM.WithLabelValues(app).Set(r)
+	}
+	return limiters, nil
+}
+
+// waitLimits blocks until app's limiter, if it has one, the virtual user's
+// own limiter, with PER_USER_RATE, and then the overall limiter allow a
+// request, or ctx is done. The app's limiter comes first so a throttled app
+// doesn't hold overall tokens other apps could use.
+func waitLimits(ctx context.Context, app string) error {
+	if l := appLimiters[app]; l != nil {
+		if err := l.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	if l, _ := ctx.Value(userLimiterKey{}).(*rate.Limiter); l != nil {
+		if err := l.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	if err := limiter.Wait(ctx); err != nil {
+		return err
+	}
+	appDispatched.WithLabelValues(app).Inc()
+	return nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/time/rate"
+)
+
+func TestRateLimiterSplitsLimit(t *testing.T) {
+	r := newRateLimiter(4, 100)
+	if got := r.Limit(); got != 100 {
+		t.Errorf("Limit() = %v, want 100", got)
+	}
+	for i, s := range r.shards {
+		if got := s.Limit(); got != 25 {
+			t.Errorf("shard %d limit = %v, want 25", i, got)
+		}
+	}
+
+	r.SetLimit(rate.Inf)
+	for i, s := range r.shards {
+		if got := s.Limit(); got != rate.Inf {
+			t.Errorf("shard %d limit = %v, want Inf", i, got)
+		}
+	}
+}
+
+// BenchmarkRateLimiter compares Wait on a single limiter with a sharded one
+// when many virtual users wait at once. The limit is high enough never to
+// throttle, so the benchmark measures contention.
+func BenchmarkRateLimiter(b *testing.B) {
+	for _, shards := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			r := newRateLimiter(shards, 1e12)
+			var next atomic.Int64
+			b.SetParallelism(64)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				ctx := withVU(context.Background(), int(next.Add(1)))
+				for pb.Next() {
+					if err := r.Wait(ctx); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"time"
+)
+
+// watchRate compares the chat request rate achieved over every window with
+// the rate limit until ctx is done. Once it falls below ratio of the limit,
+// something other than the limiter, such as prompt generation, too few
+// virtual users or long think times, is holding load back, and a warning is
+// logged. Another is logged when the rate recovers. Windows during which
+// load was paused, the limit is unlimited, or the limit changed, as during
+// a RATE_RAMP, aren't judged.
+func watchRate(ctx context.Context, window time.Duration, ratio float64) {
+	t := time.NewTicker(window)
+	defer t.Stop()
+	prev := stats.totals()
+	prevLimit, prevPaused := limiterRPM(), gate.isPaused()
+	short := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			cur := stats.totals()
+			limit, paused := limiterRPM(), gate.isPaused()
+			judged := limit > 0 && limit == prevLimit && !paused && !prevPaused
+			if judged {
+				achieved := float64(cur.requests-prev.requests) / window.Minutes()
+				wait := cur.limiterWait.since(prev.limiterWait).summary(1000)
+				args := []any{
+					"achieved_rpm", math.Round(achieved*10) / 10,
+					"target_rpm", limit,
+					"window", window,
+					"limiter_wait_p50_ms", math.Round(wait.P50*10) / 10,
+					"virtual_users", readGauge(virtualUsers),
+				}
+				switch {
+				case achieved < ratio*limit && !short:
+					short = true
+					slog.Log(ctx, slog.LevelWarn, "Achieved request rate is well below the rate limit; the loadgen or prompt server is the bottleneck, not the limiter. Add virtual users, shorten think times or speed up prompt generation", args...)
+				case achieved >= ratio*limit && short:
+					short = false
+					slog.Log(ctx, slog.LevelInfo, "Achieved request rate recovered", args...)
+				}
+			}
+			prev, prevLimit, prevPaused = cur, limit, paused
+		}
+	}
+}
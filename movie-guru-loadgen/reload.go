@@ -0,0 +1,262 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// reloadSignals receives SIGHUP from the start of main, so one sent while
+// the loadgen is starting up doesn't kill it but is queued until
+// watchReload applies it.
+var reloadSignals = make(chan os.Signal, 1)
+
+// configFileValues is what CONFIG_FILE held when it was last applied,
+// except for settings a reload couldn't apply.
+var configFileValues map[string]string
+
+// readConfigFile reads a file of KEY=VALUE lines named like the environment
+// variables. Blank lines and lines starting with # are skipped, and a value
+// may be quoted.
+func readConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("line %d: %q must look like KEY=VALUE", n, line)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		values[key] = value
+	}
+	return values, scanner.Err()
+}
+
+// applyConfigFile sets the environment variables in the CONFIG_FILE at
+// path, if any, over those already set, before the config is loaded.
+func applyConfigFile(path string) error {
+	if path == "" {
+		return nil
+	}
+	values, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	for key, value := range values {
+		os.Setenv(key, value)
+	}
+	configFileValues = values
+	return nil
+}
+
+// thinkSettings is MIN_THINK_TIME and THINK_TIME as changed by a reload.
+type thinkSettings struct {
+	min  time.Duration
+	dist sampler
+	spec string // dist as configured
+}
+
+// Settings changed by a reload, nil or 0 until then. They are read by
+// running virtual users and the throughput controller, so unlike cfg they
+// are swapped atomically.
+var (
+	reloadedThink     atomic.Pointer[thinkSettings]
+	reloadedTargetRPS atomic.Uint64 // math.Float64bits
+)
+
+// sampleThinkTime returns how long a virtual user waits after a response
+// before sending again: a think time, at least the minimum think time.
+func sampleThinkTime() time.Duration {
+	t := currentThink()
+	return max(t.min, t.dist.sample())
+}
+
+func currentThink() thinkSettings {
+	if t := reloadedThink.Load(); t != nil {
+		return *t
+	}
+	return thinkSettings{min: cfg.MinThinkTime, dist: thinkTime, spec: cfg.ThinkTime}
+}
+
+// targetRPS returns TARGET_RPS, as changed by the latest reload.
+func targetRPS() float64 {
+	if bits := reloadedTargetRPS.Load(); bits != 0 {
+		return math.Float64frombits(bits)
+	}
+	return cfg.TargetRPS
+}
+
+// hotSetting applies a reloaded value for a setting that can change while
+// the run is going. It returns the value it replaced.
+type hotSetting func(pool *workerPool, value string) (previous string, err error)
+
+// hotSettings are the settings a reload applies. Changes to any other
+// setting are ignored until the loadgen is restarted.
+var hotSettings = map[string]hotSetting{
+	"RATE_LIMIT": func(_ *workerPool, value string) (string, error) {
+		rpm, err := strconv.ParseFloat(value, 64)
+		switch {
+		case err != nil:
+			return "", err
+		case rpm <= 0 || math.IsInf(rpm, 0):
+			return "", fmt.Errorf("must be a positive number, got %v", rpm)
+		case cfg.TargetRPS > 0 || cfg.PerUserRate > 0:
+			return "", fmt.Errorf("the global rate limit isn't used with TARGET_RPS or PER_USER_RATE")
+		}
+		previous := limiterRPM()
+		setLimit(rate.Limit(rpm / 60.0))
+		return strconv.FormatFloat(previous, 'f', -1, 64), nil
+	},
+	"MIN_THINK_TIME": func(_ *workerPool, value string) (string, error) {
+		d, err := time.ParseDuration(value)
+		switch {
+		case err != nil:
+			return "", err
+		case d < 0:
+			return "", fmt.Errorf("must not be negative, got %v", d)
+		case cfg.BurstMode:
+			return "", fmt.Errorf("think times are zero with BURST_MODE")
+		}
+		t := currentThink()
+		previous := t.min
+		t.min = d
+		reloadedThink.Store(&t)
+		return previous.String(), nil
+	},
+	"THINK_TIME": func(_ *workerPool, value string) (string, error) {
+		dist, err := parseSampler(value)
+		switch {
+		case err != nil:
+			return "", err
+		case cfg.BurstMode:
+			return "", fmt.Errorf("think times are zero with BURST_MODE")
+		}
+		t := currentThink()
+		previous := t.spec
+		t.dist, t.spec = dist, value
+		reloadedThink.Store(&t)
+		return previous, nil
+	},
+	"VIRTUAL_USERS": func(pool *workerPool, value string) (string, error) {
+		n, err := strconv.Atoi(value)
+		switch {
+		case err != nil:
+			return "", err
+		case n < 1:
+			return "", fmt.Errorf("must be at least 1, got %d", n)
+		case cfg.TargetRPS > 0:
+			return "", fmt.Errorf("virtual users are managed by the throughput controller with TARGET_RPS")
+		}
+		previous := pool.size()
+		pool.resize(n)
+		return strconv.Itoa(previous), nil
+	},
+	"TARGET_RPS": func(_ *workerPool, value string) (string, error) {
+		rps, err := strconv.ParseFloat(value, 64)
+		switch {
+		case err != nil:
+			return "", err
+		case rps <= 0 || math.IsInf(rps, 0):
+			return "", fmt.Errorf("must be a positive number, got %v", rps)
+		case cfg.TargetRPS == 0:
+			return "", fmt.Errorf("closed-loop mode can't be switched on during a run")
+		}
+		previous := targetRPS()
+		reloadedTargetRPS.Store(math.Float64bits(rps))
+		return strconv.FormatFloat(previous, 'f', -1, 64), nil
+	},
+}
+
+// watchReload reloads CONFIG_FILE whenever the loadgen receives SIGHUP,
+// until ctx is done, starting with one received during startup.
+func watchReload(ctx context.Context, pool *workerPool) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reloadSignals:
+			reloadConfig(ctx, pool)
+		}
+	}
+}
+
+// reloadConfig re-reads CONFIG_FILE and applies the settings in hotSettings
+// that changed since it was last applied, logging each change. Other
+// changed settings are logged and ignored, as are invalid values, so the
+// run carries on with what it had.
+func reloadConfig(ctx context.Context, pool *workerPool) {
+	values, err := readConfigFile(cfg.ConfigFile)
+	if err != nil {
+		slog.Log(ctx, slog.LevelError, "Error reloading CONFIG_FILE, keeping the current settings", "file", cfg.ConfigFile, "error", err)
+		return
+	}
+
+	var applied, ignored int
+	for _, key := range slices.Sorted(maps.Keys(values)) {
+		value := values[key]
+		if old, ok := configFileValues[key]; ok && old == value {
+			continue
+		}
+		apply := hotSettings[key]
+		if apply == nil {
+			ignored++
+			slog.Log(ctx, slog.LevelWarn, "Setting can't change during a run, ignoring it until restart", "setting", key, "value", value)
+			continue
+		}
+		previous, err := apply(pool, value)
+		if err != nil {
+			ignored++
+			slog.Log(ctx, slog.LevelError, "Error applying reloaded setting, keeping the current value", "setting", key, "value", value, "error", err)
+			continue
+		}
+		applied++
+		configFileValues[key] = value
+		slog.Log(ctx, slog.LevelInfo, "Setting changed", "setting", key, "previous", previous, "value", value)
+	}
+	for key := range configFileValues {
+		if _, ok := values[key]; !ok {
+			slog.Log(ctx, slog.LevelWarn, "Setting removed from CONFIG_FILE, keeping the current value", "setting", key)
+			delete(configFileValues, key)
+		}
+	}
+	slog.Log(ctx, slog.LevelInfo, "Reloaded CONFIG_FILE", "file", cfg.ConfigFile, "applied", applied, "ignored", ignored)
+}
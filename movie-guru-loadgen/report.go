@@ -0,0 +1,473 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"time"
+)
+
+// runReport holds a run's results with full histograms rather than
+// percentiles, so reports from several loadgen instances can be merged and
+// still give exact combined percentiles.
+type runReport struct {
+	// Instances is the number of loadgen instances merged into the report.
+	Instances int       `json:"instances"`
+	Started   time.Time `json:"started"`
+	Ended     time.Time `json:"ended"`
+	Requests  uint64    `json:"requests"`
+	Errors    uint64    `json:"errors"`
+	// ErrorsByClass splits Errors by errorClass.
+	ErrorsByClass       map[string]uint64 `json:"errors_by_class,omitempty"`
+	Retries             uint64            `json:"retries"`
+	RetryDenied         uint64            `json:"retries_denied"`
+	EventChecks         uint64            `json:"event_checks"`
+	EventMissing        uint64            `json:"events_missing"`
+	SessionUpdates      uint64            `json:"session_updates"`
+	SessionUpdateErrors uint64            `json:"session_update_errors"`
+	ContentionErrors    uint64            `json:"session_contention_errors"`
+	StreamsAbandoned    uint64            `json:"streams_abandoned"`
+	AbandonedOutcomes   map[string]uint64 `json:"abandoned_stream_outcomes,omitempty"`
+	SessionRaces        uint64            `json:"session_races"`
+	AnomalousRaces      uint64            `json:"anomalous_session_races"`
+	RaceAnomalies       map[string]uint64 `json:"session_race_anomalies,omitempty"`
+	EmptyPrompts        uint64            `json:"empty_prompts"`
+	Blocked             uint64            `json:"blocked_prompts"`
+	PromptErrors        uint64            `json:"prompt_errors"`
+	Stalled             uint64            `json:"stalled_responses"`
+	Keepalives          uint64            `json:"stream_keepalives"`
+	OutOfOrder          uint64            `json:"out_of_order_responses"`
+	Overlong            uint64            `json:"overlong_prompts"`
+	Short               uint64            `json:"short_responses"`
+	ShortSamples        []shortResponse   `json:"short_response_samples,omitempty"`
+	AnomalousStreams    uint64            `json:"anomalous_streams"`
+	StreamAnomalies     []streamAnomaly   `json:"stream_anomalies,omitempty"`
+	Latency             *histogram        `json:"latency_seconds"`
+	LimiterWait         *histogram        `json:"limiter_wait_seconds"`
+	BodyRead            *histogram        `json:"body_read_seconds"`
+	ConnWait            *histogram        `json:"conn_wait_seconds"`
+	ClientQueue         *histogram        `json:"client_queue_seconds"`
+	ReceiveDelay        *histogram        `json:"server_receive_delay_seconds"`
+	ServerTime          *histogram        `json:"server_processing_seconds"`
+	NetOverhead         *histogram        `json:"network_overhead_seconds"`
+	SessionGap          *histogram        `json:"session_gap_seconds"`
+	Iteration           *histogram        `json:"iteration_seconds"`
+	PromptChars         *histogram        `json:"prompt_length_chars"`
+	PromptTokens        *histogram        `json:"prompt_length_tokens"`
+	ConvTokens          *histogram        `json:"conversation_tokens"`
+	ConvResets          uint64            `json:"conversation_resets"`
+	Tags                []*tagReport      `json:"tags,omitempty"`
+}
+
+// tagReport is the mergeable form of tagStats.
+type tagReport struct {
+	Key      string     `json:"key"`
+	Value    string     `json:"value"`
+	Requests uint64     `json:"requests"`
+	Errors   uint64     `json:"errors"`
+	Latency  *histogram `json:"latency_seconds"`
+}
+
+func newRunReport() *runReport {
+	return &runReport{
+		Latency:      newHistogram(),
+		LimiterWait:  newHistogram(),
+		BodyRead:     newHistogram(),
+		ConnWait:     newHistogram(),
+		ClientQueue:  newHistogram(),
+		ReceiveDelay: newHistogram(),
+		ServerTime:   newHistogram(),
+		NetOverhead:  newHistogram(),
+		SessionGap:   newHistogram(),
+		Iteration:    newHistogram(),
+		PromptChars:  newHistogram(),
+		PromptTokens: newHistogram(),
+		ConvTokens:   newHistogram(),
+	}
+}
+
+// report returns a copy of the current results as a single-instance report.
+func (s *Stats) report() *runReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := &runReport{
+		Instances:           1,
+		Started:             s.started,
+		Ended:               time.Now(),
+		Requests:            s.requests,
+		Errors:              s.errors,
+		ErrorsByClass:       maps.Clone(s.errorClasses),
+		Retries:             s.retries,
+		RetryDenied:         s.retryDenied,
+		EventChecks:         s.eventChecks,
+		EventMissing:        s.eventMissing,
+		SessionUpdates:      s.sessUpdates,
+		SessionUpdateErrors: s.sessUpdErrs,
+		ContentionErrors:    s.contention,
+		StreamsAbandoned:    s.abandoned,
+		AbandonedOutcomes:   maps.Clone(s.abandonedBy),
+		SessionRaces:        s.races,
+		AnomalousRaces:      s.racesBad,
+		RaceAnomalies:       maps.Clone(s.raceKinds),
+		EmptyPrompts:        s.emptyPrompts,
+		Blocked:             s.blocked,
+		PromptErrors:        s.promptErrors,
+		Stalled:             s.stalled,
+		Keepalives:          s.keepalives,
+		OutOfOrder:          s.outOfOrder,
+		Overlong:            s.overlong,
+		Short:               s.short,
+		ShortSamples:        slices.Clone(s.shortSamples),
+		AnomalousStreams:    s.anomalous,
+		StreamAnomalies:     slices.Clone(s.anomalies),
+		Latency:             s.latency.clone(),
+		LimiterWait:         s.limiterWait.clone(),
+		BodyRead:            s.bodyRead.clone(),
+		ConnWait:            s.connWait.clone(),
+		ClientQueue:         s.clientQueue.clone(),
+		ReceiveDelay:        s.receiveDelay.clone(),
+		ServerTime:          s.serverTime.clone(),
+		NetOverhead:         s.netOverhead.clone(),
+		SessionGap:          s.sessionGap.clone(),
+		Iteration:           s.iteration.clone(),
+		PromptChars:         s.promptChars.clone(),
+		PromptTokens:        s.promptTokens.clone(),
+		ConvTokens:          s.convTokens.clone(),
+		ConvResets:          s.convResets,
+	}
+	for t, ts := range s.tags {
+		r.Tags = append(r.Tags, &tagReport{
+			Key:      t.Key,
+			Value:    t.Value,
+			Requests: ts.requests,
+			Errors:   ts.errors,
+			Latency:  ts.latency.clone(),
+		})
+	}
+	return r
+}
+
+// merge adds o's results to r. The merged run spans from the earliest start
+// to the latest end.
+func (r *runReport) merge(o *runReport) {
+	if r.Instances == 0 || (!o.Started.IsZero() && o.Started.Before(r.Started)) {
+		r.Started = o.Started
+	}
+	if o.Ended.After(r.Ended) {
+		r.Ended = o.Ended
+	}
+	r.Instances += max(o.Instances, 1)
+	r.Requests += o.Requests
+	r.Errors += o.Errors
+	for class, n := range o.ErrorsByClass {
+		if r.ErrorsByClass == nil {
+			r.ErrorsByClass = map[string]uint64{}
+		}
+		r.ErrorsByClass[class] += n
+	}
+	r.Retries += o.Retries
+	r.RetryDenied += o.RetryDenied
+	r.EventChecks += o.EventChecks
+	r.EventMissing += o.EventMissing
+	r.SessionUpdates += o.SessionUpdates
+	r.SessionUpdateErrors += o.SessionUpdateErrors
+	r.ContentionErrors += o.ContentionErrors
+	r.StreamsAbandoned += o.StreamsAbandoned
+	for outcome, n := range o.AbandonedOutcomes {
+		if r.AbandonedOutcomes == nil {
+			r.AbandonedOutcomes = map[string]uint64{}
+		}
+		r.AbandonedOutcomes[outcome] += n
+	}
+	r.SessionRaces += o.SessionRaces
+	r.AnomalousRaces += o.AnomalousRaces
+	for kind, n := range o.RaceAnomalies {
+		if r.RaceAnomalies == nil {
+			r.RaceAnomalies = map[string]uint64{}
+		}
+		r.RaceAnomalies[kind] += n
+	}
+	r.EmptyPrompts += o.EmptyPrompts
+	r.Blocked += o.Blocked
+	r.PromptErrors += o.PromptErrors
+	r.Stalled += o.Stalled
+	r.Keepalives += o.Keepalives
+	r.OutOfOrder += o.OutOfOrder
+	r.Overlong += o.Overlong
+	r.Short += o.Short
+	r.ShortSamples = appendShortSamples(r.ShortSamples, o.ShortSamples...)
+	r.AnomalousStreams += o.AnomalousStreams
+	r.StreamAnomalies = appendAnomalies(r.StreamAnomalies, o.StreamAnomalies...)
+	r.Latency.merge(o.Latency)
+	r.LimiterWait.merge(o.LimiterWait)
+	r.BodyRead.merge(o.BodyRead)
+	r.ConnWait.merge(o.ConnWait)
+	r.ClientQueue.merge(o.ClientQueue)
+	r.ReceiveDelay.merge(o.ReceiveDelay)
+	r.ServerTime.merge(o.ServerTime)
+	r.NetOverhead.merge(o.NetOverhead)
+	r.SessionGap.merge(o.SessionGap)
+	r.Iteration.merge(o.Iteration)
+	r.PromptChars.merge(o.PromptChars)
+	r.PromptTokens.merge(o.PromptTokens)
+	r.ConvTokens.merge(o.ConvTokens)
+	r.ConvResets += o.ConvResets
+
+	for _, ot := range o.Tags {
+		var rt *tagReport
+		for _, t := range r.Tags {
+			if t.Key == ot.Key && t.Value == ot.Value {
+				rt = t
+				break
+			}
+		}
+		if rt == nil {
+			rt = &tagReport{Key: ot.Key, Value: ot.Value, Latency: newHistogram()}
+			r.Tags = append(r.Tags, rt)
+		}
+		rt.Requests += ot.Requests
+		rt.Errors += ot.Errors
+		rt.Latency.merge(ot.Latency)
+	}
+}
+
+// achievedRPM is the average rate of requests over d, in requests per
+// minute.
+func achievedRPM(requests uint64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return math.Round(float64(requests)/d.Minutes()*10) / 10
+}
+
+// snapshot summarizes the report in the same shape as /stats.
+func (r *runReport) snapshot() StatsSnapshot {
+	snap := StatsSnapshot{
+		Uptime:               r.Ended.Sub(r.Started).Round(time.Second).String(),
+		AchievedRPM:          achievedRPM(r.Requests, r.Ended.Sub(r.Started)),
+		Requests:             r.Requests,
+		Errors:               r.Errors,
+		ErrorsByClass:        maps.Clone(r.ErrorsByClass),
+		Retries:              r.Retries,
+		RetryDenied:          r.RetryDenied,
+		EventChecks:          r.EventChecks,
+		EventMissing:         r.EventMissing,
+		SessionUpdates:       r.SessionUpdates,
+		SessionUpdateErrors:  r.SessionUpdateErrors,
+		ContentionErrors:     r.ContentionErrors,
+		StreamsAbandoned:     r.StreamsAbandoned,
+		AbandonedOutcomes:    maps.Clone(r.AbandonedOutcomes),
+		SessionRaces:         r.SessionRaces,
+		AnomalousRaces:       r.AnomalousRaces,
+		RaceAnomalies:        maps.Clone(r.RaceAnomalies),
+		EmptyPrompts:         r.EmptyPrompts,
+		Blocked:              r.Blocked,
+		PromptErrors:         r.PromptErrors,
+		Stalled:              r.Stalled,
+		Keepalives:           r.Keepalives,
+		OutOfOrder:           r.OutOfOrder,
+		Overlong:             r.Overlong,
+		ShortResponses:       r.Short,
+		ShortResponseSamples: slices.Clone(r.ShortSamples),
+		AnomalousStreams:     r.AnomalousStreams,
+		StreamAnomalies:      slices.Clone(r.StreamAnomalies),
+		LatencyMs:            r.Latency.summary(1000),
+		LimiterWait:          r.LimiterWait.summary(1000),
+		BodyReadMs:           r.BodyRead.summary(1000),
+		ConnWaitMs:           r.ConnWait.summary(1000),
+		ClientQueueMs:        r.ClientQueue.summary(1000),
+		ReceiveDelayMs:       r.ReceiveDelay.summary(1000),
+		ServerTimeMs:         r.ServerTime.summary(1000),
+		NetOverheadMs:        r.NetOverhead.summary(1000),
+		SessionGapMs:         r.SessionGap.summary(1000),
+		IterationMs:          r.Iteration.summary(1000),
+		PromptChars:          r.PromptChars.summary(1),
+		PromptTokens:         r.PromptTokens.summary(1),
+		ConversationTokens:   r.ConvTokens.summary(1),
+		ConversationResets:   r.ConvResets,
+	}
+
+	if len(r.Tags) > 0 {
+		snap.Tags = map[string]map[string]tagSnapshot{}
+		for _, t := range r.Tags {
+			if snap.Tags[t.Key] == nil {
+				snap.Tags[t.Key] = map[string]tagSnapshot{}
+			}
+			snap.Tags[t.Key][t.Value] = tagSnapshot{
+				Requests:  t.Requests,
+				Errors:    t.Errors,
+				LatencyMs: t.Latency.summary(1000),
+			}
+		}
+	}
+	return snap
+}
+
+// publishReport sends the final report to REPORT_URL and writes it to
+// REPORT_FILE, whichever are set. Failures are logged so they never hide the
+// run summary.
+func publishReport(r *runReport) {
+	body, err := json.Marshal(r)
+	if err != nil {
+		slog.Log(context.Background(), slog.LevelError, "Error marshalling run report", "error", err)
+		return
+	}
+
+	if cfg.ReportFile != "" {
+		if err := os.WriteFile(cfg.ReportFile, body, 0o644); err != nil {
+			slog.Log(context.Background(), slog.LevelError, "Error writing run report", "error", err)
+		} else {
+			slog.Log(context.Background(), slog.LevelInfo, "Wrote run report", "report_file", cfg.ReportFile)
+		}
+	}
+
+	if cfg.ReportURL != "" {
+		resp, err := promptClient.Post(cfg.ReportURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			slog.Log(context.Background(), slog.LevelError, "Error sending run report", "error", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			slog.Log(context.Background(), slog.LevelError, "Aggregator rejected run report", "status", resp.StatusCode)
+			return
+		}
+		slog.Log(context.Background(), slog.LevelInfo, "Sent run report", "report_url", cfg.ReportURL)
+	}
+}
+
+// readReport loads a report written with REPORT_FILE.
+func readReport(path string) (*runReport, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r := newRunReport()
+	if err := json.Unmarshal(b, r); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	return r, nil
+}
+
+// aggregator merges the reports POSTed to it by loadgen instances.
+type aggregator struct {
+	mu     sync.Mutex
+	merged *runReport
+}
+
+// ReportsHandler accepts a run report from a loadgen instance.
+func (a *aggregator) ReportsHandler(w http.ResponseWriter, r *http.Request) {
+	rep := newRunReport()
+	if err := json.NewDecoder(r.Body).Decode(rep); err != nil {
+		http.Error(w, "invalid run report: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	a.mu.Lock()
+	a.merged.merge(rep)
+	instances := a.merged.Instances
+	a.mu.Unlock()
+
+	slog.Log(r.Context(), slog.LevelInfo, "Received run report", "remote", r.RemoteAddr, "requests", rep.Requests, "instances", instances)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ReportHandler returns the merged summary of every report received so far.
+func (a *aggregator) ReportHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(a.summary())
+}
+
+// aggregateSummary is the merged report as printed by the aggregate command.
+type aggregateSummary struct {
+	Instances int           `json:"instances"`
+	Stats     StatsSnapshot `json:"stats"`
+}
+
+func (a *aggregator) summary() aggregateSummary {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return aggregateSummary{Instances: a.merged.Instances, Stats: a.merged.snapshot()}
+}
+
+// runAggregate implements the aggregate command. It merges the report files
+// given as arguments and, with -listen, also serves POST /reports for
+// instances sending REPORT_URL until interrupted. The merged summary is
+// printed to stdout.
+func runAggregate(args []string) error {
+	fs := flag.NewFlagSet("aggregate", flag.ContinueOnError)
+	listen := fs.String("listen", "", "address to accept run reports on, e.g. :8080")
+	format := fs.String("format", "", "print the merged statistics as json, table or markdown instead of the full summary")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var reporter Reporter
+	if *format != "" {
+		var err error
+		if reporter, err = newReporter(*format); err != nil {
+			return err
+		}
+	}
+
+	agg := &aggregator{merged: newRunReport()}
+	for _, path := range fs.Args() {
+		rep, err := readReport(path)
+		if err != nil {
+			return err
+		}
+		agg.merged.merge(rep)
+	}
+
+	if *listen != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("POST /reports", agg.ReportsHandler)
+		mux.HandleFunc("GET /report", agg.ReportHandler)
+		mux.HandleFunc("/", HealthHandler)
+		srv := &http.Server{Addr: *listen, Handler: mux, ReadTimeout: 15 * time.Second}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		go func() {
+			<-ctx.Done()
+			_ = srv.Shutdown(context.Background())
+		}()
+
+		slog.Log(ctx, slog.LevelInfo, "Aggregating run reports", "listen", *listen)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			return err
+		}
+	}
+
+	summary := agg.summary()
+	if reporter != nil {
+		return reporter.Report(os.Stdout, summary.Stats)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(summary)
+}
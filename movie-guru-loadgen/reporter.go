@@ -0,0 +1,253 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	reportFormatJSON     = "json"
+	reportFormatTable    = "table"
+	reportFormatMarkdown = "markdown"
+)
+
+// Reporter writes the final run statistics in a particular format.
+type Reporter interface {
+	Report(w io.Writer, s StatsSnapshot) error
+}
+
+// newReporter returns the Reporter for a REPORT_FORMAT value.
+func newReporter(format string) (Reporter, error) {
+	switch format {
+	case reportFormatJSON:
+		return jsonReporter{}, nil
+	case reportFormatTable:
+		return tableReporter{}, nil
+	case reportFormatMarkdown:
+		return markdownReporter{}, nil
+	}
+	return nil, fmt.Errorf("report format must be %q, %q or %q, got %q", reportFormatJSON, reportFormatTable, reportFormatMarkdown, format)
+}
+
+// jsonReporter writes the statistics as indented JSON, for automation.
+type jsonReporter struct{}
+
+func (jsonReporter) Report(w io.Writer, s StatsSnapshot) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
+
+// tableReporter writes aligned plain-text tables, for a terminal.
+type tableReporter struct{}
+
+func (tableReporter) Report(w io.Writer, s StatsSnapshot) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for i, t := range summaryTables(s) {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+		fmt.Fprintln(tw, t.title)
+		fmt.Fprintln(tw, strings.Join(t.header, "\t")+"\t")
+		for _, row := range t.rows {
+			fmt.Fprintln(tw, strings.Join(row, "\t")+"\t")
+		}
+	}
+	return tw.Flush()
+}
+
+// markdownReporter writes Markdown tables, for pasting into issues and pull
+// requests.
+type markdownReporter struct{}
+
+func (markdownReporter) Report(w io.Writer, s StatsSnapshot) error {
+	for i, t := range summaryTables(s) {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "### %s\n\n", t.title)
+		fmt.Fprintf(w, "| %s |\n", strings.Join(t.header, " | "))
+		fmt.Fprintf(w, "|%s\n", strings.Repeat("---|", len(t.header)))
+		for _, row := range t.rows {
+			if _, err := fmt.Fprintf(w, "| %s |\n", strings.Join(row, " | ")); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// summaryTable is one section of a human-readable report.
+type summaryTable struct {
+	title  string
+	header []string
+	rows   [][]string
+}
+
+// summaryTables lays out the statistics shared by the table and Markdown
+// reporters.
+func summaryTables(s StatsSnapshot) []summaryTable {
+	count := func(n uint64) string { return strconv.FormatUint(n, 10) }
+	totals := summaryTable{
+		title:  "Run summary",
+		header: []string{"Metric", "Value"},
+		rows: [][]string{
+			{"Duration", s.Uptime},
+			{"Achieved rate (rpm)", strconv.FormatFloat(s.AchievedRPM, 'f', 1, 64)},
+			{"Rate limit (rpm)", rateLimit(s.RateLimit)},
+			{"Requests", count(s.Requests)},
+			{"Errors", count(s.Errors)},
+			{"Transport errors", count(s.ErrorsByClass[errorClassTransport])},
+			{"Response read errors", count(s.ErrorsByClass[errorClassResponse])},
+			{"Timeout errors", count(s.ErrorsByClass[errorClassTimeout])},
+			{"Application errors", count(s.ErrorsByClass[errorClassApplication])},
+			{"Idle streams", count(s.ErrorsByClass[errorClassStreamIdle])},
+			{"Semantic errors", count(s.ErrorsByClass[errorClassSemantic])},
+			{"Binary responses", count(s.ErrorsByClass[errorClassBinary])},
+			{"Error rate", errorRate(s.Errors, s.Requests)},
+			{"Retries", count(s.Retries)},
+			{"Retries denied", count(s.RetryDenied)},
+			{"Event checks", count(s.EventChecks)},
+			{"Events missing", count(s.EventMissing)},
+			{"Session updates", count(s.SessionUpdates)},
+			{"Session update errors", count(s.SessionUpdateErrors)},
+			{"Session contention errors", count(s.ContentionErrors)},
+			{"Session races", count(s.SessionRaces)},
+			{"Anomalous session races", count(s.AnomalousRaces)},
+			{"Anomalous streams", count(s.AnomalousStreams)},
+			{"Streams abandoned", count(s.StreamsAbandoned)},
+			{"Conversation resets", count(s.ConversationResets)},
+			{"Abandoned streams completed", count(s.AbandonedOutcomes[abandonCompleted])},
+			{"Abandoned streams cancelled", count(s.AbandonedOutcomes[abandonCancelled])},
+			{"Empty prompts", count(s.EmptyPrompts)},
+			{"Blocked prompts", count(s.Blocked)},
+			{"Prompt errors", count(s.PromptErrors)},
+			{"Stalled responses", count(s.Stalled)},
+			{"Stream keepalives", count(s.Keepalives)},
+			{"Out of order responses", count(s.OutOfOrder)},
+			{"Overlong prompts", count(s.Overlong)},
+			{"Short responses", count(s.ShortResponses)},
+		},
+	}
+	if d := s.ResponseDiversity; d != nil {
+		low := "no"
+		if d.Low {
+			low = "YES"
+		}
+		totals.rows = append(totals.rows,
+			[]string{"Most common response (%)", strconv.FormatFloat(d.MostCommonPercent, 'f', 1, 64)},
+			[]string{"Low response diversity", low})
+	}
+
+	distHeader := []string{"Distribution", "Count", "Min", "Mean", "P50", "P90", "P99", "Max"}
+	dists := summaryTable{title: "Distributions", header: distHeader}
+	for _, d := range []struct {
+		name string
+		h    histogramSummary
+	}{
+		{"Latency (ms)", s.LatencyMs},
+		{"Limiter wait (ms)", s.LimiterWait},
+		{"Body read (ms)", s.BodyReadMs},
+		{"Connection wait (ms)", s.ConnWaitMs},
+		{"Client queue (ms)", s.ClientQueueMs},
+		{"Server receive delay (ms)", s.ReceiveDelayMs},
+		{"Server processing (ms)", s.ServerTimeMs},
+		{"Network overhead (ms)", s.NetOverheadMs},
+		{"Session gap (ms)", s.SessionGapMs},
+		{"Iteration (ms)", s.IterationMs},
+		{"Prompt length (chars)", s.PromptChars},
+		{"Prompt length (tokens)", s.PromptTokens},
+		{"Conversation length (tokens)", s.ConversationTokens},
+	} {
+		dists.rows = append(dists.rows, append([]string{d.name}, summaryCells(d.h)...))
+	}
+	tables := []summaryTable{totals, dists}
+
+	if len(s.Tags) > 0 {
+		tags := summaryTable{
+			title:  "Latency by tag (ms)",
+			header: []string{"Tag", "Value", "Requests", "Errors", "Mean", "P50", "P90", "P99"},
+		}
+		for _, key := range sortedKeys(s.Tags) {
+			for _, value := range sortedKeys(s.Tags[key]) {
+				ts := s.Tags[key][value]
+				cells := summaryCells(ts.LatencyMs)
+				tags.rows = append(tags.rows, []string{key, value, count(ts.Requests), count(ts.Errors), cells[2], cells[3], cells[4], cells[5]})
+			}
+		}
+		tables = append(tables, tags)
+	}
+
+	if len(s.Endpoints) > 0 {
+		eps := summaryTable{
+			title:  "Endpoints",
+			header: []string{"Endpoint", "State", "Breaker", "Requests", "Failures", "Consecutive failures", "Last error"},
+		}
+		for _, name := range sortedKeys(s.Endpoints) {
+			e := s.Endpoints[name]
+			lastError := "-"
+			if e.LastErrorTime != nil {
+				lastError = e.LastErrorTime.Format(time.RFC3339) + " " + e.LastError
+			}
+			breaker := "-"
+			if e.Breaker != "" {
+				breaker = fmt.Sprintf("%s (%d trips)", e.Breaker, e.BreakerTrips)
+			}
+			eps.rows = append(eps.rows, []string{name, e.State, breaker, count(e.Requests), count(e.Failures), count(e.ConsecutiveFailures), lastError})
+		}
+		tables = append(tables, eps)
+	}
+	return tables
+}
+
+// summaryCells formats a distribution as count, min, mean, p50, p90, p99
+// and max.
+func summaryCells(h histogramSummary) []string {
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', 1, 64) }
+	return []string{strconv.FormatUint(h.Count, 10), f(h.Min), f(h.Mean), f(h.P50), f(h.P90), f(h.P99), f(h.Max)}
+}
+
+// rateLimit formats a rate limit in requests per minute, which is 0 when
+// there is none or it isn't known, as for merged reports.
+func rateLimit(rpm float64) string {
+	if rpm == 0 {
+		return "-"
+	}
+	return strconv.FormatFloat(rpm, 'f', 1, 64)
+}
+
+func errorRate(errors, requests uint64) string {
+	if requests == 0 {
+		return "-"
+	}
+	return strconv.FormatFloat(100*float64(errors)/float64(requests), 'f', 2, 64) + "%"
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
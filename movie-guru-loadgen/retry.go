@@ -0,0 +1,176 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// statusError is returned for a non-2xx chat server response.
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("server returned error: %s (%d)", http.StatusText(e.code), e.code)
+}
+
+// responseError is a failure after the chat server's response headers
+// arrived, such as a body over MAX_BODY_BYTES or a connection dropped
+// partway through the body or stream. The server has run the request by
+// then, so it is never retried.
+type responseError struct {
+	err error
+}
+
+func (e *responseError) Error() string { return "error reading response: " + e.err.Error() }
+func (e *responseError) Unwrap() error { return e.err }
+
+const (
+	errorClassTransport   = "transport"
+	errorClassTimeout     = "timeout"
+	errorClassApplication = "application"
+	errorClassStreamIdle  = "stream_idle"
+	errorClassSemantic    = "semantic"
+	errorClassBinary      = "binary"
+	errorClassResponse    = "response"
+)
+
+// errorClass sorts a failed chat request into a networking problem before
+// any response arrived (transport: DNS, dial, TLS, connections dropped
+// before the headers), a timeout, a response that couldn't be read
+// (response: the body was too large or cut short), or a backend problem
+// (application: the server answered with an error status). Streams dropped
+// for going idle, responses failed by VALIDATE_RESPONSES (semantic) and
+// binary responses are reported on their own.
+func errorClass(err error) string {
+	if errors.Is(err, errStreamIdle) {
+		return errorClassStreamIdle
+	}
+	var ie *invalidResponseError
+	if errors.As(err, &ie) {
+		return errorClassSemantic
+	}
+	var be *binaryResponseError
+	if errors.As(err, &be) {
+		return errorClassBinary
+	}
+	var se *statusError
+	if errors.As(err, &se) {
+		return errorClassApplication
+	}
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()) {
+		return errorClassTimeout
+	}
+	var re *responseError
+	if errors.As(err, &re) {
+		return errorClassResponse
+	}
+	return errorClassTransport
+}
+
+// retryable reports whether a failed chat request is safe to retry. A /run
+// that the server may have started can't be retried without risking a
+// duplicate turn, so only transport errors, where no response arrived, and
+// cfg.RetryStatusCodes, by default gateway errors that mean the request most
+// likely never reached the agent, are retried. Timeouts and idle streams are
+// only retried with cfg.RetryOnTimeout. Cancellation, other responses,
+// responses that couldn't be read, invalid responses and messages missing
+// from the session's events never are.
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, errEventMissing) {
+		return false
+	}
+	switch errorClass(err) {
+	case errorClassTransport:
+		return true
+	case errorClassTimeout, errorClassStreamIdle:
+		return cfg.RetryOnTimeout
+	case errorClassApplication:
+		var se *statusError
+		return errors.As(err, &se) && slices.Contains(cfg.RetryStatusCodes, se.code)
+	}
+	return false
+}
+
+type requestTimeoutKey struct{}
+
+// attemptTimeout returns the timeout for a chat request's attempt, counted
+// from 0, from cfg.RequestTimeouts, or 0 for none.
+func attemptTimeout(attempt int) time.Duration {
+	if len(cfg.RequestTimeouts) == 0 {
+		return 0
+	}
+	return cfg.RequestTimeouts[min(attempt, len(cfg.RequestTimeouts)-1)]
+}
+
+// withRequestTimeout returns a context whose chat requests time out after d.
+// It is carried as a value rather than a deadline because chat requests
+// deliberately outlive their worker's context.
+func withRequestTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, requestTimeoutKey{}, d)
+}
+
+// requestTimeout returns the chat request timeout set on ctx, or 0.
+func requestTimeout(ctx context.Context) time.Duration {
+	d, _ := ctx.Value(requestTimeoutKey{}).(time.Duration)
+	return d
+}
+
+// retryBudget caps retries across the whole run at a share of the requests
+// sent, in the manner of Envoy's retry budgets, so retries can't hide a
+// broadly unhealthy backend. Once spent, retries are refused until enough
+// new requests have been sent to refill it.
+type retryBudget struct {
+	mu       sync.Mutex
+	requests uint64
+	retries  uint64
+}
+
+var budget = &retryBudget{}
+
+// request counts a request sent for the first time.
+func (b *retryBudget) request() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.requests++
+	retryBudgetAvailable.Set(b.available())
+}
+
+// allow spends one retry from the budget if there is one left.
+func (b *retryBudget) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.available() < 1 {
+		return false
+	}
+	b.retries++
+	retryBudgetAvailable.Set(b.available())
+	return true
+}
+
+// available returns how many retries may currently be made. b.mu must be
+// held.
+func (b *retryBudget) available() float64 {
+	return cfg.RetryBudgetPercent/100*float64(b.requests) + float64(cfg.RetryBudgetMin) - float64(b.retries)
+}
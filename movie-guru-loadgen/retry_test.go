@@ -0,0 +1,101 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRunLoadRetriesOnlyWithoutResponse checks that a /run is only retried
+// when no response arrived: once the headers are in, the agent has run the
+// turn and a retry would duplicate it.
+func TestRunLoadRetriesOnlyWithoutResponse(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		handler   http.HandlerFunc
+		wantClass string
+		wantRetry bool
+	}{
+		{
+			name: "body over MAX_BODY_BYTES",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`[{"content":{"role":"model","parts":[{"text":"` + strings.Repeat("x", 2048) + `"}]}}]`))
+			},
+			wantClass: errorClassResponse,
+		},
+		{
+			name: "connection dropped mid-body",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Content-Length", "500")
+				_, _ = w.Write([]byte(`[{"content":`))
+				w.(http.Flusher).Flush()
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+			},
+			wantClass: errorClassResponse,
+		},
+		{
+			name: "connection dropped before headers",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+			},
+			wantClass: errorClassTransport,
+			wantRetry: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakeBackends(t)
+			chat := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/sessions" {
+					f.chat.Config.Handler.ServeHTTP(w, r)
+					return
+				}
+				tc.handler(w, r)
+			}))
+			defer chat.Close()
+
+			setupRun(t, f, map[string]string{
+				"CHAT_SERVER":          chat.URL,
+				"RATE_LIMIT":           "6000",
+				"MAX_BODY_BYTES":       "1024",
+				"MAX_RETRIES":          "2",
+				"RETRY_BACKOFF":        "1ms",
+				"RETRY_BUDGET_PERCENT": "100",
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+
+			summary, err := runLoad(ctx)
+			if err != nil {
+				t.Fatalf("runLoad() error = %v", err)
+			}
+			if summary.Requests == 0 || summary.ErrorsByClass[tc.wantClass] != summary.Requests {
+				t.Errorf("summary requests = %d, errors by class = %v, want every request to fail as %s", summary.Requests, summary.ErrorsByClass, tc.wantClass)
+			}
+			if got := summary.Retries > 0; got != tc.wantRetry {
+				t.Errorf("summary.Retries = %d, want retries: %v", summary.Retries, tc.wantRetry)
+			}
+		})
+	}
+}
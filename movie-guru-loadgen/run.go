@@ -0,0 +1,350 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// runLoad creates a session and sends load to the servers in cfg until ctx
+// is done. It then waits for in-flight requests to finish and returns the
+// final statistics. If the watchdog aborts the run, the statistics are
+// returned along with errNoThroughput.
+func runLoad(ctx context.Context) (StatsSnapshot, error) {
+	slog.Log(ctx, slog.LevelInfo, "Starting run", "seed", cfg.Seed)
+
+	source, err := newPromptSource()
+	if err != nil {
+		return StatsSnapshot{}, fmt.Errorf("error loading prompts: %w", err)
+	}
+	if cfg.PromptBatchSize > 1 && cfg.PromptSource == promptSourceOllama {
+		slog.Log(ctx, slog.LevelInfo, "Generating prompts in batches", "batch_size", cfg.PromptBatchSize)
+		source = newBatchSource(source, cfg.PromptBatchSize)
+	}
+	if cfg.PromptBuffer > 0 && cfg.PromptSource == promptSourceOllama {
+		slog.Log(ctx, slog.LevelInfo, "Buffering generated prompts", "size", cfg.PromptBuffer, "generators", cfg.PromptGenerators)
+		source = newBufferedSource(ctx, source, cfg.PromptBuffer, cfg.PromptGenerators)
+	}
+	if promptBudget != nil && cfg.PromptSource == promptSourceOllama {
+		slog.Log(ctx, slog.LevelInfo, "Limiting prompt generation", "budget", promptBudget.limit, "unit", promptBudget.unit())
+		if source, err = newBudgetSource(source); err != nil {
+			return StatsSnapshot{}, fmt.Errorf("error loading SEED_FILE: %w", err)
+		}
+	}
+	prompts = source
+
+	if ageBands, err = parseAgeTemplates(cfg.AgeTemplates); err != nil {
+		return StatsSnapshot{}, fmt.Errorf("error loading AGE_TEMPLATES: %w", err)
+	}
+
+	sessions, sessPool, err := startRun(ctx)
+	if err != nil {
+		return StatsSnapshot{}, err
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	stopRun = cancel
+	if cfg.StallTimeout > 0 {
+		go runWatchdog(ctx, cancel)
+	}
+
+	pool := newWorkerPool(ctx, func(ctx context.Context, id int) {
+		ctx = withVU(ctx, id)
+		if sessPool == nil {
+			runWorker(ctx, sessions)
+			return
+		}
+		own, err := sessPool.acquire(authUser(ctx))
+		if err != nil {
+			slog.Log(ctx, slog.LevelError, "Error creating session for virtual user", "error", err)
+			return
+		}
+		defer sessPool.release(own)
+		runWorker(ctx, userSessions{own})
+	})
+	if cfg.TargetRPS > 0 {
+		// Closed-loop mode: throughput is governed by the number of virtual
+		// users, so the rate limiter must not cap it.
+		setLimit(rate.Inf)
+		slog.Log(ctx, slog.LevelInfo, "Targeting throughput", "target_rps", cfg.TargetRPS, "max_virtual_users", cfg.MaxVirtualUsers)
+		pool.resize(1)
+		go runThroughputController(ctx, pool)
+	} else {
+		pool.resize(cfg.VirtualUsers)
+	}
+	if cfg.ConfigFile != "" {
+		go watchReload(ctx, pool)
+	}
+
+	<-ctx.Done()
+	stalled := errors.Is(context.Cause(ctx), errNoThroughput)
+	if stalled {
+		// In-flight requests are what's hung, so don't wait for them.
+		abortInflight()
+	}
+	slog.Log(context.Background(), slog.LevelInfo, "Stopping load, waiting for in-flight requests")
+	pool.stop()
+
+	if stalled {
+		return finishRun(), errNoThroughput
+	}
+	if errors.Is(context.Cause(ctx), errFailFast) {
+		return finishRun(), errFailFast
+	}
+	return finishRun(), nil
+}
+
+// startupCountdown is how often the time left of STARTUP_DELAY is logged.
+const startupCountdown = 10 * time.Second
+
+// waitStartupDelay holds off the run, session creation included, for d,
+// logging the time left as it counts down, until ctx is done.
+func waitStartupDelay(ctx context.Context, d time.Duration) error {
+	end := time.Now().Add(d)
+	slog.Log(ctx, slog.LevelInfo, "Waiting STARTUP_DELAY before starting load", "startup_delay", d)
+	t := time.NewTicker(startupCountdown)
+	defer t.Stop()
+	done := time.NewTimer(d)
+	defer done.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Log(ctx, slog.LevelInfo, "Interrupted during STARTUP_DELAY, not starting load")
+			return ctx.Err()
+		case <-t.C:
+			slog.Log(ctx, slog.LevelInfo, "Starting load in", "remaining", time.Until(end).Round(time.Second))
+		case <-done.C:
+			return nil
+		}
+	}
+}
+
+// startRun creates a chat session for each app and identity, and the
+// session pool if SESSION_POOL_SIZE is set, and gets everything but the
+// prompt source ready to send load. It returns the sessions and the pool,
+// which is nil when virtual users share the sessions.
+func startRun(ctx context.Context) (userSessions, *sessionPool, error) {
+	if cfg.ManifestFile != "" {
+		if err := writeManifest(cfg.ManifestFile); err != nil {
+			return nil, nil, fmt.Errorf("error writing MANIFEST_FILE: %w", err)
+		}
+		slog.Log(ctx, slog.LevelInfo, "Run manifest written", "file", cfg.ManifestFile)
+	}
+
+	if cfg.UserFile != "" {
+		if err := loadAuthUsers(ctx, cfg.UserFile); err != nil {
+			return nil, nil, fmt.Errorf("error loading USER_FILE: %w", err)
+		}
+	}
+
+	if cfg.FallbackPrompt != "" {
+		var err error
+		if fallbackPrompts, err = loadFallbackPrompts(cfg.FallbackPrompt); err != nil {
+			return nil, nil, fmt.Errorf("error loading FALLBACK_PROMPT: %w", err)
+		}
+	}
+
+	if len(cfg.VUPromptFiles) > 0 {
+		var err error
+		if pinnedPrompts, err = loadPinnedPrompts(ctx, cfg.VUPromptFiles); err != nil {
+			return nil, nil, fmt.Errorf("error loading VU_PROMPT_FILES: %w", err)
+		}
+	}
+
+	// Sessions belong to the user they were created for, so each identity
+	// gets its own.
+	createdMu.Lock()
+	createdSessions = nil
+	createdMu.Unlock()
+	sessions := make(userSessions, len(identities()))
+	for i, user := range identities() {
+		for _, app := range apps {
+			for range max(cfg.SharedSessions, 1) {
+				sessionId, err := createSession(app.name, user)
+				if err != nil {
+					return nil, nil, fmt.Errorf("error creating session for app %s: %w", app.name, err)
+				}
+				sessions[i] = append(sessions[i], newSession(app.name, user, sessionId))
+			}
+		}
+	}
+	if cfg.SharedSessions > 1 {
+		slog.Log(ctx, slog.LevelInfo, "Sharing sessions between all virtual users", "sessions_per_app", cfg.SharedSessions, "apps", len(apps))
+	}
+
+	if cfg.WarmBackends {
+		warmBackends(sessions[0])
+	}
+
+	var sessPool *sessionPool
+	if cfg.SessionPoolSize > 0 {
+		var err error
+		if sessPool, err = newSessionPool(ctx, cfg.SessionPoolSize); err != nil {
+			return nil, nil, fmt.Errorf("error creating session pool: %w", err)
+		}
+	}
+
+	if cfg.BurstMode {
+		slog.Log(ctx, slog.LevelWarn, "BURST_MODE is enabled: think times are zero and virtual users send as fast as they're allowed")
+	}
+	switch {
+	case cfg.UnsafeNoRateLimit:
+		setLimit(rate.Inf)
+		slog.Log(ctx, slog.LevelWarn, "!!! UNSAFE_NO_RATE_LIMIT is enabled: rate limiting is DISABLED and virtual users send as fast as the backend answers. This can take a backend down; POST /rate sets a limit again !!!", "virtual_users", cfg.VirtualUsers)
+	case cfg.PerUserRate > 0:
+		// Each virtual user paces itself; there's no shared budget.
+		setLimit(rate.Inf)
+		slog.Log(ctx, slog.LevelInfo, "Rate limiting each virtual user", "per_user_rpm", cfg.PerUserRate)
+	case cfg.RateRamp > 0 && cfg.TargetRPS == 0:
+		go rampRate(ctx, cfg.RateRampStartRPM, cfg.RateLimit, cfg.RateRamp)
+	default:
+		setLimit(rate.Limit(cfg.RateLimit / 60.0))
+	}
+
+	if cfg.MonitoringProject != "" {
+		exporter, err := newMonitoringExporter(ctx, cfg.MonitoringProject)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error creating Cloud Monitoring client: %w", err)
+		}
+		slog.Log(ctx, slog.LevelInfo, "Exporting metrics to Cloud Monitoring", "project", cfg.MonitoringProject, "interval", cfg.MonitoringInterval)
+		go exporter.run(ctx, cfg.MonitoringInterval)
+		registerExporter("cloud_monitoring", exporter)
+	}
+
+	if cfg.RuntimeLogInterval > 0 {
+		go logRuntime(ctx, cfg.RuntimeLogInterval)
+	}
+
+	if cfg.SelfThrottleCPU > 0 {
+		go watchCPU(ctx, cfg.SelfThrottleInterval, cfg.SelfThrottleCPU)
+	}
+
+	if cfg.MetricsLogInterval > 0 {
+		go logMetrics(ctx, cfg.MetricsLogInterval)
+	}
+
+	if cfg.RateShortfallWindow > 0 && cfg.TargetRPS == 0 {
+		go watchRate(ctx, cfg.RateShortfallWindow, cfg.RateShortfallRatio)
+	}
+
+	if cfg.LatencySeriesFile != "" {
+		series = newSeriesRecorder(cfg.LatencySeriesSamples)
+	}
+
+	diversity = nil
+	if cfg.ResponseDiversityWindow > 0 {
+		diversity = newDiversityTracker(cfg.ResponseDiversityWindow)
+	}
+	mostCommonPercent.Set(0)
+	lowResponseDiversity.Set(0)
+
+	if cfg.ResponseRecordFile != "" || cfg.ResponseBaselineFile != "" {
+		var err error
+		if responses, err = newResponseRecorder(cfg.ResponseBaselineFile); err != nil {
+			return nil, nil, fmt.Errorf("error loading RESPONSE_BASELINE_FILE: %w", err)
+		}
+	}
+
+	if cfg.StatsdHost != "" {
+		addr := net.JoinHostPort(cfg.StatsdHost, strconv.Itoa(cfg.StatsdPort))
+		var err error
+		if statsd, err = newStatsdEmitter(addr, cfg.StatsdPrefix, cfg.DogStatsD); err != nil {
+			return nil, nil, fmt.Errorf("error creating StatsD client: %w", err)
+		}
+		registerExporter("statsd", statsd)
+		slog.Log(ctx, slog.LevelInfo, "Sending metrics to StatsD", "address", addr, "prefix", cfg.StatsdPrefix, "dogstatsd", cfg.DogStatsD)
+	}
+
+	initialized.Store(true)
+	slog.Log(ctx, slog.LevelInfo, "Initialization complete, starting load")
+	return sessions, sessPool, nil
+}
+
+// finishRun writes the run's outputs and flushes metrics exporters once load
+// has stopped, and returns the final statistics.
+func finishRun() StatsSnapshot {
+	abandonChecks.Wait()
+	flushExporters(cfg.FlushTimeout)
+
+	if har != nil {
+		if err := har.save(cfg.HARFile); err != nil {
+			slog.Log(context.Background(), slog.LevelError, "Error writing HAR file", "error", err)
+		}
+	}
+
+	if series != nil {
+		if err := series.save(cfg.LatencySeriesFile); err != nil {
+			slog.Log(context.Background(), slog.LevelError, "Error writing latency series", "error", err)
+		}
+	}
+
+	if responses != nil {
+		if err := responses.finish(cfg.ResponseRecordFile); err != nil {
+			slog.Log(context.Background(), slog.LevelError, "Error writing recorded responses", "error", err)
+		}
+	}
+
+	if cfg.ReportURL != "" || cfg.ReportFile != "" {
+		publishReport(stats.report())
+	}
+
+	snap := stats.snapshot()
+	if cfg.ResultsGCSURI != "" {
+		uploadResults(snap)
+	}
+	return snap
+}
+
+// warmBackends sends a throwaway prompt generation and a chat request per
+// app so model loading on a cold backend isn't measured as part of the run.
+// None of the requests are recorded in stats, and failures are only logged.
+func warmBackends(sessions sessionSet) {
+	slog.Log(context.Background(), slog.LevelInfo, "Warming up backends")
+
+	var prompt string
+	if cfg.PromptSource == promptSourceOllama {
+		start := time.Now()
+		var err error
+		// The warm-up isn't part of the run, so it doesn't spend PROMPT_BUDGET.
+		prompt, err = generatePrompt(withoutBudget(context.Background()), pickPromptModel(), newConversation().generationPrompt())
+		if err != nil {
+			slog.Log(context.Background(), slog.LevelWarn, "Prompt server warm-up failed", "error", err)
+		} else {
+			slog.Log(context.Background(), slog.LevelInfo, "Prompt server warmed up", "duration", time.Since(start))
+		}
+	}
+	if strings.TrimSpace(prompt) == "" {
+		prompt = "Can you recommend a comedy from 2010?"
+	}
+
+	for _, sess := range sessions {
+		res, err := requestMovieRecommendations(context.Background(), []part{{Text: prompt}}, sess, false)
+		if err != nil {
+			slog.Log(context.Background(), slog.LevelWarn, "Chat server warm-up failed", "app", sess.app, "error", err)
+		} else {
+			slog.Log(context.Background(), slog.LevelInfo, "Chat server warmed up", "app", sess.app, "duration", res.Latency)
+		}
+	}
+}
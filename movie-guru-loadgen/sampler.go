@@ -0,0 +1,147 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// sampler draws delays, such as think times and backoffs, from a
+// distribution. Samples are never negative and come from rng.
+type sampler interface {
+	sample() time.Duration
+}
+
+// Samplers parsed from cfg.RetryBackoff, cfg.ThinkTime, cfg.StartupJitter,
+// cfg.SessionPoolJitter and cfg.SessionCooldown.
+var (
+	retryBackoff      = mustParseSampler("500ms")
+	thinkTime         = mustParseSampler("0")
+	startupJitter     = mustParseSampler("0")
+	sessionPoolJitter = mustParseSampler("0")
+	sessionCooldown   = mustParseSampler("0")
+)
+
+// parseSampler parses a compact delay distribution:
+//
+//	2s            constant 2s (also "const:2s")
+//	uniform:1s-3s uniform between 1s and 3s
+//	exp:2s        exponential with a mean of 2s
+//	norm:2s,0.5s  normal with a mean of 2s and a standard deviation of 0.5s,
+//	              clamped at 0
+func parseSampler(spec string) (sampler, error) {
+	kind, args, ok := strings.Cut(strings.TrimSpace(spec), ":")
+	if !ok {
+		kind, args = "const", kind
+	}
+	switch kind {
+	case "const":
+		d, err := parseDelay(args)
+		if err != nil {
+			return nil, err
+		}
+		return constSampler(d), nil
+	case "uniform":
+		lo, hi, ok := strings.Cut(args, "-")
+		if !ok {
+			return nil, fmt.Errorf("uniform needs min-max, got %q", args)
+		}
+		s := uniformSampler{}
+		var err error
+		if s.min, err = parseDelay(lo); err != nil {
+			return nil, err
+		}
+		if s.max, err = parseDelay(hi); err != nil {
+			return nil, err
+		}
+		if s.min > s.max {
+			return nil, fmt.Errorf("uniform min %v is greater than max %v", s.min, s.max)
+		}
+		return s, nil
+	case "exp":
+		d, err := parseDelay(args)
+		if err != nil {
+			return nil, err
+		}
+		return expSampler{mean: d}, nil
+	case "norm":
+		mean, stddev, ok := strings.Cut(args, ",")
+		if !ok {
+			return nil, fmt.Errorf("norm needs mean,stddev, got %q", args)
+		}
+		s := normSampler{}
+		var err error
+		if s.mean, err = parseDelay(mean); err != nil {
+			return nil, err
+		}
+		if s.stddev, err = parseDelay(stddev); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("unknown distribution %q, want const, uniform, exp or norm", kind)
+}
+
+// parseDelay parses a non-negative duration. A bare "0" is allowed.
+func parseDelay(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("delay must not be negative, got %v", d)
+	}
+	return d, nil
+}
+
+// mustParseSampler is parseSampler for specs known to be valid, such as
+// defaults.
+func mustParseSampler(spec string) sampler {
+	s, err := parseSampler(spec)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+type constSampler time.Duration
+
+func (c constSampler) sample() time.Duration { return time.Duration(c) }
+
+type uniformSampler struct {
+	min, max time.Duration
+}
+
+func (u uniformSampler) sample() time.Duration {
+	return u.min + time.Duration(rng.Float64()*float64(u.max-u.min))
+}
+
+type expSampler struct {
+	mean time.Duration
+}
+
+func (e expSampler) sample() time.Duration {
+	return time.Duration(rng.ExpFloat64() * float64(e.mean))
+}
+
+type normSampler struct {
+	mean, stddev time.Duration
+}
+
+func (n normSampler) sample() time.Duration {
+	return max(0, n.mean+time.Duration(rng.NormFloat64()*float64(n.stddev)))
+}
@@ -0,0 +1,110 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseSampler(t *testing.T) {
+	for _, tc := range []struct {
+		spec    string
+		want    sampler
+		wantErr bool
+	}{
+		{spec: "2s", want: constSampler(2 * time.Second)},
+		{spec: "0", want: constSampler(0)},
+		{spec: "const:250ms", want: constSampler(250 * time.Millisecond)},
+		{spec: "uniform:1s-3s", want: uniformSampler{min: time.Second, max: 3 * time.Second}},
+		{spec: " uniform:1s - 3s ", want: uniformSampler{min: time.Second, max: 3 * time.Second}},
+		{spec: "exp:2s", want: expSampler{mean: 2 * time.Second}},
+		{spec: "norm:2s,0.5s", want: normSampler{mean: 2 * time.Second, stddev: 500 * time.Millisecond}},
+		{spec: "", wantErr: true},
+		{spec: "-1s", wantErr: true},
+		{spec: "uniform:3s-1s", wantErr: true},
+		{spec: "uniform:1s", wantErr: true},
+		{spec: "norm:2s", wantErr: true},
+		{spec: "exp:fast", wantErr: true},
+		{spec: "pareto:1s", wantErr: true},
+	} {
+		t.Run(tc.spec, func(t *testing.T) {
+			got, err := parseSampler(tc.spec)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("parseSampler(%q) error = %v, wantErr %v", tc.spec, err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("parseSampler(%q) = %#v, want %#v", tc.spec, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSamplerDistributions(t *testing.T) {
+	rng = newLockedRand(1)
+	const n = 20000
+
+	for _, tc := range []struct {
+		spec     string
+		min, max time.Duration
+		mean     time.Duration
+	}{
+		{spec: "2s", min: 2 * time.Second, max: 2 * time.Second, mean: 2 * time.Second},
+		{spec: "uniform:1s-3s", min: time.Second, max: 3 * time.Second, mean: 2 * time.Second},
+		{spec: "exp:2s", min: 0, max: time.Duration(math.MaxInt64), mean: 2 * time.Second},
+		{spec: "norm:2s,0.5s", min: 0, max: time.Duration(math.MaxInt64), mean: 2 * time.Second},
+		// Clamping at 0 pulls the mean of a wide normal above its nominal
+		// mean but never yields a negative delay.
+		{spec: "norm:0s,1s", min: 0, max: time.Duration(math.MaxInt64), mean: 399 * time.Millisecond},
+	} {
+		t.Run(tc.spec, func(t *testing.T) {
+			s, err := parseSampler(tc.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var sum time.Duration
+			for range n {
+				d := s.sample()
+				if d < tc.min || d > tc.max {
+					t.Fatalf("sample() = %v, want between %v and %v", d, tc.min, tc.max)
+				}
+				sum += d
+			}
+			mean := sum / n
+			if diff := math.Abs(float64(mean - tc.mean)); diff > 0.05*float64(tc.mean) {
+				t.Errorf("mean of %d samples = %v, want %v ± 5%%", n, mean, tc.mean)
+			}
+		})
+	}
+}
+
+func TestSamplerReproducible(t *testing.T) {
+	s := mustParseSampler("exp:1s")
+	draw := func() []time.Duration {
+		rng = newLockedRand(42)
+		var ds []time.Duration
+		for range 10 {
+			ds = append(ds, s.sample())
+		}
+		return ds
+	}
+	first, second := draw(), draw()
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("sample %d = %v then %v with the same seed", i, first[i], second[i])
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"runtime/metrics"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// The default registry's Go collector only exports runtime.MemStats. Add
+// the runtime/metrics GC, memory and scheduler metrics: the scheduler
+// latency histogram in particular shows when the loadgen is short of CPU
+// rather than the backend being saturated.
+func init() {
+	prometheus.Unregister(collectors.NewGoCollector())
+	prometheus.MustRegister(collectors.NewGoCollector(
+		collectors.WithGoCollectorRuntimeMetrics(collectors.MetricsGC, collectors.MetricsMemory, collectors.MetricsScheduler),
+	))
+}
+
+const (
+	metricGoroutines   = "/sched/goroutines:goroutines"
+	metricHeapObjects  = "/memory/classes/heap/objects:bytes"
+	metricGCCycles     = "/gc/cycles/total:gc-cycles"
+	metricGCPauses     = "/sched/pauses/total/gc:seconds"
+	metricSchedLatency = "/sched/latencies:seconds"
+)
+
+// runtimeSample is a reading of the loadgen's own resource usage.
+type runtimeSample struct {
+	goroutines   uint64
+	heapBytes    uint64
+	gcCycles     uint64
+	gcPauseP99   time.Duration
+	schedLatency time.Duration
+}
+
+// readRuntime reads a runtimeSample. The pause and latency quantiles cover
+// the whole run so far.
+func readRuntime() runtimeSample {
+	samples := []metrics.Sample{
+		{Name: metricGoroutines},
+		{Name: metricHeapObjects},
+		{Name: metricGCCycles},
+		{Name: metricGCPauses},
+		{Name: metricSchedLatency},
+	}
+	metrics.Read(samples)
+
+	var s runtimeSample
+	for _, sample := range samples {
+		switch sample.Name {
+		case metricGoroutines:
+			s.goroutines = uint64Value(sample.Value)
+		case metricHeapObjects:
+			s.heapBytes = uint64Value(sample.Value)
+		case metricGCCycles:
+			s.gcCycles = uint64Value(sample.Value)
+		case metricGCPauses:
+			s.gcPauseP99 = histogramQuantile(sample.Value, 0.99)
+		case metricSchedLatency:
+			s.schedLatency = histogramQuantile(sample.Value, 0.99)
+		}
+	}
+	return s
+}
+
+func uint64Value(v metrics.Value) uint64 {
+	if v.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return v.Uint64()
+}
+
+// histogramQuantile returns the upper bound of the bucket holding quantile q
+// of a runtime/metrics duration histogram.
+func histogramQuantile(v metrics.Value, q float64) time.Duration {
+	if v.Kind() != metrics.KindFloat64Histogram {
+		return 0
+	}
+	h := v.Float64Histogram()
+	var total uint64
+	for _, c := range h.Counts {
+		total += c
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(total)))
+	var seen uint64
+	for i, c := range h.Counts {
+		seen += c
+		if seen >= rank {
+			upper := h.Buckets[i+1]
+			if math.IsInf(upper, 1) {
+				upper = h.Buckets[i]
+			}
+			return time.Duration(upper * float64(time.Second))
+		}
+	}
+	return 0
+}
+
+// logRuntime logs the loadgen's resource usage every interval until ctx is
+// done.
+func logRuntime(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			s := readRuntime()
+			slog.Log(ctx, slog.LevelInfo, "Loadgen runtime",
+				"goroutines", s.goroutines,
+				"heap_bytes", s.heapBytes,
+				"gc_cycles", s.gcCycles,
+				"gc_pause_p99", s.gcPauseP99,
+				"sched_latency_p99", s.schedLatency,
+				"virtual_users", readGauge(virtualUsers))
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"runtime"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// selfThrottleFactor is how much the rate limit is cut every interval the
+// loadgen's CPU usage stays above SELF_THROTTLE_CPU.
+const selfThrottleFactor = 0.75
+
+// watchCPU measures the loadgen's own CPU usage, as a percentage of
+// GOMAXPROCS cores, every interval until ctx is done. Once it's above
+// threshold the loadgen can no longer time requests reliably, so the rate
+// limit is cut to selfThrottleFactor of the rate achieved, and cut again
+// every interval it stays there. When usage falls back below threshold the
+// limit in force before is restored, unless something else, e.g. POST
+// /rate, changed it in the meantime.
+func watchCPU(ctx context.Context, interval time.Duration, threshold float64) {
+	prevCPU, ok := processCPUTime()
+	if !ok {
+		slog.Log(ctx, slog.LevelWarn, "Process CPU time isn't available on this platform, SELF_THROTTLE_CPU is ignored")
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	prevWall, prev := time.Now(), stats.totals()
+	var throttled bool
+	var restore, set rate.Limit
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			cpu, _ := processCPUTime()
+			now, cur := time.Now(), stats.totals()
+			wall := now.Sub(prevWall)
+			usage := 100 * (cpu - prevCPU).Seconds() / (wall.Seconds() * float64(runtime.GOMAXPROCS(0)))
+			cpuUsage.Set(usage)
+			achieved := rate.Limit(float64(cur.requests-prev.requests) / wall.Seconds())
+			prevCPU, prevWall, prev = cpu, now, cur
+
+			if throttled && limiter.Limit() != set {
+				// The limit was changed by something else, which wins.
+				throttled = false
+				selfThrottled.Set(0)
+			}
+			args := []any{"cpu_percent", math.Round(usage*10) / 10, "threshold_percent", threshold}
+			switch {
+			case usage > threshold:
+				if !throttled {
+					throttled, restore = true, limiter.Limit()
+					selfThrottled.Set(1)
+				}
+				set = limiter.Limit()
+				if achieved > 0 {
+					set = min(set, achieved)
+				}
+				set *= selfThrottleFactor
+				setLimit(set)
+				slog.Log(ctx, slog.LevelWarn, "Loadgen CPU usage is above SELF_THROTTLE_CPU, self-throttling so its own load isn't reported as backend latency", append(args, "rate_limit_rpm", limiterRPM())...)
+			case throttled:
+				throttled = false
+				selfThrottled.Set(0)
+				setLimit(restore)
+				slog.Log(ctx, slog.LevelInfo, "Loadgen CPU usage recovered, self-throttling lifted", append(args, "rate_limit_rpm", limiterRPM())...)
+			}
+		}
+	}
+}
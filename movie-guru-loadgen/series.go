@@ -0,0 +1,116 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencySample is one chat request in the latency time series.
+type latencySample struct {
+	Time      time.Time `json:"time"`
+	LatencyMs float64   `json:"latency_ms"`
+	Outcome   string    `json:"outcome"`
+	Class     string    `json:"class,omitempty"`
+}
+
+// seriesRecorder keeps a uniform random sample of at most size chat
+// requests from across the run, by reservoir sampling, so the series can be
+// plotted to show trends such as warm-up or degradation without its size
+// growing with the run.
+type seriesRecorder struct {
+	mu      sync.Mutex
+	size    int
+	seen    int
+	samples []latencySample
+}
+
+// series is nil unless LATENCY_SERIES_FILE is set. Its methods are no-ops on
+// nil.
+var series *seriesRecorder
+
+func newSeriesRecorder(size int) *seriesRecorder {
+	return &seriesRecorder{size: size, samples: make([]latencySample, 0, size)}
+}
+
+// record adds a request completed now that took d.
+func (r *seriesRecorder) record(d time.Duration, outcome, class string) {
+	if r == nil {
+		return
+	}
+	s := latencySample{Time: time.Now(), LatencyMs: float64(d) / float64(time.Millisecond), Outcome: outcome, Class: class}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seen++
+	if len(r.samples) < r.size {
+		r.samples = append(r.samples, s)
+	} else if i := rng.Intn(r.seen); i < r.size {
+		r.samples[i] = s
+	}
+}
+
+// save writes the samples in time order to path, as CSV if it ends in
+// ".csv" and as newline-delimited JSON otherwise.
+func (r *seriesRecorder) save(path string) error {
+	r.mu.Lock()
+	samples := slices.Clone(r.samples)
+	r.mu.Unlock()
+	slices.SortFunc(samples, func(a, b latencySample) int { return a.Time.Compare(b.Time) })
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		err = writeSeriesCSV(f, samples)
+	} else {
+		err = writeSeriesNDJSON(f, samples)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func writeSeriesCSV(f *os.File, samples []latencySample) error {
+	w := csv.NewWriter(f)
+	_ = w.Write([]string{"time", "latency_ms", "outcome", "class"})
+	for _, s := range samples {
+		_ = w.Write([]string{s.Time.Format(time.RFC3339Nano), strconv.FormatFloat(s.LatencyMs, 'f', 3, 64), s.Outcome, s.Class})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func writeSeriesNDJSON(f *os.File, samples []latencySample) error {
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, s := range samples {
+		if err := enc.Encode(s); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
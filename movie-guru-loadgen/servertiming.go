@@ -0,0 +1,99 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serverTime returns the processing time the backend reports in the first
+// of cfg.ServerTimingHeaders the response has. It returns false when none
+// of them is present and parseable.
+func serverTime(ctx context.Context, resp *http.Response) (time.Duration, bool) {
+	for _, h := range cfg.ServerTimingHeaders {
+		v := resp.Header.Get(h)
+		if v == "" {
+			continue
+		}
+		var d time.Duration
+		var ok bool
+		if strings.EqualFold(h, "Server-Timing") {
+			d, ok = parseServerTiming(resp.Header.Values(h))
+		} else {
+			d, ok = parseProcessingTime(v)
+		}
+		if !ok {
+			slog.Log(ctx, slog.LevelDebug, "Unparseable server timing", "header", h, "value", v)
+			continue
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// parseServerTiming returns the processing time in Server-Timing header
+// values such as "db;dur=53, app;dur=47.2": the "total" metric's duration
+// if there is one, or else the sum of every metric's duration.
+func parseServerTiming(values []string) (time.Duration, bool) {
+	var sum float64
+	found := false
+	for _, v := range values {
+		for _, metric := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(metric, ";")
+			dur, ok := serverTimingDur(params)
+			if !ok {
+				continue
+			}
+			if strings.EqualFold(strings.TrimSpace(name), "total") {
+				return time.Duration(dur * float64(time.Millisecond)), true
+			}
+			sum += dur
+			found = true
+		}
+	}
+	return time.Duration(sum * float64(time.Millisecond)), found
+}
+
+// serverTimingDur returns the dur parameter, in milliseconds, of a
+// Server-Timing metric's parameters.
+func serverTimingDur(params string) (float64, bool) {
+	for _, p := range strings.Split(params, ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+		if strings.EqualFold(k, "dur") {
+			f, err := strconv.ParseFloat(strings.Trim(v, `"`), 64)
+			return f, err == nil && f >= 0
+		}
+	}
+	return 0, false
+}
+
+// parseProcessingTime parses a header such as X-Processing-Time: a Go
+// duration like "120ms", or a bare number of milliseconds.
+func parseProcessingTime(v string) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if d, err := time.ParseDuration(v); err == nil {
+		return d, d >= 0
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		return 0, false
+	}
+	return time.Duration(f * float64(time.Millisecond)), true
+}
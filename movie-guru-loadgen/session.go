@@ -0,0 +1,182 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// session is a chat server session of an ADK app and the requests in flight
+// on it. Each request gets a sequence number at dispatch so responses that
+// complete out of dispatch order can be detected.
+type session struct {
+	app  string
+	user string // the identity the session was created for
+	id   string
+
+	mu       sync.Mutex
+	inflight int
+	nextSeq  uint64
+	lastDone uint64 // highest sequence number completed so far
+}
+
+func newSession(app, user, id string) *session {
+	return &session{app: app, user: user, id: id}
+}
+
+// createdSessions holds every session created during the run, to catch a
+// backend handing out a session it already did: movie-guru-agent's
+// /sessions returns the same session for a user all day.
+var (
+	createdMu       sync.Mutex
+	createdSessions map[sessionKey]bool
+)
+
+type sessionKey struct{ app, user, id string }
+
+// errSessionReused means the chat server returned a session that was
+// already created during the run instead of a new one.
+var errSessionReused = errors.New("chat server returned a session it already created; set SESSION_CREATE_PATH to an endpoint that creates a new one on every call, e.g. /apps/{app}/users/{user}/sessions/{id}")
+
+// claimSession records the session app, user and id as created, and
+// returns errSessionReused if it already was.
+func claimSession(app, user, id string) error {
+	createdMu.Lock()
+	defer createdMu.Unlock()
+	key := sessionKey{app, user, id}
+	if createdSessions[key] {
+		return fmt.Errorf("session %s of app %s: %w", id, app, errSessionReused)
+	}
+	if createdSessions == nil {
+		createdSessions = map[sessionKey]bool{}
+	}
+	createdSessions[key] = true
+	return nil
+}
+
+// apps is parsed from cfg.AppNames.
+var apps = []weighted{{name: defaultAppName, weight: 1}}
+
+// sessionSet holds the same number of sessions for each app in apps,
+// grouped in the same order: one each, or SHARED_SESSIONS each when all
+// virtual users share them.
+type sessionSet []*session
+
+// sharedTurn round-robins requests over an app's sessions in a sessionSet.
+var sharedTurn atomic.Uint64
+
+// pick picks an app by weight and the next of its sessions in turn.
+func (s sessionSet) pick() *session {
+	if len(s) == 1 {
+		return s[0]
+	}
+	perApp := len(s) / len(apps)
+	i := pickWeighted(apps) * perApp
+	if perApp > 1 {
+		i += int(sharedTurn.Add(1) % uint64(perApp))
+	}
+	return s[i]
+}
+
+// userSessions holds a sessionSet for each identity, in the order of
+// identities(), or just the virtual user's own set from the session pool.
+type userSessions []sessionSet
+
+// pick picks a session of the identity the virtual user in ctx sends as
+// next, so every request on a session is sent as its owner.
+func (s userSessions) pick(ctx context.Context) *session {
+	if len(s) == 1 {
+		return s[0].pick()
+	}
+	return s[authUserIndex(ctx)].pick()
+}
+
+// contentionError reports whether err is a response that says the session
+// was busy with, or changed by, a concurrent request: 409 Conflict or
+// 423 Locked.
+func contentionError(err error) bool {
+	var se *statusError
+	return errors.As(err, &se) && (se.code == http.StatusConflict || se.code == http.StatusLocked)
+}
+
+// begin marks a request as dispatched on the session. It returns the
+// request's sequence number and a tag with the number of requests in flight
+// on the session, including this one.
+func (s *session) begin() (uint64, tag) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextSeq++
+	s.inflight++
+	return s.nextSeq, tag{Key: "session_inflight", Value: strconv.Itoa(s.inflight)}
+}
+
+// turnTag labels a request with its turn number on the session, i.e. how
+// many requests were dispatched on it before, plus one. Turns past 2 are
+// grouped into power-of-two ranges ("3-4", "5-8", ...) so long runs don't
+// create a label per turn.
+func turnTag(seq uint64) tag {
+	t := tag{Key: "session_turn", Value: strconv.FormatUint(seq, 10)}
+	if seq > 2 {
+		hi := uint64(1) << bits.Len64(seq-1)
+		t.Value = strconv.FormatUint(hi/2+1, 10) + "-" + strconv.FormatUint(hi, 10)
+	}
+	return t
+}
+
+// end marks the request with sequence number seq as complete. It reports
+// whether a request dispatched after it on the same session completed first.
+func (s *session) end(seq uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inflight--
+	if seq < s.lastDone {
+		return true
+	}
+	s.lastDone = seq
+	return false
+}
+
+type turnKey struct{}
+
+// withTurnOrder returns ctx with a lock that keeps a virtual user's turns
+// strictly ordered in multi-turn mode with ORDERED_TURNS: each of its
+// requests waits until its previous one has been answered. The lock belongs
+// to the virtual user, not the session, so users sharing a session still
+// send in parallel.
+func withTurnOrder(ctx context.Context) context.Context {
+	if !cfg.MultiTurn || !cfg.OrderedTurns {
+		return ctx
+	}
+	return context.WithValue(ctx, turnKey{}, &sync.Mutex{})
+}
+
+// holdTurn waits, if the virtual user in ctx has ordered turns, until none
+// of its requests are in flight, and returns the function that lets the
+// next one go.
+func holdTurn(ctx context.Context) func() {
+	turn, _ := ctx.Value(turnKey{}).(*sync.Mutex)
+	if turn == nil {
+		return func() {}
+	}
+	turn.Lock()
+	return turn.Unlock
+}
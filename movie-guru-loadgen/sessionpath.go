@@ -0,0 +1,81 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	crand "crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// sessionPathPlaceholder matches the placeholders in SESSION_CREATE_PATH.
+var sessionPathPlaceholder = regexp.MustCompile(`\{[^{}]*\}`)
+
+// validateSessionPath checks a SESSION_CREATE_PATH template: a path starting
+// with '/' whose only placeholders are {app}, {user} and {id}.
+func validateSessionPath(path string) error {
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("%q must start with /", path)
+	}
+	for _, p := range sessionPathPlaceholder.FindAllString(path, -1) {
+		if p != "{app}" && p != "{user}" && p != "{id}" {
+			return fmt.Errorf("%q has unknown placeholder %s; use {app}, {user} or {id}", path, p)
+		}
+	}
+	if strings.ContainsAny(sessionPathPlaceholder.ReplaceAllString(path, ""), "{}") {
+		return fmt.Errorf("%q has an unterminated placeholder", path)
+	}
+	return nil
+}
+
+// validateSessionMethod checks SESSION_CREATE_METHOD.
+func validateSessionMethod(method string) error {
+	switch method {
+	case http.MethodPost, http.MethodPut:
+		return nil
+	}
+	return fmt.Errorf("must be POST or PUT, got %q", method)
+}
+
+// sessionEndpoint returns the URL a session for app and user is created at and the
+// response body field holding its id. Without SESSION_CREATE_PATH,
+// movie-guru-agent's own endpoint creates sessions for the default app and
+// other apps use the ADK session endpoint. A template with {id} gets a
+// session id chosen here, which is returned as id and used if the response
+// doesn't name one.
+func sessionEndpoint(app, user string) (u, idKey, id string) {
+	if cfg.SessionCreatePath == "" {
+		if app == defaultAppName {
+			return cfg.ChatServer + "/sessions", "session_id", ""
+		}
+		return fmt.Sprintf("%s/apps/%s/users/%s/sessions", cfg.ChatServer, url.PathEscape(app), url.PathEscape(user)), "id", ""
+	}
+
+	if strings.Contains(cfg.SessionCreatePath, "{id}") {
+		b := make([]byte, 16)
+		_, _ = crand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	path := strings.NewReplacer(
+		"{app}", url.PathEscape(app),
+		"{user}", url.PathEscape(user),
+		"{id}", id,
+	).Replace(cfg.SessionCreatePath)
+	return cfg.ChatServer + path, "id", id
+}
@@ -0,0 +1,116 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+// sessionPool hands each virtual user its own sessions, one per app, all
+// of one identity, from a pool created at startup, so session creation
+// isn't measured as part of early requests. When the pool runs dry,
+// sessions are created on demand.
+type sessionPool struct {
+	mu    sync.Mutex
+	idle  map[poolKey][]*session
+	inUse int
+}
+
+// poolKey is what idle sessions are pooled by.
+type poolKey struct{ app, user string }
+
+// newSessionPool creates size sessions for each app, spaced out by
+// sessionPoolJitter. The identities take turns, the same as virtual users
+// are given them.
+func newSessionPool(ctx context.Context, size int) (*sessionPool, error) {
+	p := &sessionPool{idle: map[poolKey][]*session{}}
+	users := identities()
+	for i := range size {
+		user := users[i%len(users)]
+		for _, app := range apps {
+			if err := sleep(ctx, sessionPoolJitter.sample()); err != nil {
+				return nil, err
+			}
+			sess, err := newPoolSession(app.name, user)
+			if err != nil {
+				return nil, err
+			}
+			key := poolKey{app.name, user}
+			p.idle[key] = append(p.idle[key], sess)
+		}
+	}
+	sessionPoolIdle.Set(float64(size * len(apps)))
+	slog.Log(ctx, slog.LevelInfo, "Session pool created", "sessions_per_app", size, "apps", len(apps))
+	return p, nil
+}
+
+func newPoolSession(app, user string) (*session, error) {
+	id, err := createSession(app, user)
+	if err != nil {
+		return nil, fmt.Errorf("error creating session for app %s: %w", app, err)
+	}
+	return newSession(app, user, id), nil
+}
+
+// acquire takes a session of user for each app, in the order of apps,
+// creating any the pool has run out of.
+func (p *sessionPool) acquire(user string) (sessionSet, error) {
+	var set sessionSet
+	for _, app := range apps {
+		key := poolKey{app.name, user}
+		p.mu.Lock()
+		idle := p.idle[key]
+		var sess *session
+		if n := len(idle); n > 0 {
+			sess, p.idle[key] = idle[n-1], idle[:n-1]
+			sessionPoolIdle.Dec()
+		}
+		p.mu.Unlock()
+
+		if sess == nil {
+			sessionPoolCreated.Inc()
+			var err error
+			if sess, err = newPoolSession(app.name, user); err != nil {
+				p.release(set)
+				return nil, err
+			}
+		}
+		set = append(set, sess)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inUse++
+	sessionPoolInUse.Set(float64(p.inUse))
+	return set, nil
+}
+
+// release returns a virtual user's sessions to the pool.
+func (p *sessionPool) release(set sessionSet) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, sess := range set {
+		key := poolKey{sess.app, sess.user}
+		p.idle[key] = append(p.idle[key], sess)
+		sessionPoolIdle.Inc()
+	}
+	if len(set) == len(apps) {
+		p.inUse--
+		sessionPoolInUse.Set(float64(p.inUse))
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// runSessionUpdates sends a session state update to one of sessions every
+// cfg.SessionUpdateInterval until ctx is done, simulating a user changing
+// their preferences mid-conversation.
+func runSessionUpdates(ctx context.Context, sessions userSessions) {
+	t := time.NewTicker(cfg.SessionUpdateInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		if gate.wait(ctx) != nil {
+			return
+		}
+		sess := sessions.pick(ctx)
+		err := updateSession(ctx, sess)
+		stats.recordSessionUpdate(err)
+		if err != nil && ctx.Err() == nil {
+			slog.Log(ctx, slog.LevelWarn, "Error updating session state", "app", sess.app, "session_id", sess.id, "error", err)
+		}
+	}
+}
+
+// updateSession sends cfg.SessionUpdatePayload to the session's
+// cfg.SessionUpdatePath.
+func updateSession(ctx context.Context, sess *session) error {
+	path := strings.NewReplacer(
+		"{app}", url.PathEscape(sess.app),
+		"{user}", url.PathEscape(sess.user),
+		"{id}", url.PathEscape(sess.id),
+	).Replace(cfg.SessionUpdatePath)
+	req, err := http.NewRequestWithContext(ctx, cfg.SessionUpdateMethod, cfg.ChatServer+path, bytes.NewBufferString(cfg.SessionUpdatePayload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	setAuthUser(req, sess.user)
+	setVUHeader(ctx, req)
+
+	resp, err := chatClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &statusError{code: resp.StatusCode}
+	}
+	return nil
+}
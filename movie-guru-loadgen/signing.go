@@ -0,0 +1,63 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+)
+
+// signingTransport adds an HMAC-SHA256 signature of every request body,
+// keyed with REQUEST_SIGNING_SECRET, to the REQUEST_SIGNATURE_HEADER header
+// as lowercase hex. Requests without a body are signed over the empty body.
+type signingTransport struct {
+	next   http.RoundTripper
+	secret []byte
+	header string
+}
+
+func (t *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		rc := req.Body
+		var err error
+		if req.GetBody != nil {
+			// Leave the original body for the transport to send.
+			if rc, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		body, err = io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write(body)
+
+	// A RoundTripper mustn't modify the request it was given.
+	signed := req.Clone(req.Context())
+	if req.GetBody == nil && body != nil {
+		signed.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	signed.Header.Set(t.header, hex.EncodeToString(mac.Sum(nil)))
+	return t.next.RoundTrip(signed)
+}
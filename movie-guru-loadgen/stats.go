@@ -0,0 +1,802 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// histogramMin is the smallest value tracked with full precision; anything
+	// at or below it lands in bucket 0.
+	histogramMin = 1e-4
+	// histogramGrowth is the ratio between consecutive bucket bounds, which
+	// keeps reported percentiles within ~1% of the true value.
+	histogramGrowth = 1.02
+)
+
+// histogram is a sparse, log-bucketed histogram. Buckets are keyed by index
+// so two histograms can be merged by adding their counts.
+type histogram struct {
+	Buckets map[int]uint64 `json:"buckets"`
+	Count   uint64         `json:"count"`
+	Sum     float64        `json:"sum"`
+	Min     float64        `json:"min"`
+	Max     float64        `json:"max"`
+}
+
+func newHistogram() *histogram {
+	return &histogram{Buckets: map[int]uint64{}}
+}
+
+func bucketIndex(v float64) int {
+	if v <= histogramMin {
+		return 0
+	}
+	return int(math.Ceil(math.Log(v/histogramMin) / math.Log(histogramGrowth)))
+}
+
+func bucketUpperBound(i int) float64 {
+	return histogramMin * math.Pow(histogramGrowth, float64(i))
+}
+
+func (h *histogram) observe(v float64) {
+	if h.Count == 0 || v < h.Min {
+		h.Min = v
+	}
+	if v > h.Max {
+		h.Max = v
+	}
+	h.Count++
+	h.Sum += v
+	h.Buckets[bucketIndex(v)]++
+}
+
+func (h *histogram) clone() *histogram {
+	c := *h
+	c.Buckets = make(map[int]uint64, len(h.Buckets))
+	for k, v := range h.Buckets {
+		c.Buckets[k] = v
+	}
+	return &c
+}
+
+// merge adds o's observations to h.
+func (h *histogram) merge(o *histogram) {
+	if o == nil || o.Count == 0 {
+		return
+	}
+	if h.Count == 0 || o.Min < h.Min {
+		h.Min = o.Min
+	}
+	if o.Max > h.Max {
+		h.Max = o.Max
+	}
+	h.Count += o.Count
+	h.Sum += o.Sum
+	for k, v := range o.Buckets {
+		h.Buckets[k] += v
+	}
+}
+
+// since returns the observations added to h since it was prev, a clone
+// taken earlier. Min and Max are only as precise as the buckets.
+func (h *histogram) since(prev *histogram) *histogram {
+	d := newHistogram()
+	d.Count = h.Count - prev.Count
+	d.Sum = h.Sum - prev.Sum
+	lo, hi := math.MaxInt, math.MinInt
+	for k, v := range h.Buckets {
+		if n := v - prev.Buckets[k]; n > 0 {
+			d.Buckets[k] = n
+			lo, hi = min(lo, k), max(hi, k)
+		}
+	}
+	if d.Count > 0 {
+		d.Min = bucketUpperBound(lo - 1)
+		d.Max = bucketUpperBound(hi)
+	}
+	return d
+}
+
+func (h *histogram) quantile(q float64) float64 {
+	if h.Count == 0 {
+		return 0
+	}
+	keys := make([]int, 0, len(h.Buckets))
+	for k := range h.Buckets {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+
+	rank := uint64(math.Ceil(q * float64(h.Count)))
+	var seen uint64
+	for _, k := range keys {
+		seen += h.Buckets[k]
+		if seen >= rank {
+			return math.Max(h.Min, math.Min(h.Max, bucketUpperBound(k)))
+		}
+	}
+	return h.Max
+}
+
+// histogramSummary is the human-facing view of a histogram.
+type histogramSummary struct {
+	Count uint64  `json:"count"`
+	Min   float64 `json:"min"`
+	Mean  float64 `json:"mean"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+	Max   float64 `json:"max"`
+}
+
+// summary reports the histogram with every value multiplied by scale, e.g.
+// 1000 to turn seconds into milliseconds.
+func (h *histogram) summary(scale float64) histogramSummary {
+	s := histogramSummary{Count: h.Count}
+	if h.Count == 0 {
+		return s
+	}
+	s.Min = h.Min * scale
+	s.Mean = h.Sum / float64(h.Count) * scale
+	s.P50 = h.quantile(0.50) * scale
+	s.P90 = h.quantile(0.90) * scale
+	s.P99 = h.quantile(0.99) * scale
+	s.Max = h.Max * scale
+	return s
+}
+
+// tag labels a chat request so its results can be compared with requests
+// that carry a different value for the same key.
+type tag struct {
+	Key   string
+	Value string
+}
+
+// tagStats accumulates the results of requests carrying one tag value.
+type tagStats struct {
+	requests uint64
+	errors   uint64
+	latency  *histogram
+}
+
+// tagSnapshot is a point-in-time copy of tagStats. Durations are in ms.
+type tagSnapshot struct {
+	Requests  uint64           `json:"requests"`
+	Errors    uint64           `json:"errors"`
+	LatencyMs histogramSummary `json:"latency_ms"`
+}
+
+// Stats accumulates the results of the run. It backs both the /stats endpoint
+// and the Prometheus metrics served on /metrics.
+type Stats struct {
+	mu           sync.Mutex
+	started      time.Time
+	requests     uint64
+	errors       uint64
+	errorClasses map[string]uint64
+	retries      uint64
+	retryDenied  uint64
+	eventChecks  uint64
+	eventMissing uint64
+	sessUpdates  uint64
+	sessUpdErrs  uint64
+	contention   uint64
+	abandoned    uint64
+	abandonedBy  map[string]uint64 // abandoned streams by what the backend did
+	races        uint64
+	racesBad     uint64            // races that damaged the session
+	raceKinds    map[string]uint64 // damaged races by kind
+	emptyPrompts uint64
+	blocked      uint64
+	promptErrors uint64
+	stalled      uint64
+	keepalives   uint64
+	outOfOrder   uint64
+	overlong     uint64
+	short        uint64
+	shortSamples []shortResponse // the most recent short responses
+	anomalous    uint64
+	anomalies    []streamAnomaly // the most recent streams failing the integrity check
+	latency      *histogram      // chat request latency, excluding limiter wait
+	limiterWait  *histogram      // time spent waiting for a rate limiter token
+	bodyRead     *histogram      // time between response headers and end of body
+	connWait     *histogram      // time queued for a pooled connection
+	clientQueue  *histogram      // rate limiter token to send
+	receiveDelay *histogram      // send to the backend's reported receive time
+	serverTime   *histogram      // processing time the backend reports
+	netOverhead  *histogram      // latency less the reported processing time
+	sessionGap   *histogram      // a conversation's end to the next session's first request
+	iteration    *histogram      // a virtual user's whole iteration, prompt to reply
+	promptChars  *histogram      // prompt length in characters
+	promptTokens *histogram      // estimated prompt length in tokens
+	convTokens   *histogram      // estimated tokens exchanged per conversation
+	convResets   uint64          // conversations ended by MAX_CONVERSATION_TOKENS
+	tags         map[tag]*tagStats
+}
+
+// StatsSnapshot is a point-in-time copy of Stats. Durations are in ms.
+type StatsSnapshot struct {
+	Uptime    string  `json:"uptime"`
+	Paused    bool    `json:"paused"`
+	RateLimit float64 `json:"rate_limit_rpm"`
+	Requests  uint64  `json:"requests"`
+	Errors    uint64  `json:"errors"`
+	// ErrorsByClass splits Errors into transport, timeout and application
+	// errors.
+	ErrorsByClass map[string]uint64 `json:"errors_by_class,omitempty"`
+	AchievedRPM   float64           `json:"achieved_rpm"` // average chat request rate over the run
+	Retries       uint64            `json:"retries"`
+	RetryDenied   uint64            `json:"retries_denied"`
+	EventChecks   uint64            `json:"event_checks"`
+	EventMissing  uint64            `json:"events_missing"`
+	// SessionUpdates counts SESSION_UPDATE_INTERVAL updates sent,
+	// SessionUpdateErrors those that failed.
+	SessionUpdates      uint64 `json:"session_updates"`
+	SessionUpdateErrors uint64 `json:"session_update_errors"`
+	// ContentionErrors counts chat requests rejected because their session
+	// was busy or changed concurrently, with 409 or 423.
+	ContentionErrors uint64 `json:"session_contention_errors"`
+	// StreamsAbandoned counts streams closed early by
+	// STREAM_ABANDON_FRACTION; AbandonedOutcomes splits those checked by
+	// whether the backend completed the reply anyway or cancelled it.
+	StreamsAbandoned  uint64            `json:"streams_abandoned"`
+	AbandonedOutcomes map[string]uint64 `json:"abandoned_stream_outcomes,omitempty"`
+	EmptyPrompts      uint64            `json:"empty_prompts"`
+	Blocked           uint64            `json:"blocked_prompts"`
+	PromptErrors      uint64            `json:"prompt_errors"`
+	Stalled           uint64            `json:"stalled_responses"`
+	Keepalives        uint64            `json:"stream_keepalives"`
+	OutOfOrder        uint64            `json:"out_of_order_responses"`
+	Overlong          uint64            `json:"overlong_prompts"`
+	// SessionRaces counts SESSION_RACE_FRACTION races, AnomalousRaces those
+	// that damaged the session; RaceAnomalies splits them by kind.
+	SessionRaces   uint64            `json:"session_races"`
+	AnomalousRaces uint64            `json:"anomalous_session_races"`
+	RaceAnomalies  map[string]uint64 `json:"session_race_anomalies,omitempty"`
+	// ShortResponses counts successful responses shorter than
+	// MIN_RESPONSE_CHARS; ShortResponseSamples are the latest of them.
+	ShortResponses       uint64          `json:"short_responses"`
+	ShortResponseSamples []shortResponse `json:"short_response_samples,omitempty"`
+	// AnomalousStreams counts streams that failed CHECK_STREAM_INTEGRITY;
+	// the latest are kept in StreamAnomalies.
+	AnomalousStreams uint64          `json:"anomalous_streams"`
+	StreamAnomalies  []streamAnomaly `json:"stream_anomalies,omitempty"`
+	// ResponseDiversity is how varied the latest successful replies are,
+	// with RESPONSE_DIVERSITY_WINDOW.
+	ResponseDiversity *diversitySnapshot `json:"response_diversity,omitempty"`
+	// Endpoints is the current health of each backend endpoint requests
+	// were sent to.
+	Endpoints   map[string]EndpointSnapshot `json:"endpoints,omitempty"`
+	LatencyMs   histogramSummary            `json:"latency_ms"`
+	LimiterWait histogramSummary            `json:"limiter_wait_ms"`
+	BodyReadMs  histogramSummary            `json:"body_read_ms"`
+	ConnWaitMs  histogramSummary            `json:"conn_wait_ms"`
+	// ClientQueueMs is the time from a request's rate limiter token to it
+	// being sent; ReceiveDelayMs from it being sent to the receive time the
+	// backend reports, if it does.
+	ClientQueueMs  histogramSummary `json:"client_queue_ms"`
+	ReceiveDelayMs histogramSummary `json:"server_receive_delay_ms"`
+	ServerTimeMs   histogramSummary `json:"server_processing_ms"` // as the backend reports it
+	NetOverheadMs  histogramSummary `json:"network_overhead_ms"`  // latency less ServerTimeMs
+	SessionGapMs   histogramSummary `json:"session_gap_ms"`       // between a virtual user's sessions
+	IterationMs    histogramSummary `json:"iteration_ms"`
+	PromptChars    histogramSummary `json:"prompt_length_chars"`
+	PromptTokens   histogramSummary `json:"prompt_length_tokens"`
+	// ConversationTokens is the estimated tokens exchanged per finished
+	// conversation, ConversationResets how many MAX_CONVERSATION_TOKENS
+	// ended.
+	ConversationTokens histogramSummary `json:"conversation_tokens"`
+	ConversationResets uint64           `json:"conversation_resets"`
+	// Tags maps tag key to tag value to the results for that value.
+	Tags map[string]map[string]tagSnapshot `json:"tags,omitempty"`
+}
+
+var stats = newStats()
+
+func newStats() *Stats {
+	return &Stats{
+		started:      time.Now(),
+		latency:      newHistogram(),
+		limiterWait:  newHistogram(),
+		bodyRead:     newHistogram(),
+		connWait:     newHistogram(),
+		clientQueue:  newHistogram(),
+		receiveDelay: newHistogram(),
+		serverTime:   newHistogram(),
+		netOverhead:  newHistogram(),
+		sessionGap:   newHistogram(),
+		iteration:    newHistogram(),
+		promptChars:  newHistogram(),
+		promptTokens: newHistogram(),
+		convTokens:   newHistogram(),
+		errorClasses: map[string]uint64{},
+		abandonedBy:  map[string]uint64{},
+		raceKinds:    map[string]uint64{},
+		tags:         map[tag]*tagStats{},
+	}
+}
+
+// recordChat records a chat server request. d must only cover the time the
+// request was in flight, not the time spent waiting on the rate limiter.
+// Any tags are recorded in addition to the overall results.
+func (s *Stats) recordChat(d time.Duration, err error, tags ...tag) {
+	s.recordTracedChat("", d, err, tags...)
+}
+
+// recordTracedChat is recordChat for a request in the trace traceID, which
+// is attached to the latency histograms as an exemplar.
+func (s *Stats) recordTracedChat(traceID string, d time.Duration, err error, tags ...tag) {
+	outcome, class := "success", ""
+	if err != nil {
+		outcome, class = "error", errorClass(err)
+		chatErrors.WithLabelValues(class).Inc()
+	}
+	observe(chatRequestDuration.WithLabelValues(outcome), d.Seconds(), traceID)
+	for _, t := range tags {
+		observe(taggedChatRequestDuration.WithLabelValues(t.Key, t.Value, outcome), d.Seconds(), traceID)
+	}
+	statsdTags := append([]tag{{Key: "outcome", Value: outcome}}, tags...)
+	statsd.count("chat.requests", 1, statsdTags...)
+	if err != nil {
+		statsd.count("chat.errors", 1, tags...)
+	}
+	statsd.timing("chat.latency", d, statsdTags...)
+	series.record(d, outcome, class)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if err != nil {
+		s.errors++
+		s.errorClasses[class]++
+	}
+	s.latency.observe(d.Seconds())
+
+	for _, t := range tags {
+		ts, ok := s.tags[t]
+		if !ok {
+			ts = &tagStats{latency: newHistogram()}
+			s.tags[t] = ts
+		}
+		ts.requests++
+		if err != nil {
+			ts.errors++
+		}
+		ts.latency.observe(d.Seconds())
+	}
+}
+
+// recordRetry records a failed chat request being retried.
+func (s *Stats) recordRetry() {
+	retriesTotal.Inc()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retries++
+}
+
+// recordRetryDenied records a retry refused by the retry budget.
+func (s *Stats) recordRetryDenied() {
+	retriesDenied.Inc()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retryDenied++
+}
+
+// recordEventCheck records the outcome of a VERIFY_EVENTS check. Checks
+// that couldn't fetch the session are only counted in /metrics.
+func (s *Stats) recordEventCheck(err error) {
+	outcome := "found"
+	switch {
+	case errors.Is(err, errEventMissing):
+		outcome = "missing"
+	case err != nil:
+		outcome = "error"
+	}
+	eventChecks.WithLabelValues(outcome).Inc()
+	if outcome == "error" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.eventChecks++
+	if outcome == "missing" {
+		s.eventMissing++
+	}
+}
+
+// recordSessionUpdate records the outcome of a session state update.
+func (s *Stats) recordSessionUpdate(err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	sessionUpdates.WithLabelValues(outcome).Inc()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessUpdates++
+	if err != nil {
+		s.sessUpdErrs++
+	}
+}
+
+// recordContention records a chat request rejected because of concurrent
+// use of its session. It is counted as an error by recordChat too.
+func (s *Stats) recordContention() {
+	contentionErrors.Inc()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.contention++
+}
+
+// recordStreamAbandoned records a stream closed early on purpose.
+func (s *Stats) recordStreamAbandoned() {
+	streamsAbandoned.Inc()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.abandoned++
+}
+
+// recordAbandonOutcome records what the backend did with an abandoned
+// stream: completed, cancelled or error when it couldn't be checked.
+func (s *Stats) recordAbandonOutcome(outcome string) {
+	abandonedOutcomes.WithLabelValues(outcome).Inc()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.abandonedBy[outcome]++
+}
+
+// recordRace records a session race and the kinds of damage it did, if
+// any.
+func (s *Stats) recordRace(kinds []string) {
+	sessionRaces.Inc()
+	for _, kind := range kinds {
+		sessionRaceAnomalies.WithLabelValues(kind).Inc()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.races++
+	if len(kinds) > 0 {
+		s.racesBad++
+	}
+	for _, kind := range kinds {
+		s.raceKinds[kind]++
+	}
+}
+
+// shortResponse is an example of a reply shorter than MIN_RESPONSE_CHARS.
+type shortResponse struct {
+	Time  time.Time `json:"time"`
+	Chars int       `json:"chars"`
+	Reply string    `json:"reply"`
+}
+
+// maxShortSamples is how many short responses are kept as examples.
+const maxShortSamples = 10
+
+// recordShortResponse records a successful reply of chars characters that
+// is shorter than MIN_RESPONSE_CHARS.
+func (s *Stats) recordShortResponse(reply string, chars int) {
+	shortResponses.Inc()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.short++
+	s.shortSamples = appendShortSamples(s.shortSamples, shortResponse{Time: time.Now(), Chars: chars, Reply: reply})
+}
+
+// appendShortSamples appends samples to dst, keeping only the
+// maxShortSamples most recent.
+func appendShortSamples(dst []shortResponse, samples ...shortResponse) []shortResponse {
+	dst = append(dst, samples...)
+	slices.SortStableFunc(dst, func(a, b shortResponse) int { return a.Time.Compare(b.Time) })
+	return dst[max(0, len(dst)-maxShortSamples):]
+}
+
+// recordStreamAnomaly records a stream that failed the integrity check.
+func (s *Stats) recordStreamAnomaly(a streamAnomaly) {
+	for _, kind := range a.Kinds {
+		streamAnomalies.WithLabelValues(kind).Inc()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.anomalous++
+	s.anomalies = appendAnomalies(s.anomalies, a)
+}
+
+// appendAnomalies appends samples to dst, keeping only the
+// maxShortSamples most recent.
+func appendAnomalies(dst []streamAnomaly, samples ...streamAnomaly) []streamAnomaly {
+	dst = append(dst, samples...)
+	slices.SortStableFunc(dst, func(a, b streamAnomaly) int { return a.Time.Compare(b.Time) })
+	return dst[max(0, len(dst)-maxShortSamples):]
+}
+
+// recordLimiterWait records how long a request waited for a rate limiter token.
+func (s *Stats) recordLimiterWait(d time.Duration) {
+	limiterWaitDuration.Observe(d.Seconds())
+	statsd.timing("limiter.wait", d)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limiterWait.observe(d.Seconds())
+}
+
+// recordConnWait records how long a chat request waited for a connection
+// from the transport's pool.
+func (s *Stats) recordConnWait(d time.Duration) {
+	connWaitDuration.Observe(d.Seconds())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connWait.observe(d.Seconds())
+}
+
+// recordClientQueue records how long a chat request waited between getting
+// its rate limiter token and being sent.
+func (s *Stats) recordClientQueue(d time.Duration) {
+	clientQueueDuration.Observe(d.Seconds())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clientQueue.observe(d.Seconds())
+}
+
+// recordReceiveDelay records how long after being sent the backend says a
+// chat request reached it.
+func (s *Stats) recordReceiveDelay(d time.Duration) {
+	receiveDelayDuration.Observe(d.Seconds())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.receiveDelay.observe(d.Seconds())
+}
+
+// recordServerTime records the processing time the backend reported for a
+// chat request and, unless it exceeds latency, the difference as network
+// overhead.
+func (s *Stats) recordServerTime(d, latency time.Duration) {
+	serverTimeDuration.Observe(d.Seconds())
+	overhead := latency - d
+	if overhead >= 0 {
+		networkOverhead.Observe(overhead.Seconds())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.serverTime.observe(d.Seconds())
+	if overhead >= 0 {
+		s.netOverhead.observe(overhead.Seconds())
+	}
+}
+
+// recordSessionGap records the time between a virtual user's last response
+// in a conversation and its first request on the next session.
+func (s *Stats) recordSessionGap(d time.Duration) {
+	sessionGapDuration.Observe(d.Seconds())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessionGap.observe(d.Seconds())
+}
+
+// recordIteration records how long a virtual user's iteration took, from
+// the start of prompt generation through think time and rate limiting to
+// the chat reply.
+func (s *Stats) recordIteration(d time.Duration) {
+	iterationDuration.Observe(d.Seconds())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.iteration.observe(d.Seconds())
+}
+
+// recordEmptyPrompt records a prompt-generation anomaly where the prompt
+// server returned nothing usable.
+func (s *Stats) recordEmptyPrompt() {
+	emptyPrompts.Inc()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.emptyPrompts++
+}
+
+// recordBlockedPrompt records a generated prompt that matched a blocked
+// pattern.
+func (s *Stats) recordBlockedPrompt() {
+	blockedPromptsTotal.Inc()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blocked++
+}
+
+// recordPromptError records a failed call to the prompt server.
+func (s *Stats) recordPromptError() {
+	promptErrors.Inc()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.promptErrors++
+}
+
+// recordBodyRead records the time between receiving response headers and the
+// end of the body. A response whose longest wait for the body, gap, is over
+// cfg.StallThreshold counts as stalled; for a stream that's the longest gap
+// between its lines, so a long but steady stream isn't.
+func (s *Stats) recordBodyRead(d, gap time.Duration) {
+	stalled := gap > cfg.StallThreshold
+	bodyReadDuration.Observe(d.Seconds())
+	if stalled {
+		stalledResponses.Inc()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bodyRead.observe(d.Seconds())
+	if stalled {
+		s.stalled++
+	}
+}
+
+// recordKeepalives records keepalive comments received on a streamed
+// response.
+func (s *Stats) recordKeepalives(n int) {
+	streamKeepalives.Add(float64(n))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keepalives += uint64(n)
+}
+
+// recordOutOfOrder records a response that completed after one dispatched
+// later on the same session.
+func (s *Stats) recordOutOfOrder() {
+	outOfOrderResponses.Inc()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.outOfOrder++
+}
+
+// recordConversationTokens records the estimated tokens exchanged in a
+// conversation that ended.
+func (s *Stats) recordConversationTokens(tokens int) {
+	conversationTokens.Observe(float64(tokens))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.convTokens.observe(float64(tokens))
+}
+
+// recordConversationReset records a conversation ended by
+// MAX_CONVERSATION_TOKENS.
+func (s *Stats) recordConversationReset() {
+	conversationResets.Inc()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.convResets++
+}
+
+// recordPromptLength records the length of a prompt in characters and in
+// estimated tokens, using the rough rule of four characters per token.
+func (s *Stats) recordPromptLength(prompt string) {
+	chars := float64(utf8.RuneCountInString(prompt))
+	tokens := math.Ceil(chars / 4)
+	overlong := chars > float64(maxChatLen)
+	promptLengthChars.Observe(chars)
+	promptLengthTokens.Observe(tokens)
+	if overlong {
+		overlongPrompts.Inc()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.promptChars.observe(chars)
+	s.promptTokens.observe(tokens)
+	if overlong {
+		s.overlong++
+	}
+}
+
+// completed returns the number of chat requests that have finished, whether
+// or not they succeeded.
+func (s *Stats) completed() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests + s.abandoned
+}
+
+// statsTotals holds copies of the cumulative values pushed to external
+// monitoring systems.
+type statsTotals struct {
+	started      time.Time
+	requests     uint64
+	errors       uint64
+	emptyPrompts uint64
+	latency      *histogram
+	limiterWait  *histogram
+}
+
+func (s *Stats) totals() statsTotals {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return statsTotals{
+		started:      s.started,
+		requests:     s.requests,
+		errors:       s.errors,
+		emptyPrompts: s.emptyPrompts,
+		latency:      s.latency.clone(),
+		limiterWait:  s.limiterWait.clone(),
+	}
+}
+
+func (s *Stats) snapshot() StatsSnapshot {
+	snap := s.report().snapshot()
+	snap.Paused = gate.isPaused()
+	snap.RateLimit = limiterRPM()
+	snap.Endpoints = endpoints.snapshot()
+	snap.ResponseDiversity = diversity.snapshot()
+	return snap
+}
+
+// StatsHandler returns the current run statistics as JSON
+func StatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(stats.snapshot())
+}
+
+// SnapshotHandler writes the current run statistics, as GET /stats returns
+// them, to a file in cfg.SnapshotDir named after the time, so a moment of
+// interest is kept before later results dilute it. It returns the path.
+func SnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().UTC()
+	b, err := json.MarshalIndent(stats.snapshot(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	path := filepath.Join(cfg.SnapshotDir, "stats-"+now.Format("20060102T150405.000Z")+".json")
+	if err := os.WriteFile(path, append(b, '\n'), 0o644); err != nil {
+		slog.Log(r.Context(), slog.LevelError, "Error writing stats snapshot", "path", path, "error", err)
+		http.Error(w, fmt.Sprintf("error writing snapshot: %v", err), http.StatusInternalServerError)
+		return
+	}
+	slog.Log(r.Context(), slog.LevelInfo, "Wrote stats snapshot", "path", path)
+	_ = json.NewEncoder(w).Encode(map[string]string{"path": path})
+}
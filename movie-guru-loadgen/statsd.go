@@ -0,0 +1,89 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statsdEmitter sends metrics to a StatsD server over UDP as they are
+// recorded. With dogStatsD set, tags are added in the DogStatsD format;
+// plain StatsD has no tags, so only the totals are sent.
+type statsdEmitter struct {
+	conn      net.Conn
+	prefix    string
+	dogStatsD bool
+}
+
+// statsd is nil unless STATSD_HOST is set. Its methods are no-ops on nil.
+var statsd *statsdEmitter
+
+func newStatsdEmitter(addr, prefix string, dogStatsD bool) (*statsdEmitter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdEmitter{conn: conn, prefix: prefix, dogStatsD: dogStatsD}, nil
+}
+
+// count sends a counter increment.
+func (e *statsdEmitter) count(name string, n int, tags ...tag) {
+	if e == nil {
+		return
+	}
+	e.send(name, strconv.Itoa(n), "c", tags)
+}
+
+// timing sends a duration in milliseconds.
+func (e *statsdEmitter) timing(name string, d time.Duration, tags ...tag) {
+	if e == nil {
+		return
+	}
+	e.send(name, strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64), "ms", tags)
+}
+
+// flush closes the connection. Metrics are written as they are recorded, so
+// there is nothing buffered to send.
+func (e *statsdEmitter) flush(context.Context) error {
+	return e.conn.Close()
+}
+
+// send writes one metric line. UDP writes don't wait for the server, and a
+// lost packet is only a lost sample, so errors are ignored.
+func (e *statsdEmitter) send(name, value, kind string, tags []tag) {
+	var b strings.Builder
+	b.WriteString(e.prefix)
+	b.WriteString(name)
+	b.WriteByte(':')
+	b.WriteString(value)
+	b.WriteByte('|')
+	b.WriteString(kind)
+	if e.dogStatsD && len(tags) > 0 {
+		b.WriteString("|#")
+		for i, t := range tags {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(t.Key)
+			b.WriteByte(':')
+			b.WriteString(t.Value)
+		}
+	}
+	_, _ = e.conn.Write([]byte(b.String()))
+}
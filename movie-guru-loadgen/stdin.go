@@ -0,0 +1,145 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// maxStdinLine is the longest prompt line accepted on stdin.
+const maxStdinLine = 1 << 20
+
+// runStdin sends each non-empty line read from r to the chat server verbatim
+// and in order, waiting for the rate limiter before each one. With
+// REPLAY_TIMING, lines are "timestamp<TAB>prompt" and are sent with their
+// recorded spacing, divided by REPLAY_SPEED. It stops when r is exhausted or
+// ctx is done and returns the final statistics.
+func runStdin(ctx context.Context, r io.Reader) (StatsSnapshot, error) {
+	slog.Log(ctx, slog.LevelInfo, "Reading prompts from stdin")
+
+	sessions, _, err := startRun(ctx)
+	if err != nil {
+		return StatsSnapshot{}, err
+	}
+	ctx, cancel := context.WithCancelCause(withVU(ctx, 0))
+	defer cancel(nil)
+	stopRun = cancel
+
+	// Scan in the background so an idle stdin doesn't hold up shutdown.
+	lines := make(chan string)
+	scanErr := make(chan error, 1)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 0, 64*1024), maxStdinLine)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-ctx.Done():
+				return
+			}
+		}
+		scanErr <- scanner.Err()
+	}()
+
+	var pacer replayPacer
+	for ctx.Err() == nil {
+		var line string
+		var ok bool
+		select {
+		case line, ok = <-lines:
+		case <-ctx.Done():
+		}
+		if !ok {
+			break
+		}
+		prompt := strings.TrimSpace(line)
+		if cfg.ReplayTiming {
+			var at time.Time
+			if at, prompt = splitTimestamp(prompt); !at.IsZero() && pacer.wait(ctx, at) != nil {
+				break
+			}
+		}
+		if prompt == "" {
+			continue
+		}
+		stats.recordPromptLength(prompt)
+
+		if gate.wait(ctx) != nil {
+			break
+		}
+		waitStart := time.Now()
+		if err := limiter.Wait(ctx); err != nil {
+			break
+		}
+		stats.recordLimiterWait(time.Since(waitStart))
+
+		_, err := sendChat(ctx, sessions.pick(ctx), []part{{Text: prompt}})
+		if err != nil {
+			slog.Log(ctx, slog.LevelError, "Error requesting movie recommendations", "error", err)
+		}
+	}
+
+	select {
+	case err := <-scanErr:
+		if err != nil {
+			slog.Log(context.Background(), slog.LevelError, "Error reading stdin", "error", err)
+		}
+	default:
+	}
+	if errors.Is(context.Cause(ctx), errFailFast) {
+		return finishRun(), errFailFast
+	}
+	return finishRun(), nil
+}
+
+// splitTimestamp splits a "timestamp<TAB>prompt" line. The timestamp is zero
+// when the line has none, or it doesn't parse, and the whole line is the
+// prompt.
+func splitTimestamp(line string) (time.Time, string) {
+	ts, prompt, ok := strings.Cut(line, "\t")
+	if !ok {
+		return time.Time{}, line
+	}
+	at, ok := parseTimestamp(ts)
+	if !ok {
+		return time.Time{}, line
+	}
+	return at, strings.TrimSpace(prompt)
+}
+
+// replayPacer schedules recorded lines relative to the first one, so the
+// replay keeps the recording's pacing, compressed by REPLAY_SPEED, however
+// long each request takes. Lines that are already due are sent right away,
+// and the rate limiter still caps the rate.
+type replayPacer struct {
+	first, start time.Time
+}
+
+// wait blocks until the line recorded at is due, or ctx is done.
+func (p *replayPacer) wait(ctx context.Context, at time.Time) error {
+	if p.first.IsZero() {
+		p.first, p.start = at, time.Now()
+		return nil
+	}
+	due := p.start.Add(time.Duration(float64(at.Sub(p.first)) / cfg.ReplaySpeed))
+	return sleep(ctx, time.Until(due))
+}
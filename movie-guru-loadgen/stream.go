@@ -0,0 +1,97 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maxSSELine is the longest server-sent events line accepted.
+const maxSSELine = 1 << 20
+
+// errStreamIdle means a streaming response went silent, not even sending a
+// keepalive comment, for longer than cfg.StreamIdleTimeout.
+var errStreamIdle = errors.New("stream idle timeout")
+
+// streamResult is what a server-sent events response from /run_sse carried.
+type streamResult struct {
+	events     []adkEvent
+	keepalives int // comment lines, which servers send to keep idle streams open
+	// maxGap is the longest wait for a line, from the headers or the line
+	// before, including the wait after the last line for the end of the
+	// body.
+	maxGap time.Duration
+}
+
+// readStream reads a server-sent events body and returns it with how long it
+// took to arrive once the response headers were received. Every line,
+// keepalive comments included, resets the idle timer; if it fires, cancel
+// aborts the request and errStreamIdle is returned. With abandonAfter set,
+// the stream is closed after that many events and errStreamAbandoned is
+// returned.
+func readStream(resp *http.Response, cancel context.CancelFunc, abandonAfter int) (res streamResult, bodyTime time.Duration, err error) {
+	headersAt := time.Now()
+	var idle atomic.Bool
+	var timer *time.Timer
+	if cfg.StreamIdleTimeout > 0 {
+		timer = time.AfterFunc(cfg.StreamIdleTimeout, func() {
+			idle.Store(true)
+			cancel()
+		})
+		defer timer.Stop()
+	}
+
+	lastAt := headersAt
+	defer func() { res.maxGap = max(res.maxGap, time.Since(lastAt)) }()
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxSSELine)
+	for scanner.Scan() {
+		now := time.Now()
+		res.maxGap, lastAt = max(res.maxGap, now.Sub(lastAt)), now
+		if timer != nil {
+			timer.Reset(cfg.StreamIdleTimeout)
+		}
+		if err := checkBinary(scanner.Bytes()); err != nil {
+			return res, time.Since(headersAt), err
+		}
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, ":"):
+			res.keepalives++
+		case strings.HasPrefix(line, "data:"):
+			var ev adkEvent
+			if err := json.Unmarshal([]byte(strings.TrimSpace(strings.TrimPrefix(line, "data:"))), &ev); err == nil {
+				res.events = append(res.events, ev)
+			}
+		}
+		if abandonAfter > 0 && len(res.events) >= abandonAfter {
+			cancel()
+			return res, time.Since(headersAt), errStreamAbandoned
+		}
+	}
+
+	err = scanner.Err()
+	if idle.Load() {
+		err = errStreamIdle
+	}
+	return res, time.Since(headersAt), err
+}
@@ -0,0 +1,114 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+// Stream integrity anomalies, as reported in stream_anomalies and the kind
+// label of loadgen_stream_anomalies_total.
+const (
+	anomalyDuplicateEvent  = "duplicate_event"   // an event id sent twice
+	anomalyDuplicateChunk  = "duplicate_chunk"   // a partial text repeated back to back
+	anomalyOutOfOrder      = "out_of_order"      // an event older than the one before it
+	anomalyPartialMismatch = "partials_mismatch" // partials that don't add up to the final text
+)
+
+// minDuplicateChunk is the shortest partial text that counts as a
+// duplicate when repeated. Shorter chunks, a word or two, legitimately
+// repeat.
+const minDuplicateChunk = 8
+
+// maxAnomalyChunks caps the partial texts kept with a stream anomaly sample.
+const maxAnomalyChunks = 100
+
+// streamAnomaly is an example of a stream that failed the integrity check.
+type streamAnomaly struct {
+	Time  time.Time `json:"time"`
+	Kinds []string  `json:"kinds"`
+	// Chunks are the stream's model texts in the order received, partial
+	// and final, each cut to bodySnippet's length.
+	Chunks []string `json:"chunks"`
+}
+
+// checkStreamIntegrity looks for signs of a backend streaming bug in the
+// events of a stream and returns the kinds found, or nil.
+func checkStreamIntegrity(events []adkEvent) []string {
+	var kinds []string
+	found := func(kind string) {
+		if !slices.Contains(kinds, kind) {
+			kinds = append(kinds, kind)
+		}
+	}
+
+	seen := make(map[string]bool)
+	var lastTime float64
+	var lastChunk string
+	var partials strings.Builder
+	for _, ev := range events {
+		if ev.ID != "" {
+			if seen[ev.ID] {
+				found(anomalyDuplicateEvent)
+			}
+			seen[ev.ID] = true
+		}
+		if ev.Timestamp > 0 {
+			if ev.Timestamp < lastTime {
+				found(anomalyOutOfOrder)
+			}
+			lastTime = ev.Timestamp
+		}
+
+		c := ev.Content
+		if c == nil || c.Role != "model" {
+			continue
+		}
+		text := messageText(c.Parts)
+		if ev.Partial {
+			if len(text) >= minDuplicateChunk && text == lastChunk {
+				found(anomalyDuplicateChunk)
+			}
+			lastChunk = text
+			partials.WriteString(text)
+			continue
+		}
+		// A final event repeats the text of the partials before it.
+		if partials.Len() > 0 && text != "" && text != partials.String() {
+			found(anomalyPartialMismatch)
+		}
+		partials.Reset()
+		lastChunk = ""
+	}
+	return kinds
+}
+
+// newStreamAnomaly builds the sample kept for a stream with kinds of
+// anomalies.
+func newStreamAnomaly(events []adkEvent, kinds []string) streamAnomaly {
+	a := streamAnomaly{Time: time.Now(), Kinds: kinds}
+	for _, ev := range events {
+		if ev.Content == nil || ev.Content.Role != "model" {
+			continue
+		}
+		if len(a.Chunks) == maxAnomalyChunks {
+			break
+		}
+		a.Chunks = append(a.Chunks, bodySnippet([]byte(messageText(ev.Content.Parts))))
+	}
+	return a
+}
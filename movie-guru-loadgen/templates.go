@@ -0,0 +1,133 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// agePlaceholder is replaced with the user's age in template files, and
+// genresPlaceholder with genreList.
+const (
+	agePlaceholder    = "{age}"
+	genresPlaceholder = "{genres}"
+)
+
+// genres are the genres personas are interested in.
+var genres = []string{"comedy", "horror", "kids", "cartoon", "thriller", "adeventure", "fantasy"}
+
+// genreList returns genres as a comma-separated list. With SHUFFLE_GENRES
+// the order is shuffled for every prompt, so the model isn't nudged towards
+// whichever genres come first.
+func genreList() string {
+	list := genres
+	if cfg.ShuffleGenres {
+		list = slices.Clone(genres)
+		rng.Shuffle(len(list), func(i, j int) { list[i], list[j] = list[j], list[i] })
+	}
+	return strings.Join(list, ", ")
+}
+
+// weightedTemplate is a persona prompt template and its selection weight.
+type weightedTemplate struct {
+	text   string
+	weight int
+}
+
+// ageBand holds the templates used for users aged min to max inclusive.
+type ageBand struct {
+	min, max  int
+	templates []weightedTemplate
+	total     int
+}
+
+// ageBands is loaded from cfg.AgeTemplates. Ages outside every band use
+// userPrompt.
+var ageBands []ageBand
+
+// parseAgeTemplates parses a spec such as
+//
+//	13-19=teen.txt;60-80=senior.txt:3,retired.txt:1
+//
+// where each band maps an inclusive age range to one or more template files,
+// each with an optional weight (default 1).
+func parseAgeTemplates(spec string) ([]ageBand, error) {
+	var bands []ageBand
+	for _, item := range strings.Split(spec, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		ages, files, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("age band %q must look like min-max=file[:weight],...", item)
+		}
+		lo, hi, ok := strings.Cut(ages, "-")
+		if !ok {
+			return nil, fmt.Errorf("age range %q must look like min-max", ages)
+		}
+		band := ageBand{}
+		var err error
+		if band.min, err = strconv.Atoi(strings.TrimSpace(lo)); err != nil {
+			return nil, fmt.Errorf("invalid age range %q: %w", ages, err)
+		}
+		if band.max, err = strconv.Atoi(strings.TrimSpace(hi)); err != nil {
+			return nil, fmt.Errorf("invalid age range %q: %w", ages, err)
+		}
+		if band.min > band.max {
+			return nil, fmt.Errorf("invalid age range %q: min is greater than max", ages)
+		}
+
+		for _, f := range strings.Split(files, ",") {
+			path, w, hasWeight := strings.Cut(strings.TrimSpace(f), ":")
+			weight := 1
+			if hasWeight {
+				if weight, err = strconv.Atoi(w); err != nil || weight < 1 {
+					return nil, fmt.Errorf("invalid weight %q for template %s", w, path)
+				}
+			}
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			band.templates = append(band.templates, weightedTemplate{text: string(b), weight: weight})
+			band.total += weight
+		}
+		bands = append(bands, band)
+	}
+	return bands, nil
+}
+
+// personaPrompt renders the persona prompt for a user of the given age,
+// picking a template from the first band that covers it by weight.
+func personaPrompt(age int) string {
+	for _, band := range ageBands {
+		if age < band.min || age > band.max {
+			continue
+		}
+		n := rng.Intn(band.total)
+		for _, t := range band.templates {
+			if n < t.weight {
+				return strings.NewReplacer(agePlaceholder, strconv.Itoa(age), genresPlaceholder, genreList()).Replace(t.text)
+			}
+			n -= t.weight
+		}
+	}
+	return fmt.Sprintf(userPrompt, age, genreList())
+}
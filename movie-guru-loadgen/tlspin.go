@@ -0,0 +1,88 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// errPinMismatch fails a TLS handshake with a backend whose certificate
+// chain matches none of TLS_PINS.
+var errPinMismatch = errors.New("TLS certificate matches none of TLS_PINS")
+
+// A tlsPin is the SHA-256 of a certificate or of its public key.
+type tlsPin struct {
+	spki bool
+	hash []byte
+}
+
+// tlsPins is parsed from cfg.TLSPins.
+var tlsPins []tlsPin
+
+// parseTLSPins parses pins given as "sha256/<base64>", the SHA-256 of a
+// certificate's DER-encoded public key (SubjectPublicKeyInfo) as in HPKP,
+// or as the hex SHA-256 fingerprint of the whole certificate, with or
+// without colons.
+func parseTLSPins(spec []string) ([]tlsPin, error) {
+	var pins []tlsPin
+	for _, s := range spec {
+		var pin tlsPin
+		var err error
+		if b64, ok := strings.CutPrefix(s, "sha256/"); ok {
+			pin.spki = true
+			pin.hash, err = base64.StdEncoding.DecodeString(b64)
+		} else {
+			pin.hash, err = hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+		}
+		if err != nil || len(pin.hash) != sha256.Size {
+			return nil, fmt.Errorf("%q is neither sha256/<base64 public key hash> nor a hex certificate fingerprint", s)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// verifyPins is a tls.Config.VerifyPeerCertificate that accepts a chain if
+// any certificate in it matches any of tlsPins. It runs after the usual
+// verification, unless INSECURE_SKIP_VERIFY, so pinning a self-signed
+// certificate makes that safe.
+func verifyPins(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	var presented []string
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("error parsing peer certificate: %w", err)
+		}
+		certHash := sha256.Sum256(raw)
+		keyHash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range tlsPins {
+			if (pin.spki && bytes.Equal(pin.hash, keyHash[:])) || (!pin.spki && bytes.Equal(pin.hash, certHash[:])) {
+				return nil
+			}
+		}
+		presented = append(presented, cert.Subject.String()+" sha256/"+base64.StdEncoding.EncodeToString(keyHash[:]))
+	}
+	slog.Log(context.Background(), slog.LevelError, "TLS certificate pin mismatch: the backend isn't the one expected, or an intercepting proxy is in the way", "presented", presented)
+	return errPinMismatch
+}
@@ -0,0 +1,179 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	gcsUploadScope = "https://www.googleapis.com/auth/devstorage.read_write"
+	// gcsUploadURL is the Cloud Storage JSON API media upload endpoint.
+	gcsUploadURL = "https://storage.googleapis.com/upload/storage/v1/b/%s/o"
+)
+
+// parseGCSURI splits gs://bucket/prefix into the bucket and the prefix,
+// without leading or trailing slashes.
+func parseGCSURI(uri string) (bucket, prefix string, err error) {
+	rest, ok := strings.CutPrefix(uri, "gs://")
+	if !ok {
+		return "", "", fmt.Errorf("%q is not a gs:// URI", uri)
+	}
+	bucket, prefix, _ = strings.Cut(rest, "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf("%q has no bucket", uri)
+	}
+	return bucket, strings.Trim(prefix, "/"), nil
+}
+
+// resultsObjectName names a run's bundle after the host and start time so
+// pods uploading to the same prefix don't overwrite each other.
+func resultsObjectName(prefix string) string {
+	host, _ := os.Hostname()
+	if host == "" {
+		host = "loadgen"
+	}
+	name := fmt.Sprintf("%s-%s.tar.gz", host, stats.started.UTC().Format("20060102T150405Z"))
+	if prefix == "" {
+		return name
+	}
+	return path.Join(prefix, name)
+}
+
+// bundleResults returns a gzipped tarball of the run's summary, report and
+// manifest, and of any artifact files it wrote. Files that are configured
+// but missing are skipped.
+func bundleResults(summary StatsSnapshot) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	add := func(name string, b []byte) error {
+		hdr := &tar.Header{Name: name, Mode: 0o644, Size: int64(len(b)), ModTime: time.Now()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(b)
+		return err
+	}
+	addJSON := func(name string, v any) error {
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		return add(name, append(b, '\n'))
+	}
+
+	if err := addJSON("summary.json", summary); err != nil {
+		return nil, err
+	}
+	if err := addJSON("report.json", stats.report()); err != nil {
+		return nil, err
+	}
+	if err := addJSON("manifest.json", newRunManifest()); err != nil {
+		return nil, err
+	}
+	for _, f := range []string{cfg.HARFile, cfg.LatencySeriesFile, cfg.ResponseRecordFile} {
+		if f == "" {
+			continue
+		}
+		b, err := os.ReadFile(f)
+		if err != nil {
+			slog.Log(context.Background(), slog.LevelWarn, "Skipping artifact missing from results bundle", "file", f, "error", err)
+			continue
+		}
+		if err := add(filepath.Base(f), b); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// uploadObject writes body to bucket/name with Application Default
+// Credentials.
+func uploadObject(ctx context.Context, client *http.Client, bucket, name string, body []byte) error {
+	u := fmt.Sprintf(gcsUploadURL, url.PathEscape(bucket)) + "?" + url.Values{
+		"uploadType": {"media"},
+		"name":       {name},
+	}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/gzip")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("upload failed with status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// uploadResults bundles the run's results and uploads them to
+// cfg.ResultsGCSURI. It is best effort: failures are logged, never fatal.
+func uploadResults(summary StatsSnapshot) {
+	bucket, prefix, err := parseGCSURI(cfg.ResultsGCSURI)
+	if err != nil {
+		slog.Log(context.Background(), slog.LevelError, "Error uploading results", "error", err)
+		return
+	}
+	body, err := bundleResults(summary)
+	if err != nil {
+		slog.Log(context.Background(), slog.LevelError, "Error bundling results", "error", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ResultsUploadTimeout)
+	defer cancel()
+	client, err := google.DefaultClient(ctx, gcsUploadScope)
+	if err != nil {
+		slog.Log(context.Background(), slog.LevelError, "Error finding credentials to upload results", "error", err)
+		return
+	}
+	name := resultsObjectName(prefix)
+	if err := uploadObject(ctx, client, bucket, name, body); err != nil {
+		slog.Log(context.Background(), slog.LevelError, "Error uploading results", "bucket", bucket, "object", name, "error", err)
+		return
+	}
+	slog.Log(context.Background(), slog.LevelInfo, "Uploaded results", "uri", "gs://"+bucket+"/"+name, "bytes", len(body))
+}
@@ -0,0 +1,145 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// invalidResponseError is returned for a successful chat response whose
+// events don't hold an answer: the server acknowledged the request but sent
+// no content back.
+type invalidResponseError struct {
+	// reason is a short label for metrics: not_json, not_event_stream,
+	// malformed, no_model_turn, empty_parts or empty_text.
+	reason string
+	detail string
+}
+
+func (e *invalidResponseError) Error() string {
+	return fmt.Sprintf("invalid chat response (%s): %s", e.reason, e.detail)
+}
+
+// bodySnippetLen is how much of an unexpected body is quoted in errors.
+const bodySnippetLen = 200
+
+// checkJSON returns an error describing resp when body is not JSON, such as
+// the HTML error page a misconfigured gateway serves with a 200, so the
+// failure says what came back instead of failing to unmarshal. A body that
+// is valid JSON is accepted whatever its Content-Type.
+func checkJSON(resp *http.Response, body []byte) error {
+	ct := resp.Header.Get("Content-Type")
+	if mt, _, _ := mime.ParseMediaType(ct); mt == "application/json" || strings.HasSuffix(mt, "+json") || json.Valid(body) {
+		return nil
+	}
+	return &invalidResponseError{
+		reason: "not_json",
+		detail: fmt.Sprintf("expected JSON from %s, got Content-Type %q: %q", resp.Request.URL.Path, ct, bodySnippet(body)),
+	}
+}
+
+// checkEventStream returns an error describing resp when a streamed chat
+// response is an HTML page, or anything else that can't hold server-sent
+// events, instead of letting it pass as a stream without events.
+func checkEventStream(resp *http.Response) error {
+	ct := resp.Header.Get("Content-Type")
+	mt, _, _ := mime.ParseMediaType(ct)
+	if ct == "" || mt == "text/event-stream" || mt == "text/plain" || mt == "application/octet-stream" {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, bodySnippetLen+utf8.UTFMax))
+	return &invalidResponseError{
+		reason: "not_event_stream",
+		detail: fmt.Sprintf("expected an event stream from %s, got Content-Type %q: %q", resp.Request.URL.Path, ct, bodySnippet(body)),
+	}
+}
+
+// bodySnippet returns the start of body, cut at a rune boundary, or a
+// binaryPreview of a binary body.
+func bodySnippet(body []byte) string {
+	if isBinary(body) {
+		return binaryPreview(body)
+	}
+	if len(body) <= bodySnippetLen {
+		return string(body)
+	}
+	cut := bodySnippetLen
+	for cut > 0 && !utf8.RuneStart(body[cut]) {
+		cut--
+	}
+	return string(body[:cut]) + "…"
+}
+
+// validateBody decodes a /run response and validates its events.
+func validateBody(body []byte) error {
+	var events []adkEvent
+	if err := json.Unmarshal(body, &events); err != nil {
+		return &invalidResponseError{reason: "malformed", detail: "body is not a list of events: " + err.Error()}
+	}
+	return validateEvents(events)
+}
+
+// validateEvents checks that events end in a model turn shaped like the
+// newMessage that was sent: a "model" role with at least one part, and some
+// text among those parts.
+func validateEvents(events []adkEvent) error {
+	for i := len(events) - 1; i >= 0; i-- {
+		c := events[i].Content
+		if c == nil || c.Role != "model" {
+			continue
+		}
+		if len(c.Parts) == 0 {
+			return &invalidResponseError{reason: "empty_parts", detail: fmt.Sprintf("model turn in event %d of %d has no parts", i+1, len(events))}
+		}
+		for _, p := range c.Parts {
+			if strings.TrimSpace(p.Text) != "" {
+				return nil
+			}
+		}
+		return &invalidResponseError{reason: "empty_text", detail: fmt.Sprintf("model turn in event %d of %d has %d parts but no text", i+1, len(events), len(c.Parts))}
+	}
+	return &invalidResponseError{reason: "no_model_turn", detail: fmt.Sprintf("none of %d events has a model role", len(events))}
+}
+
+// checkResponseLength flags a successful reply shorter than
+// cfg.MinResponseChars. A short reply is a quality failure rather than an
+// error: the request still counts as a success.
+func checkResponseLength(ctx context.Context, reply string) {
+	chars := utf8.RuneCountInString(strings.TrimSpace(reply))
+	if chars >= cfg.MinResponseChars {
+		return
+	}
+	stats.recordShortResponse(reply, chars)
+	slog.Log(ctx, slog.LevelWarn, "Chat server returned a short response", "chars", chars, "min_response_chars", cfg.MinResponseChars)
+}
+
+// logInvalidResponse logs and counts err if it is an invalidResponseError.
+func logInvalidResponse(ctx context.Context, err error) {
+	var ie *invalidResponseError
+	if !errors.As(err, &ie) {
+		return
+	}
+	invalidResponses.WithLabelValues(ie.reason).Inc()
+	slog.Log(ctx, slog.LevelWarn, "Chat server returned an invalid response", "reason", ie.reason, "detail", ie.detail)
+}
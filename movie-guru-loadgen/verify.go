@@ -0,0 +1,106 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// errEventMissing means the chat server answered a request but the user
+// message isn't among the session's stored events.
+var errEventMissing = errors.New("user message not found in session events")
+
+// adkSession is the subset of an ADK session returned by the session
+// endpoint that holds its events.
+type adkSession struct {
+	Events []adkEvent `json:"events"`
+}
+
+// verifyEvents fetches the session's stored events and checks that the user
+// message sent as parts is among them. It returns errEventMissing when it
+// isn't, or another error when the session couldn't be fetched.
+func verifyEvents(ctx context.Context, sess *session, parts []part) error {
+	events, err := fetchSessionEvents(ctx, sess)
+	if err != nil {
+		return err
+	}
+
+	want := messageText(parts)
+	// The newest events are the most likely match, so search backwards.
+	for i := len(events) - 1; i >= 0; i-- {
+		c := events[i].Content
+		if c != nil && c.Role == "user" && messageText(c.Parts) == want {
+			return nil
+		}
+	}
+	return errEventMissing
+}
+
+// fetchSessionEvents returns the events stored in a session, read as its
+// user.
+func fetchSessionEvents(ctx context.Context, sess *session) ([]adkEvent, error) {
+	u := fmt.Sprintf("%s/apps/%s/users/%s/sessions/%s", cfg.ChatServer, url.PathEscape(sess.app), url.PathEscape(sess.user), url.PathEscape(sess.id))
+	req, err := http.NewRequestWithContext(context.WithoutCancel(ctx), "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	setAuthUser(req, sess.user)
+	setVUHeader(ctx, req)
+
+	resp, err := chatClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, &statusError{code: resp.StatusCode}
+	}
+
+	var stored adkSession
+	if err := json.NewDecoder(resp.Body).Decode(&stored); err != nil {
+		return nil, fmt.Errorf("error decoding session: %w", err)
+	}
+	return stored.Events, nil
+}
+
+func messageText(parts []part) string {
+	var text strings.Builder
+	for _, p := range parts {
+		text.WriteString(p.Text)
+	}
+	return text.String()
+}
+
+// checkEvents runs verifyEvents for a request that succeeded and records the
+// outcome. It returns errEventMissing if the message wasn't stored.
+func checkEvents(ctx context.Context, sess *session, parts []part) error {
+	err := verifyEvents(ctx, sess, parts)
+	stats.recordEventCheck(err)
+	switch {
+	case errors.Is(err, errEventMissing):
+		slog.Log(ctx, slog.LevelError, "Chat request succeeded but its message was not stored", "session_id", sess.id)
+		return err
+	case err != nil:
+		slog.Log(ctx, slog.LevelWarn, "Error verifying session events", "error", err)
+	}
+	return nil
+}
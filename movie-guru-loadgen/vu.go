@@ -0,0 +1,79 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// vuHeader carries the virtual user id on chat requests so loadgen logs can
+// be joined with backend logs.
+const vuHeader = "X-VU-ID"
+
+type (
+	vuKey       struct{}
+	vuNumberKey struct{}
+)
+
+// withVU returns a context for virtual user n. Its id, "vu-<n>", is added to
+// every log line written with the context and sent on its chat requests.
+func withVU(ctx context.Context, n int) context.Context {
+	ctx = context.WithValue(ctx, vuNumberKey{}, n)
+	return context.WithValue(ctx, vuKey{}, "vu-"+strconv.Itoa(n))
+}
+
+// vuNumber returns the number of the virtual user in ctx, or 0.
+func vuNumber(ctx context.Context) int {
+	n, _ := ctx.Value(vuNumberKey{}).(int)
+	return n
+}
+
+// vuID returns the virtual user id carried by ctx, or "".
+func vuID(ctx context.Context) string {
+	id, _ := ctx.Value(vuKey{}).(string)
+	return id
+}
+
+// setVUHeader adds the virtual user id in ctx, if any, to req.
+func setVUHeader(ctx context.Context, req *http.Request) {
+	if id := vuID(ctx); id != "" {
+		req.Header.Set(vuHeader, id)
+	}
+}
+
+// contextHandler adds the virtual user id in a record's context to the
+// record, so a worker's log lines identify it without passing a logger
+// around.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := vuID(ctx); id != "" {
+		r.AddAttrs(slog.String("vu", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,391 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// runWorker is a single virtual user. It keeps cfg.SessionInflight
+// conversations going at once, so that many requests can be in flight on a
+// session, until ctx is done.
+func runWorker(ctx context.Context, sessions userSessions) {
+	slog.Log(ctx, slog.LevelInfo, "Virtual user started")
+	defer slog.Log(ctx, slog.LevelInfo, "Virtual user stopped")
+
+	if sleep(ctx, startupJitter.sample()) != nil {
+		return
+	}
+	if cfg.PerUserRate > 0 {
+		ctx = withUserLimiter(ctx)
+	}
+	ctx = withTurnOrder(ctx)
+
+	var wg sync.WaitGroup
+	if cfg.SessionUpdateInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runSessionUpdates(ctx, sessions)
+		}()
+	}
+	for range cfg.SessionInflight - 1 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runConversation(ctx, sessions)
+		}()
+	}
+	runConversation(ctx, sessions)
+	wg.Wait()
+}
+
+// runConversation generates a prompt, waits for the rate limiter and sends
+// the prompt to the chat server until ctx is done. In multi-turn mode each
+// prompt follows on from the previous replies, on the same app's session;
+// otherwise every prompt picks an app afresh.
+func runConversation(ctx context.Context, sessions userSessions) {
+	conv := newConversation()
+	sess := sessions.pick(ctx)
+	defer func() {
+		if len(conv.turns) > 0 {
+			stats.recordConversationTokens(conv.tokens)
+		}
+	}()
+	// ended is when the previous conversation ended, until the first request
+	// on the next session is sent.
+	var answered, ended time.Time
+	for ctx.Err() == nil {
+		iterationStart := time.Now()
+		if !cfg.MultiTurn {
+			conv = newConversation()
+			sess = sessions.pick(ctx)
+		}
+		if gate.wait(ctx) != nil {
+			return
+		}
+		if op := pickOperation(); op != operationRun {
+			// Other operations are paced like chat turns, so API_MIX
+			// doesn't change how often a virtual user sends.
+			if pace(ctx, sess.app, answered) != nil {
+				return
+			}
+			if err := sendOperation(ctx, sess, op); err != nil {
+				slog.Log(ctx, slog.LevelError, "Error sending request", "operation", op, "error", err)
+			}
+			answered = time.Now()
+			stats.recordIteration(answered.Sub(iterationStart))
+			continue
+		}
+		moviePrompt, promptTags, err := nextPrompt(ctx, conv)
+		if err != nil {
+			stats.recordPromptError()
+			slog.Log(ctx, slog.LevelError, "Error generating prompt", "error", err)
+			if cfg.FailFast {
+				failFast(ctx, err, nil)
+				return
+			}
+			if len(fallbackPrompts) > 0 && ctx.Err() == nil {
+				// Keep the chat server under load through a prompt
+				// server outage. Fallback prompts aren't generated, so
+				// their lengths aren't recorded.
+				moviePrompt, promptTags = fallbackPrompt()
+			}
+		}
+		if moviePrompt == "" {
+			_ = sleep(ctx, 1*time.Second)
+			continue
+		}
+
+		// Don't dispatch if load was paused while the prompt was generated.
+		if gate.wait(ctx) != nil {
+			return
+		}
+
+		// Prompt generation counts towards the think time.
+		if pace(ctx, sess.app, answered) != nil {
+			return
+		}
+		if !ended.IsZero() {
+			stats.recordSessionGap(time.Since(ended))
+			ended = time.Time{}
+		}
+
+		parts := messageParts(moviePrompt)
+		messageTag := tag{Key: "message", Value: "single"}
+		if len(parts) > 1 {
+			messageTag.Value = "multipart"
+		}
+		if len(apiMix) > 0 {
+			promptTags = append(promptTags, tag{Key: "operation", Value: operationRun})
+		}
+
+		send := sendChat
+		if pickRace() {
+			send = raceTurns
+		}
+		res, err := send(ctx, sess, parts, append(promptTags, messageTag)...)
+		answered = time.Now()
+		stats.recordIteration(answered.Sub(iterationStart))
+		if err != nil {
+			slog.Log(ctx, slog.LevelError, "Error requesting movie recommendations", "error", err)
+		}
+		if !cfg.MultiTurn {
+			// Every turn is a conversation of its own, and the next one
+			// picks a session afresh.
+			ended = answered
+			if sleep(ctx, sessionCooldown.sample()) != nil {
+				return
+			}
+		} else if err == nil {
+			conv.add(turn{Question: moviePrompt, Answer: res.Reply})
+			if cfg.MaxConversationTokens > 0 && conv.tokens >= cfg.MaxConversationTokens {
+				ended = answered
+				if sleep(ctx, sessionCooldown.sample()) != nil {
+					return
+				}
+				sess = resetConversation(ctx, conv, sess)
+				conv = newConversation()
+			}
+		}
+	}
+}
+
+// pace waits until the virtual user in ctx may send its next request on
+// app. Like a person reading the last reply, a virtual user doesn't send
+// again until a think time, at least MIN_THINK_TIME, after its previous
+// response was answered, however much headroom the rate limiter has. It
+// then waits for the rate limiter, before the request's clock starts, so
+// that throttling isn't reported as chat server latency.
+func pace(ctx context.Context, app string, answered time.Time) error {
+	if !answered.IsZero() {
+		if err := sleep(ctx, sampleThinkTime()-time.Since(answered)); err != nil {
+			return err
+		}
+	}
+	waitStart := time.Now()
+	if err := waitLimits(ctx, app); err != nil {
+		return err
+	}
+	stats.recordLimiterWait(time.Since(waitStart))
+	return nil
+}
+
+// resetConversation ends conv, which has exhausted MAX_CONVERSATION_TOKENS,
+// like a client whose context window is full, and returns a fresh session
+// of sess's app and user to start the next conversation on. If the session can't be
+// created, sess is returned.
+func resetConversation(ctx context.Context, conv *conversation, sess *session) *session {
+	stats.recordConversationTokens(conv.tokens)
+	stats.recordConversationReset()
+	slog.Log(ctx, slog.LevelDebug, "Conversation reached MAX_CONVERSATION_TOKENS, starting over", "tokens", conv.tokens, "turns", len(conv.turns))
+
+	id, err := createSession(sess.app, sess.user)
+	if err != nil {
+		slog.Log(ctx, slog.LevelWarn, "Error creating a fresh session, continuing on the old one", "app", sess.app, "error", err)
+		return sess
+	}
+	return newSession(sess.app, sess.user, id)
+}
+
+// sendChat sends parts on sess and records the result. Failures are retried
+// up to cfg.MaxRetries times, with exponential backoff, while the run's
+// retry budget allows. Every attempt is recorded, so retries never turn a
+// failure into an apparent success. Retries keep the request's canary
+// routing.
+func sendChat(ctx context.Context, sess *session, parts []part, tags ...tag) (chatResponse, error) {
+	budget.request()
+	canary := cfg.CanaryFraction > 0 && rng.Float64() < cfg.CanaryFraction
+	if cfg.CanaryFraction > 0 {
+		trafficTag := tag{Key: "traffic", Value: "baseline"}
+		if canary {
+			trafficTag.Value = "canary"
+		}
+		tags = append(tags, trafficTag)
+	}
+	if len(apps) > 1 {
+		tags = append(tags, tag{Key: "app", Value: sess.app})
+	}
+
+	// Callers send as soon as they have a rate limiter token, so queueing
+	// on the client is measured from here.
+	tokenAt := time.Now()
+	for attempt := 0; ; attempt++ {
+		reqCtx, attemptTags := withTrace(ctx), []tag(nil)
+		timeout := attemptTimeout(attempt)
+		if timeout > 0 {
+			reqCtx = withRequestTimeout(reqCtx, timeout)
+			attemptTags = []tag{{Key: "timeout", Value: timeout.String()}}
+		}
+		if waited, err := endpoints.wait(ctx, chatEndpoint()); err != nil {
+			return chatResponse{}, err
+		} else if waited {
+			tokenAt = time.Now()
+		}
+		release := holdTurn(ctx)
+		seq, inflightTag := sess.begin()
+		stats.recordClientQueue(time.Since(tokenAt))
+		res, err := requestMovieRecommendations(reqCtx, parts, sess, canary)
+		if sess.end(seq) {
+			stats.recordOutOfOrder()
+		}
+		release()
+		if errors.Is(err, errStreamAbandoned) {
+			// Neither a success nor a failure: the loadgen hung up.
+			stats.recordStreamAbandoned()
+			if cfg.StreamAbandonCheckDelay > 0 {
+				// Look for the message as sent, nonce included.
+				abandonChecks.Add(1)
+				go func() {
+					defer abandonChecks.Done()
+					checkAbandoned(ctx, sess, res.Parts)
+				}()
+			}
+			return res, nil
+		}
+		endpoints.record(chatEndpoint(), err)
+		stats.recordTracedChat(traceID(reqCtx), res.Latency, err, slices.Concat(tags, attemptTags, []tag{inflightTag, turnTag(seq)})...)
+		if res.BodyTime > 0 {
+			stats.recordBodyRead(res.BodyTime, res.StallGap)
+		}
+		stats.recordConnWait(res.ConnWait)
+		if contentionError(err) {
+			stats.recordContention()
+		}
+		if res.ReceiveDelay > 0 {
+			stats.recordReceiveDelay(res.ReceiveDelay)
+		}
+		if res.ServerTime > 0 {
+			stats.recordServerTime(res.ServerTime, res.Latency)
+		}
+		if res.Keepalives > 0 {
+			stats.recordKeepalives(res.Keepalives)
+		}
+		if res.Anomaly != nil {
+			stats.recordStreamAnomaly(*res.Anomaly)
+			slog.Log(ctx, slog.LevelWarn, "Chat server stream failed the integrity check", "kinds", res.Anomaly.Kinds, "chunks", len(res.Anomaly.Chunks))
+		}
+
+		if err == nil && cfg.MinResponseChars > 0 {
+			checkResponseLength(ctx, res.Reply)
+		}
+		if err == nil && cfg.VerifyEvents {
+			err = checkEvents(ctx, sess, res.Parts)
+		}
+		if err == nil {
+			responses.record(ctx, messageText(parts), res.Reply)
+			diversity.record(ctx, res.Reply)
+			if timeout > 0 {
+				timeoutTierSuccesses.WithLabelValues(timeout.String()).Inc()
+				if attempt > 0 {
+					slog.Log(ctx, slog.LevelInfo, "Chat request succeeded with an escalated timeout", "attempt", attempt, "timeout", timeout)
+				}
+			}
+		}
+		if err != nil && cfg.FailFast {
+			failFast(ctx, err, res.Exchange)
+			return res, err
+		}
+		if err == nil || attempt >= cfg.MaxRetries || !retryable(err) {
+			return res, err
+		}
+		if !budget.allow() {
+			stats.recordRetryDenied()
+			slog.Log(ctx, slog.LevelWarn, "Retry budget exhausted, not retrying chat request", "error", err)
+			return res, err
+		}
+		stats.recordRetry()
+		slog.Log(ctx, slog.LevelWarn, "Retrying chat request", "attempt", attempt+1, "error", err)
+
+		if sleep(ctx, retryBackoff.sample()<<attempt) != nil {
+			return res, err
+		}
+		waitStart := time.Now()
+		if waitLimits(ctx, sess.app) != nil {
+			return res, err
+		}
+		stats.recordLimiterWait(time.Since(waitStart))
+		tokenAt = time.Now()
+	}
+}
+
+// sleep waits for d or until ctx is done, whichever comes first.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// workerPool runs a resizable set of virtual users. Removing a worker cancels
+// its context; a request it already has in flight still completes.
+type workerPool struct {
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	ctx     context.Context
+	cancels []context.CancelFunc
+	run     func(ctx context.Context, id int)
+}
+
+// newWorkerPool returns a pool running run for each worker. Workers are
+// numbered from 0 in the order they are started; a removed worker's number
+// is reused by the next worker added.
+func newWorkerPool(ctx context.Context, run func(ctx context.Context, id int)) *workerPool {
+	return &workerPool{ctx: ctx, run: run}
+}
+
+// resize starts or stops workers until n are running.
+func (p *workerPool) resize(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for len(p.cancels) < n {
+		ctx, cancel := context.WithCancel(p.ctx)
+		id := len(p.cancels)
+		p.cancels = append(p.cancels, cancel)
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.run(ctx, id)
+		}()
+	}
+	for len(p.cancels) > n {
+		last := len(p.cancels) - 1
+		p.cancels[last]()
+		p.cancels = p.cancels[:last]
+	}
+	virtualUsers.Set(float64(len(p.cancels)))
+}
+
+func (p *workerPool) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.cancels)
+}
+
+// stop removes every worker and waits for their in-flight requests.
+func (p *workerPool) stop() {
+	p.resize(0)
+	p.wg.Wait()
+}